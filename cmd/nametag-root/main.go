@@ -0,0 +1,156 @@
+// nametag-root creates the next root document which assigns the keys to the roles
+// (see imagestore.Root). The document is added to imagestore.RootFile in the image directory,
+// the server publishes the list and the clients verify each root by the previous one.
+//
+//	nametag-root -root root_key_1,root_key_2 -root-threshold 2 -targets targets_key \
+//		-snapshot snapshot_key -timestamp timestamp_key -roots data/root.json > root.json
+//
+// The empty file name is the embedded key. The new root is signed by its root keys,
+// the next root is signed by the root keys of the previous root too, add them with -sign
+// if they are changed.
+// The keys are RSA, Ed25519 or minisign private keys, see sign.Load,
+// the minisign keys are decrypted by NAMETAG_SIGN_KEY_PASSWORD.
+// The output is the json list of the existing documents from -roots with the new one appended.
+package main
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"log"
+	"os"
+	"strings"
+	"time"
+
+	"nametag/internal/imagestore"
+	"nametag/internal/signature/sign"
+)
+
+func main() {
+	keys := map[string]*string{
+		imagestore.RoleRoot:      flag.String("root", "", "comma separated private keys of the root role"),
+		imagestore.RoleTargets:   flag.String("targets", "", "comma separated private keys of the targets role"),
+		imagestore.RoleSnapshot:  flag.String("snapshot", "", "comma separated private keys of the snapshot role"),
+		imagestore.RoleTimestamp: flag.String("timestamp", "", "comma separated private keys of the timestamp role"),
+	}
+	thresholds := map[string]*int{
+		imagestore.RoleRoot:      flag.Int("root-threshold", 1, "the number of the root keys which sign the next root"),
+		imagestore.RoleTargets:   flag.Int("targets-threshold", 1, "the number of the targets keys which sign the releases"),
+		imagestore.RoleSnapshot:  flag.Int("snapshot-threshold", 1, "the number of the snapshot keys which sign the snapshot"),
+		imagestore.RoleTimestamp: flag.Int("timestamp-threshold", 1, "the number of the timestamp keys which sign the timestamp"),
+	}
+	expires := flag.Duration("expires", 365*24*time.Hour, "the lifetime of the root")
+	signKeys := flag.String("sign", "", "comma separated private keys of the previous root which sign the new one too")
+	rootsFile := flag.String("roots", "", "the existing root documents, e.g. data/root.json")
+	flag.Parse()
+
+	password := os.Getenv("NAMETAG_SIGN_KEY_PASSWORD")
+	roots := make([]*imagestore.Signed, 0)
+	if *rootsFile != "" {
+		b, err := os.ReadFile(*rootsFile)
+		if err != nil && !os.IsNotExist(err) {
+			log.Fatal(err)
+		}
+		if len(b) > 0 {
+			if err := json.Unmarshal(b, &roots); err != nil {
+				log.Fatal(err)
+			}
+		}
+	}
+
+	r := &imagestore.Root{
+		Version:   1,
+		ExpiresAt: time.Now().UTC().Truncate(time.Second).Add(*expires),
+		Keys:      map[string]imagestore.PublicKey{},
+		Roles:     map[string]imagestore.Role{},
+	}
+	if len(roots) > 0 {
+		last, err := lastRoot(roots[len(roots)-1])
+		if err != nil {
+			log.Fatal(err)
+		}
+		r.Version = last.Version + 1
+	}
+
+	var rootSigners []sign.Signer
+	var err error
+	for role, files := range keys {
+		var signers []sign.Signer
+		signers, err = loadSigners(*files, password)
+		if err != nil {
+			log.Fatal(err)
+		}
+
+		ids := make([]string, 0, len(signers))
+		for _, s := range signers {
+			r.Keys[s.KeyID()] = imagestore.PublicKey{Alg: s.Alg(), Key: s.PublicKey()}
+			ids = append(ids, s.KeyID())
+		}
+		r.Roles[role] = imagestore.Role{KeyIDs: ids, Threshold: *thresholds[role]}
+
+		if role == imagestore.RoleRoot {
+			rootSigners = signers
+		}
+	}
+	if err := r.Check(); err != nil {
+		log.Fatal(err)
+	}
+
+	var previous []sign.Signer
+	if *signKeys != "" {
+		previous, err = loadSigners(*signKeys, password)
+		if err != nil {
+			log.Fatal(err)
+		}
+	}
+
+	signed, err := imagestore.NewSigned(rootSigners[0], r)
+	if err != nil {
+		log.Fatal(err)
+	}
+	for _, s := range append(rootSigners[1:], previous...) {
+		if err := signed.AddSignature(s); err != nil {
+			log.Fatal(err)
+		}
+	}
+
+	b, err := json.MarshalIndent(append(roots, signed), "", "  ")
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	log.Printf("root %d is signed by %d keys, expires at %s", r.Version, len(signed.AllSignatures()), r.ExpiresAt.Format(time.RFC3339))
+	fmt.Println(string(b))
+}
+
+// loadSigners loads the comma separated private keys, the empty name is the embedded key.
+func loadSigners(files, password string) ([]sign.Signer, error) {
+	signers := make([]sign.Signer, 0)
+	for _, fileName := range strings.Split(files, ",") {
+		var s sign.Signer
+		var err error
+		if fileName == "" {
+			s, err = sign.New()
+		} else {
+			s, err = sign.Load(fileName, password)
+		}
+		if err != nil {
+			return nil, err
+		}
+		signers = append(signers, s)
+	}
+
+	return signers, nil
+}
+
+// lastRoot decodes the payload of the last root document, it's verified by the clients.
+func lastRoot(s *imagestore.Signed) (*imagestore.Root, error) {
+	b, err := base64.URLEncoding.DecodeString(s.Payload)
+	if err != nil {
+		return nil, err
+	}
+
+	r := &imagestore.Root{}
+	return r, json.Unmarshal(b, r)
+}
@@ -0,0 +1,153 @@
+// nametag-sign adds the signature of one more key to the releases, the rollback directive,
+// the revocation list and the key rotations of the manifest, so the clients which require
+// several signatures accept them (see updater.Options.SignatureThreshold). It's run offline by each release key holder:
+//
+//	curl -s http://server:8080/releases > releases.json
+//	nametag-sign -key release_key_1 < releases.json > cosign.json
+//	nametag-sign -key release_key_2 < cosign.json > data/cosign.json
+//
+// The input may be a list of the signed documents too, e.g. data/keys.json.
+// The minisign key is decrypted by NAMETAG_SIGN_KEY_PASSWORD.
+//
+// With -dir it signs the copy of the image directory on the air-gapped machine instead:
+// it writes the detached signatures of the images (imagestore.SidecarExt) and of the documents
+// of the manifest (imagestore.ManifestSidecarFile), the server built with the offline tag
+// publishes them without any private key. The patches signed with the releases are made there too:
+//
+//	nametag-sign -key release_key -dir data [-targets targets_key -snapshot snapshot_key -timestamp timestamp_key]
+//	rsync -a data/*.sig data/patches server:data/
+//
+// The server can't renew the offline signatures, sign the directory again before -timestamp-ttl is passed
+// (a day by default, the longer one weakens the protection against the stale manifests).
+package main
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/json"
+	"flag"
+	"io"
+	"log"
+	"os"
+
+	"nametag/internal/imagestore"
+	"nametag/internal/signature/sign"
+)
+
+func main() {
+	keyFile := flag.String("key", "", "the private key, see sign.Load")
+	dir := flag.String("dir", "", "the image directory to write the sidecar signatures, the same path as on the server")
+	roleKeys := map[string]*string{
+		imagestore.RoleTargets:   flag.String("targets", "", "the private key of the targets role for -dir, -key by default"),
+		imagestore.RoleSnapshot:  flag.String("snapshot", "", "the private key of the snapshot role for -dir, -key by default"),
+		imagestore.RoleTimestamp: flag.String("timestamp", "", "the private key of the timestamp role for -dir, -key by default"),
+	}
+	releaseTTL := flag.Duration("release-ttl", imagestore.DefaultReleaseTTL, "the lifetime of the release signatures for -dir")
+	snapshotTTL := flag.Duration("snapshot-ttl", imagestore.DefaultSnapshotTTL, "the lifetime of the snapshot for -dir")
+	timestampTTL := flag.Duration("timestamp-ttl", imagestore.DefaultTimestampTTL,
+		"the lifetime of the timestamp for -dir, the clients accept the stale manifest for so long")
+	flag.Parse()
+
+	if *keyFile == "" {
+		flag.Usage()
+		os.Exit(2)
+	}
+
+	signer, err := sign.Load(*keyFile, os.Getenv("NAMETAG_SIGN_KEY_PASSWORD"))
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	if *dir != "" {
+		im := imagestore.New("", *dir, signer)
+		im.SetReleaseTTL(*releaseTTL)
+		im.SetSnapshotTTL(*snapshotTTL)
+		im.SetTimestampTTL(*timestampTTL)
+
+		for role, fileName := range roleKeys {
+			if *fileName == "" {
+				continue
+			}
+
+			s, err := sign.Load(*fileName, os.Getenv("NAMETAG_SIGN_KEY_PASSWORD"))
+			if err != nil {
+				log.Fatal(err)
+			}
+			im.SetRoleSigner(role, s)
+		}
+
+		if err := im.ScanImagesInDir(); err != nil {
+			log.Fatal(err)
+		}
+		if err := im.WriteSidecars(); err != nil {
+			log.Fatal(err)
+		}
+
+		log.Printf("signed %d images in %s", len(im.Images), *dir)
+		return
+	}
+
+	in, err := io.ReadAll(os.Stdin)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	var out any
+	if in = bytes.TrimSpace(in); bytes.HasPrefix(in, []byte("[")) {
+		documents := make([]*imagestore.Signed, 0)
+		if err := json.Unmarshal(in, &documents); err != nil {
+			log.Fatal(err)
+		}
+		if err := signAll(signer, documents); err != nil {
+			log.Fatal(err)
+		}
+		out = documents
+	} else {
+		m := &imagestore.Manifest{}
+		if err := json.Unmarshal(in, m); err != nil {
+			log.Fatal(err)
+		}
+
+		documents := make([]*imagestore.Signed, 0, len(m.Releases)+len(m.Rotations))
+		for _, image := range m.Releases {
+			if image != nil && image.Release != nil {
+				documents = append(documents, image.Release)
+			}
+		}
+		documents = append(documents, m.Rollback, m.Revoked)
+		if err := signAll(signer, append(documents, m.Rotations...)); err != nil {
+			log.Fatal(err)
+		}
+		out = m
+	}
+
+	b, err := json.MarshalIndent(out, "", "  ")
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	if _, err := os.Stdout.Write(append(b, '\n')); err != nil {
+		log.Fatal(err)
+	}
+}
+
+// signAll signs the documents, the signed json is printed to check what is signed.
+func signAll(signer sign.Signer, documents []*imagestore.Signed) error {
+	for _, s := range documents {
+		if s == nil {
+			continue
+		}
+
+		payload, err := base64.URLEncoding.DecodeString(s.Payload)
+		if err != nil {
+			return err
+		}
+		if err := s.AddSignature(signer); err != nil {
+			return err
+		}
+
+		log.Printf("signed by %s key %s: %s", signer.Alg(), signer.KeyID(), payload)
+	}
+
+	return nil
+}
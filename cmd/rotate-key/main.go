@@ -0,0 +1,145 @@
+// rotate-key creates the key rotation document: the new key cross-signed by the old one
+// and signed by itself, so the clients know that the new key is held by the signer.
+// The document is added to imagestore.RotationFile in the image directory,
+// the server publishes it and the clients start to trust the new key.
+//
+//	rotate-key -new new_key [-old old_key] [-generate rsa|ed25519] [-retire id1,id2] -keys data/keys.json > keys.json
+//
+// The old key is the embedded one by default. The keys are RSA, Ed25519 or minisign keys,
+// see sign.Load, the minisign keys are decrypted by NAMETAG_OLD_KEY_PASSWORD and NAMETAG_NEW_KEY_PASSWORD.
+// The output is the json list of the existing documents from -keys with the new one appended.
+package main
+
+import (
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/json"
+	"encoding/pem"
+	"flag"
+	"fmt"
+	"log"
+	"os"
+	"strings"
+
+	"nametag/internal/imagestore"
+	"nametag/internal/signature/sign"
+)
+
+func main() {
+	oldKey := flag.String("old", "", "the private key which the clients trust, the embedded one by default")
+	newKey := flag.String("new", "", "the new private key")
+	generate := flag.String("generate", "", "generate the new rsa or ed25519 key into the -new file")
+	retire := flag.String("retire", "", "comma separated ids of the keys which are not trusted anymore")
+	keys := flag.String("keys", "", "the existing rotation documents, e.g. data/keys.json")
+	flag.Parse()
+
+	if *newKey == "" {
+		flag.Usage()
+		os.Exit(2)
+	}
+
+	if *generate != "" {
+		if err := generateKey(*newKey, *generate); err != nil {
+			log.Fatal(err)
+		}
+	}
+
+	oldSigner, err := loadSigner(*oldKey, os.Getenv("NAMETAG_OLD_KEY_PASSWORD"))
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	newSigner, err := sign.Load(*newKey, os.Getenv("NAMETAG_NEW_KEY_PASSWORD"))
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	r := &imagestore.KeyRotation{
+		KeyID: newSigner.KeyID(),
+		Alg:   newSigner.Alg(),
+		Key:   newSigner.PublicKey(),
+	}
+	if *retire != "" {
+		r.Retire = strings.Split(*retire, ",")
+	}
+	if err := r.Check(); err != nil {
+		log.Fatal(err)
+	}
+
+	signed, err := imagestore.NewSigned(oldSigner, r)
+	if err != nil {
+		log.Fatal(err)
+	}
+	if err := signed.AddSignature(newSigner); err != nil {
+		log.Fatal(err)
+	}
+
+	rotations := make([]*imagestore.Signed, 0)
+	if *keys != "" {
+		b, err := os.ReadFile(*keys)
+		if err != nil && !os.IsNotExist(err) {
+			log.Fatal(err)
+		}
+		if len(b) > 0 {
+			if err := json.Unmarshal(b, &rotations); err != nil {
+				log.Fatal(err)
+			}
+		}
+	}
+
+	b, err := json.MarshalIndent(append(rotations, signed), "", "  ")
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	log.Printf("%s key %s is signed by the %s key %s", newSigner.Alg(), newSigner.KeyID(), oldSigner.Alg(), oldSigner.KeyID())
+	fmt.Println(string(b))
+}
+
+func loadSigner(fileName, password string) (sign.Signer, error) {
+	if fileName == "" {
+		return sign.New()
+	}
+
+	return sign.Load(fileName, password)
+}
+
+// generateKey writes the new RSA key in PKCS1 form or the new Ed25519 key in PEM encoded PKCS8 form.
+func generateKey(fileName, alg string) error {
+	var b []byte
+	switch alg {
+	case "rsa":
+		key, err := rsa.GenerateKey(rand.Reader, 2048)
+		if err != nil {
+			return err
+		}
+		b = x509.MarshalPKCS1PrivateKey(key)
+	case "ed25519":
+		_, key, err := ed25519.GenerateKey(rand.Reader)
+		if err != nil {
+			return err
+		}
+		der, err := x509.MarshalPKCS8PrivateKey(key)
+		if err != nil {
+			return err
+		}
+		b = pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: der})
+	default:
+		return fmt.Errorf("unknown key type %q", alg)
+	}
+
+	// the existing key is never overwritten
+	f, err := os.OpenFile(fileName, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0600)
+	if err != nil {
+		return err
+	}
+
+	if _, err := f.Write(b); err != nil {
+		_ = f.Close()
+		return err
+	}
+
+	return f.Close()
+}
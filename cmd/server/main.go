@@ -6,13 +6,13 @@ import (
 	"fmt"
 	"log"
 	"net/http"
+	"os"
 	"strings"
 	"time"
 
 	"golang.org/x/sync/errgroup"
 
 	"nametag/internal/imagestore"
-	"nametag/internal/signature/sign"
 )
 
 const (
@@ -27,34 +27,95 @@ const (
 	// ScanFrequency specifies how often the image repository should check the catalog for new images.
 	// todo: move to configuration
 	ScanFrequency = 2 * time.Second
+
+	// NextCheckAfter asks the clients to check the manifest not more often. 0 means no limit.
+	// todo: move to configuration
+	NextCheckAfter = 0 * time.Second
+
+	// ReleaseTTL is the lifetime of the release signatures, they are re-signed when half of it is left.
+	// todo: move to configuration
+	ReleaseTTL = imagestore.DefaultReleaseTTL
+
+	// TimestampTTL is the lifetime of the manifest timestamp, the clients reject the manifest after it.
+	// todo: move to configuration
+	TimestampTTL = imagestore.DefaultTimestampTTL
+
+	// EnvSignKey is the private key file of the server after the key rotation, the embedded key by default.
+	// EnvSignKeyPassword decrypts the minisign key.
+	EnvSignKey         = "NAMETAG_SIGN_KEY"
+	EnvSignKeyPassword = "NAMETAG_SIGN_KEY_PASSWORD"
+
+	// SnapshotTTL is the lifetime of the snapshot, it's re-signed when half of it is left.
+	// todo: move to configuration
+	SnapshotTTL = imagestore.DefaultSnapshotTTL
+
+	// RetryAfter is sent to the clients with the server errors.
+	RetryAfter = "60"
 )
 
+// EnvRoleKeys are the private key files of the roles of the root document,
+// the role without the key is signed by the server key. EnvSignKeyPassword decrypts them too.
+var EnvRoleKeys = map[string]string{
+	imagestore.RoleTargets:   "NAMETAG_TARGETS_KEY",
+	imagestore.RoleSnapshot:  "NAMETAG_SNAPSHOT_KEY",
+	imagestore.RoleTimestamp: "NAMETAG_TIMESTAMP_KEY",
+}
+
 type countHandler struct {
 	im *imagestore.AllImages
 }
 
 func (h *countHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 	if strings.HasPrefix(r.URL.Path, HttpDir) {
-		http.ServeFile(w, r, r.URL.Path[1:])
+		fileName := r.URL.Path[1:]
+
+		// ServeFile handles Range and If-Range by the ETag,
+		// so the updater can resume the interrupted download
+		if info, err := os.Stat(fileName); err == nil && !info.IsDir() {
+			w.Header().Set("ETag", fmt.Sprintf(`"%x-%x"`, info.ModTime().UnixNano(), info.Size()))
+		}
+
+		http.ServeFile(w, r, fileName)
+		return
+	}
+
+	var body []byte
+	var err error
+	switch r.URL.Path {
+	case imagestore.ManifestPath:
+		body, err = h.im.GetManifest(r.Header.Get(imagestore.InstanceHeader))
+	case imagestore.ReleasesPath:
+		body, err = h.im.GetReleases()
+	default:
+		body, err = h.im.GetLastImage()
+	}
+
+	if err != nil {
+		log.Println(err)
+		w.Header().Set("Retry-After", RetryAfter)
+		http.Error(w, "internal error", http.StatusInternalServerError)
 		return
 	}
 
 	w.Header().Set("Content-Type", "application/json")
-	_, err := fmt.Fprintf(w, "%s\n\n", h.im.LastImage)
+	_, err = fmt.Fprintf(w, "%s\n\n", body)
 	if err != nil {
 		log.Println(err)
 	}
 }
 
 func main() {
-	singer, err := sign.New()
+	im, err := newImages()
 	if err != nil {
 		log.Fatal(err)
 	}
 
-	im := imagestore.New(HttpDir, StorageDir, singer)
 	ctx, cancel := context.WithCancel(context.Background())
 	im.SetScanFrequency(ScanFrequency)
+	im.SetNextCheckAfter(NextCheckAfter)
+	im.SetReleaseTTL(ReleaseTTL)
+	im.SetTimestampTTL(TimestampTTL)
+	im.SetSnapshotTTL(SnapshotTTL)
 
 	srv := &http.Server{}
 	srv.Handler = &countHandler{im: im}
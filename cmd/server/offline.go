@@ -0,0 +1,26 @@
+//go:build offline
+
+package main
+
+import (
+	"log"
+
+	"nametag/internal/imagestore"
+	"nametag/internal/signature/verify"
+)
+
+// newImages returns the image repository without the private key, the server is built by
+//
+//	go build -tags offline ./cmd/server
+//
+// so the binary doesn't embed the key. It publishes the images and the documents
+// signed offline by cmd/nametag-sign, the sidecars are checked by the embedded public keys.
+func newImages() (*imagestore.AllImages, error) {
+	ver, err := verify.New()
+	if err != nil {
+		return nil, err
+	}
+
+	log.Printf("Offline signing, trusted keys: %v", ver.KeyIDs())
+	return imagestore.NewOffline(HttpDir, StorageDir, ver), nil
+}
@@ -0,0 +1,43 @@
+//go:build !offline
+
+package main
+
+import (
+	"os"
+
+	"nametag/internal/imagestore"
+	"nametag/internal/signature/sign"
+)
+
+// newImages returns the image repository which signs the images and the documents of the manifest
+// by the server key and the role keys.
+func newImages() (*imagestore.AllImages, error) {
+	var singer sign.Signer
+	var err error
+	if fileName := os.Getenv(EnvSignKey); fileName != "" {
+		singer, err = sign.Load(fileName, os.Getenv(EnvSignKeyPassword))
+	} else {
+		singer, err = sign.New()
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	im := imagestore.New(HttpDir, StorageDir, singer)
+
+	// the root keys are offline, the server has the keys of the other roles only
+	for role, env := range EnvRoleKeys {
+		fileName := os.Getenv(env)
+		if fileName == "" {
+			continue
+		}
+
+		s, err := sign.Load(fileName, os.Getenv(EnvSignKeyPassword))
+		if err != nil {
+			return nil, err
+		}
+		im.SetRoleSigner(role, s)
+	}
+
+	return im, nil
+}
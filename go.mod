@@ -3,20 +3,23 @@ module nametag
 go 1.21.3
 
 require (
+	aead.dev/minisign v0.2.0
+	github.com/dsnet/compress v0.0.1
 	github.com/hashicorp/go-version v1.7.0
+	github.com/klauspost/compress v1.17.11
 	github.com/libp2p/go-reuseport v0.4.0
 	github.com/minio/selfupdate v0.6.0
 	github.com/pkg/errors v0.9.1
 	github.com/sirupsen/logrus v1.9.3
 	github.com/stretchr/testify v1.7.0
+	github.com/ulikunitz/xz v0.5.12
 	golang.org/x/sync v0.8.0
+	golang.org/x/sys v0.0.0-20220715151400-c0bba94af5f8
 )
 
 require (
-	aead.dev/minisign v0.2.0 // indirect
 	github.com/davecgh/go-spew v1.1.1 // indirect
 	github.com/pmezard/go-difflib v1.0.0 // indirect
 	golang.org/x/crypto v0.0.0-20211209193657-4570a0811e8b // indirect
-	golang.org/x/sys v0.0.0-20220715151400-c0bba94af5f8 // indirect
 	gopkg.in/yaml.v3 v3.0.0-20200313102051-9f266ea9e77c // indirect
 )
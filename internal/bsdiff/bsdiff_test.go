@@ -0,0 +1,54 @@
+package bsdiff_test
+
+import (
+	"bytes"
+	"encoding/binary"
+	"math/rand"
+	"testing"
+
+	"github.com/minio/selfupdate"
+	"github.com/stretchr/testify/assert"
+
+	"nametag/internal/bsdiff"
+)
+
+func Test_DiffPatch(t *testing.T) {
+	rnd := rand.New(rand.NewSource(1))
+
+	old := make([]byte, 64*1024)
+	rnd.Read(old)
+
+	// the new version is the old one with some changes
+	new := append([]byte("header"), old...)
+	copy(new[1000:], "changed")
+	new = append(new, "footer"...)
+
+	patch := &bytes.Buffer{}
+	assert.Nil(t, bsdiff.Diff(bytes.NewReader(old), bytes.NewReader(new), patch), "Diff")
+	assert.Less(t, patch.Len(), len(new)/4, "patch is small")
+
+	result := &bytes.Buffer{}
+	err := selfupdate.NewBSDiffPatcher().Patch(bytes.NewReader(old), result, bytes.NewReader(patch.Bytes()))
+	assert.Nil(t, err, "Patch")
+	assert.Equal(t, new, result.Bytes())
+}
+
+func Test_CheckHeader(t *testing.T) {
+	old := bytes.Repeat([]byte("app.v1.0.0 "), 1000)
+	new := bytes.Repeat([]byte("app.v2.0.0 "), 1000)
+
+	patch := &bytes.Buffer{}
+	assert.Nil(t, bsdiff.Diff(bytes.NewReader(old), bytes.NewReader(new), patch), "Diff")
+	size := int64(patch.Len())
+
+	assert.Nil(t, bsdiff.CheckHeader(bytes.NewReader(patch.Bytes()), size, int64(len(new))))
+	assert.NotNil(t, bsdiff.CheckHeader(bytes.NewReader(patch.Bytes()), size, int64(len(new))+1), "other new size")
+	assert.NotNil(t, bsdiff.CheckHeader(bytes.NewReader(patch.Bytes()[:20]), size, int64(len(new))), "short header")
+
+	// the forged control lengths: -1 in the sign-magnitude encoding and larger than the patch
+	for _, n := range []uint64{1 | 1<<63, uint64(size)} {
+		forged := append([]byte{}, patch.Bytes()...)
+		binary.LittleEndian.PutUint64(forged[8:], n)
+		assert.NotNil(t, bsdiff.CheckHeader(bytes.NewReader(forged), size, int64(len(new))), "control length %x", n)
+	}
+}
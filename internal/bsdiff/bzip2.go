@@ -0,0 +1,13 @@
+package bsdiff
+
+import (
+	"io"
+
+	"github.com/dsnet/compress/bzip2"
+)
+
+// Package compress/bzip2 implements only decompression,
+// so the writer is taken from github.com/dsnet/compress.
+func newBzip2Writer(w io.Writer) (io.WriteCloser, error) {
+	return bzip2.NewWriter(w, &bzip2.WriterConfig{Level: bzip2.BestCompression})
+}
@@ -0,0 +1,31 @@
+// Package bsdiff implements binary diff as described on
+// http://www.daemonology.net/bsdiff/. It writes files
+// compatible with the tools there and with selfupdate.NewBSDiffPatcher.
+//
+// It's a port of github.com/kr/binarydist (see License), which is vendored
+// by github.com/minio/selfupdate as an internal package, so only the patch
+// part can be used from there. The bzip2 compression is done in-process
+// instead of running the bzip2 tool.
+package bsdiff
+
+var magic = [8]byte{'B', 'S', 'D', 'I', 'F', 'F', '4', '0'}
+
+// File format:
+//
+//	0       8    "BSDIFF40"
+//	8       8    X
+//	16      8    Y
+//	24      8    sizeof(newfile)
+//	32      X    bzip2(control block)
+//	32+X    Y    bzip2(diff block)
+//	32+X+Y  ???  bzip2(extra block)
+//
+// with control block a set of triples (x,y,z) meaning "add x bytes
+// from oldfile to x bytes from the diff block; copy y bytes from the
+// extra block; seek forwards in oldfile by z bytes".
+type header struct {
+	Magic   [8]byte
+	CtrlLen int64
+	DiffLen int64
+	NewSize int64
+}
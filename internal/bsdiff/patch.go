@@ -0,0 +1,33 @@
+package bsdiff
+
+import (
+	"encoding/binary"
+	"io"
+
+	"github.com/pkg/errors"
+)
+
+// HeaderSize is the size of the patch header, see header.
+const HeaderSize = 32
+
+// CheckHeader reads the header of the patch of patchSize bytes and checks that it makes
+// the file of newSize bytes. bspatch allocates the buffers by the lengths of the header,
+// so the forged ones must be rejected before the patch is applied.
+func CheckHeader(r io.Reader, patchSize, newSize int64) error {
+	var hdr header
+	if err := binary.Read(r, signMagLittleEndian{}, &hdr); err != nil {
+		return errors.Wrap(err, "patch header")
+	}
+
+	if hdr.Magic != magic {
+		return errors.Errorf("patch header: bad magic")
+	}
+	if hdr.NewSize != newSize {
+		return errors.Errorf("patch header: new size %d, expected %d", hdr.NewSize, newSize)
+	}
+	if hdr.CtrlLen < 0 || hdr.DiffLen < 0 || hdr.CtrlLen > patchSize-HeaderSize || hdr.DiffLen > patchSize-HeaderSize-hdr.CtrlLen {
+		return errors.Errorf("patch header: block lengths %d and %d exceed the patch size %d", hdr.CtrlLen, hdr.DiffLen, patchSize)
+	}
+
+	return nil
+}
@@ -0,0 +1,285 @@
+// Package compress decompresses the artifacts of the image server.
+// The compression is selected by the extension of the file: ".gz", ".zst" or ".xz".
+package compress
+
+import (
+	"bytes"
+	"compress/gzip"
+	"encoding/binary"
+	"io"
+	"strings"
+
+	"github.com/klauspost/compress/zstd"
+	"github.com/pkg/errors"
+	"github.com/ulikunitz/xz"
+	"github.com/ulikunitz/xz/lzma"
+)
+
+// Supported compressions, None is the raw file.
+const (
+	None = ""
+	Gzip = "gzip"
+	Zstd = "zstd"
+	Xz   = "xz"
+)
+
+// MaxWindow is the largest window (dictionary) of the compressed data, 128 MiB fits
+// zstd --ultra -22 and xz -9. The decoder allocates it before the data is checked,
+// so the data with the larger window is rejected.
+const MaxWindow = 128 << 20
+
+// TooLargeError is returned by the reader of LimitReader after the limit.
+var TooLargeError = errors.Errorf("size limit exceeded")
+
+var extensions = map[string]string{
+	".gz":  Gzip,
+	".zst": Zstd,
+	".xz":  Xz,
+}
+
+// FromFileName returns the compression by the extension and the file name without the extension.
+func FromFileName(fileName string) (compression, name string) {
+	for ext, c := range extensions {
+		if strings.HasSuffix(fileName, ext) {
+			return c, strings.TrimSuffix(fileName, ext)
+		}
+	}
+
+	return None, fileName
+}
+
+// Check checks that the compression is supported.
+func Check(compression string) error {
+	switch compression {
+	case None, Gzip, Zstd, Xz:
+		return nil
+	}
+
+	return errors.Errorf("unsupported compression %q", compression)
+}
+
+// NewReader returns the reader of the decompressed data from r.
+// Close releases the decoder, it doesn't close r.
+func NewReader(r io.Reader, compression string) (io.ReadCloser, error) {
+	switch compression {
+	case None:
+		return io.NopCloser(r), nil
+	case Gzip:
+		return gzip.NewReader(r)
+	case Zstd:
+		d, err := zstd.NewReader(r,
+			zstd.WithDecoderMaxMemory(MaxWindow), zstd.WithDecoderMaxWindow(MaxWindow), zstd.WithDecoderConcurrency(1))
+		if err != nil {
+			return nil, err
+		}
+		return d.IOReadCloser(), nil
+	case Xz:
+		// DictCap is the least dictionary, the larger one of the block is used instead
+		d, err := xz.ReaderConfig{DictCap: lzma.MinDictCap, SingleStream: true}.NewReader(&xzChecker{r: r})
+		if err != nil {
+			return nil, err
+		}
+		return io.NopCloser(d), nil
+	}
+
+	return nil, Check(compression)
+}
+
+const (
+	xzStreamHeaderLen = 12
+	xzFilterLZMA2     = 0x21
+)
+
+// xzCheckSizes are the sizes of the block checks by the check type of the stream flags.
+var xzCheckSizes = [16]int64{0, 4, 4, 4, 8, 8, 8, 16, 16, 16, 32, 32, 32, 64, 64, 64}
+
+// The parts of the xz stream which xzChecker reads.
+const (
+	xzStreamHeader = iota
+	xzBlockHeader
+	xzChunkHeader
+	xzDone // the index or the broken stream, the rest isn't checked
+)
+
+// xzChecker passes the xz stream to the xz reader and checks the dictionary in each block header
+// before the reader gets it: the xz reader allocates any dictionary of the block header. It follows
+// the blocks by the headers of the LZMA2 chunks and skips their data. The broken stream is passed as is,
+// it's reported by the xz reader.
+type xzChecker struct {
+	r io.Reader
+
+	part      int
+	header    []byte // the part of the header which is read
+	skip      int64  // the bytes to pass before the next header
+	blockSize int64  // the size of the block header and the chunks for the block padding
+	checkSize int64
+}
+
+func (c *xzChecker) Read(p []byte) (int, error) {
+	n, err := c.r.Read(p)
+	if err := c.scan(p[:n]); err != nil {
+		return 0, err
+	}
+
+	return n, err
+}
+
+// scan follows the stream by the bytes b which are passed to the xz reader.
+func (c *xzChecker) scan(b []byte) error {
+	for len(b) > 0 && c.part != xzDone {
+		if c.skip > 0 {
+			k := min(c.skip, int64(len(b)))
+			c.skip -= k
+			b = b[k:]
+			continue
+		}
+
+		c.header = append(c.header, b[0])
+		b = b[1:]
+
+		complete, err := c.next()
+		if err != nil {
+			return err
+		}
+		if complete {
+			c.header = c.header[:0]
+		}
+	}
+
+	return nil
+}
+
+// next checks the header of the current part and reports whether it's complete.
+func (c *xzChecker) next() (bool, error) {
+	h := c.header
+	switch c.part {
+	case xzStreamHeader:
+		if len(h) < xzStreamHeaderLen {
+			return false, nil
+		}
+		if !bytes.HasPrefix(h, xzHeader) {
+			c.part = xzDone
+			return true, nil
+		}
+		c.checkSize = xzCheckSizes[h[7]&0x0f]
+		c.part = xzBlockHeader
+
+	case xzBlockHeader:
+		// the index indicator follows the last block
+		if h[0] == 0 {
+			c.part = xzDone
+			return true, nil
+		}
+		if len(h) < (int(h[0])+1)*4 {
+			return false, nil
+		}
+		if err := checkXzBlockHeader(h); err != nil {
+			return false, err
+		}
+		c.blockSize = int64(len(h))
+		c.part = xzChunkHeader
+
+	case xzChunkHeader:
+		// the LZMA2 chunk: the end of the block, the uncompressed chunk with its size
+		// or the LZMA chunk with its unpacked and packed sizes and optional properties
+		var size int64
+		switch control := h[0]; {
+		case control == 0:
+			c.blockSize++
+			c.skip = (4-c.blockSize%4)%4 + c.checkSize
+			c.part = xzBlockHeader
+			return true, nil
+		case control <= 2:
+			if len(h) < 3 {
+				return false, nil
+			}
+			size = int64(binary.BigEndian.Uint16(h[1:])) + 1
+		case control >= 0x80:
+			if len(h) < 5 || (control >= 0xc0 && len(h) < 6) {
+				return false, nil
+			}
+			size = int64(binary.BigEndian.Uint16(h[3:])) + 1
+		default:
+			c.part = xzDone
+			return true, nil
+		}
+		c.blockSize += int64(len(h)) + size
+		c.skip = size
+	}
+
+	return true, nil
+}
+
+// xzHeader is the magic of the xz stream.
+var xzHeader = []byte{0xfd, '7', 'z', 'X', 'Z', 0}
+
+// checkXzBlockHeader checks the dictionary of the LZMA2 filter in the block header h.
+func checkXzBlockHeader(h []byte) error {
+	// the block header: the size, the flags, the optional sizes, the filters and their properties
+	flags := h[1]
+	h = h[2:]
+	for _, present := range []bool{flags&0x40 != 0, flags&0x80 != 0} {
+		if present {
+			if _, n := binary.Uvarint(h); n > 0 {
+				h = h[n:]
+			}
+		}
+	}
+
+	for i := 0; i <= int(flags&0x03) && len(h) > 0; i++ {
+		id, n := binary.Uvarint(h)
+		if n <= 0 {
+			return nil
+		}
+		h = h[n:]
+
+		size, n := binary.Uvarint(h)
+		if n <= 0 || uint64(len(h)-n) < size {
+			return nil
+		}
+		props := h[n : n+int(size)]
+		h = h[n+int(size):]
+
+		if id == xzFilterLZMA2 && size == 1 {
+			dictCap, err := lzma.DecodeDictCap(props[0])
+			if err != nil {
+				return nil
+			}
+			if dictCap > MaxWindow {
+				return errors.Errorf("xz: dictionary %d is larger than %d", dictCap, MaxWindow)
+			}
+		}
+	}
+
+	return nil
+}
+
+// LimitReader returns the reader which fails with TooLargeError after n bytes,
+// unlike io.LimitReader the truncated data can't be taken for the complete one.
+func LimitReader(r io.Reader, n int64) io.Reader {
+	return &limitedReader{r: r, n: n}
+}
+
+type limitedReader struct {
+	r io.Reader
+	n int64
+}
+
+func (l *limitedReader) Read(p []byte) (int, error) {
+	if l.n < 0 {
+		return 0, TooLargeError
+	}
+
+	// read one byte more than the limit to find out that it's exceeded
+	if int64(len(p)) > l.n+1 {
+		p = p[:l.n+1]
+	}
+
+	n, err := l.r.Read(p)
+	l.n -= int64(n)
+	if l.n < 0 {
+		return n + int(l.n), TooLargeError
+	}
+
+	return n, err
+}
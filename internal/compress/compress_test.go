@@ -0,0 +1,162 @@
+package compress_test
+
+import (
+	"bytes"
+	"compress/gzip"
+	"encoding/binary"
+	"hash/crc32"
+	"io"
+	"math/rand"
+	"testing"
+
+	"github.com/klauspost/compress/zstd"
+	"github.com/stretchr/testify/assert"
+	"github.com/ulikunitz/xz"
+
+	"nametag/internal/compress"
+)
+
+func compressed(t *testing.T, compression string, data []byte) []byte {
+	buf := &bytes.Buffer{}
+
+	var w io.WriteCloser
+	var err error
+	switch compression {
+	case compress.Gzip:
+		w = gzip.NewWriter(buf)
+	case compress.Zstd:
+		w, err = zstd.NewWriter(buf)
+	case compress.Xz:
+		w, err = xz.NewWriter(buf)
+	}
+	assert.Nil(t, err, "NewWriter")
+
+	_, err = w.Write(data)
+	assert.Nil(t, err, "Write")
+	assert.Nil(t, w.Close(), "Close")
+
+	return buf.Bytes()
+}
+
+func Test_NewReader(t *testing.T) {
+	data := bytes.Repeat([]byte("nametag "), 10000)
+
+	for _, c := range []string{compress.Gzip, compress.Zstd, compress.Xz} {
+		b := compressed(t, c, data)
+		assert.Less(t, len(b), len(data)/10, c)
+
+		r, err := compress.NewReader(bytes.NewReader(b), c)
+		if !assert.Nil(t, err, c) {
+			continue
+		}
+
+		got, err := io.ReadAll(r)
+		assert.Nil(t, err, c)
+		assert.Equal(t, data, got, c)
+		assert.Nil(t, r.Close(), c)
+
+		// the decompression bomb is stopped
+		r, err = compress.NewReader(bytes.NewReader(b), c)
+		assert.Nil(t, err, c)
+		_, err = io.ReadAll(compress.LimitReader(r, int64(len(data)-1)))
+		assert.ErrorIs(t, err, compress.TooLargeError, c)
+	}
+
+	_, err := compress.NewReader(bytes.NewReader(nil), "lz4")
+	assert.NotNil(t, err)
+}
+
+func Test_NewReaderWindow(t *testing.T) {
+	// the zstd frame of "hello" with the 256 MiB window
+	b := []byte{0x28, 0xb5, 0x2f, 0xfd, 0x00, 0x90, 0x29, 0x00, 0x00, 'h', 'e', 'l', 'l', 'o'}
+	r, err := compress.NewReader(bytes.NewReader(b), compress.Zstd)
+	if assert.Nil(t, err, "NewReader") {
+		_, err = io.ReadAll(r)
+		assert.NotNil(t, err, "zstd window")
+	}
+
+	// the xz stream with the 256 MiB dictionary in the block header
+	b = compressed(t, compress.Xz, []byte("hello"))
+	header := b[12:24]
+	assert.Equal(t, byte(0x21), header[2], "LZMA2 filter")
+	header[4] = 0x20
+	binary.LittleEndian.PutUint32(header[8:], crc32.ChecksumIEEE(header[:8]))
+	r, err = compress.NewReader(bytes.NewReader(b), compress.Xz)
+	if assert.Nil(t, err, "NewReader") {
+		_, err = io.ReadAll(r)
+		assert.NotNil(t, err, "xz dictionary")
+	}
+
+	header[4] = 0x1a
+	binary.LittleEndian.PutUint32(header[8:], crc32.ChecksumIEEE(header[:8]))
+	r, err = compress.NewReader(bytes.NewReader(b), compress.Xz)
+	if assert.Nil(t, err, "NewReader") {
+		got, err := io.ReadAll(r)
+		assert.Nil(t, err, "the dictionary of 32 MiB")
+		assert.Equal(t, "hello", string(got))
+	}
+}
+
+func Test_NewReaderXzBlocks(t *testing.T) {
+	// the incompressible part is stored in the uncompressed chunks
+	rnd := rand.New(rand.NewSource(1))
+	data := make([]byte, 300_000)
+	rnd.Read(data[:100_000])
+	copy(data[100_000:], bytes.Repeat([]byte("app.v1.2.3 "), 20_000))
+
+	buf := &bytes.Buffer{}
+	w, err := xz.WriterConfig{DictCap: 1 << 16, BlockSize: 64 << 10}.NewWriter(buf)
+	assert.Nil(t, err, "NewWriter")
+	_, err = w.Write(data)
+	assert.Nil(t, err, "Write")
+	assert.Nil(t, w.Close(), "Close")
+	b := buf.Bytes()
+
+	r, err := compress.NewReader(bytes.NewReader(b), compress.Xz)
+	if assert.Nil(t, err, "NewReader") {
+		got, err := io.ReadAll(r)
+		assert.Nil(t, err, "ReadAll")
+		assert.Equal(t, data, got, "all the blocks")
+	}
+
+	// the blocks have the same headers, the last one declares the 1 GiB dictionary
+	header := append([]byte{}, b[12:12+(int(b[12])+1)*4]...)
+	i := bytes.LastIndex(b, header)
+	if !assert.Greater(t, i, 12, "the last block") {
+		return
+	}
+	last := b[i : i+len(header)]
+	last[4] = 0x24
+	binary.LittleEndian.PutUint32(last[len(last)-4:], crc32.ChecksumIEEE(last[:len(last)-4]))
+
+	r, err = compress.NewReader(bytes.NewReader(b), compress.Xz)
+	if assert.Nil(t, err, "NewReader") {
+		_, err = io.ReadAll(r)
+		if assert.NotNil(t, err, "the dictionary of the last block") {
+			assert.Contains(t, err.Error(), "dictionary")
+		}
+	}
+}
+
+func Test_LimitReader(t *testing.T) {
+	got, err := io.ReadAll(compress.LimitReader(bytes.NewReader([]byte("12345")), 5))
+	assert.Nil(t, err, "exactly the limit")
+	assert.Equal(t, "12345", string(got))
+
+	got, err = io.ReadAll(compress.LimitReader(bytes.NewReader([]byte("123456")), 5))
+	assert.ErrorIs(t, err, compress.TooLargeError)
+	assert.Equal(t, "12345", string(got))
+}
+
+func Test_FromFileName(t *testing.T) {
+	for name, want := range map[string][2]string{
+		"app.v1.2.3":                    {compress.None, "app.v1.2.3"},
+		"app.v1.2.3.gz":                 {compress.Gzip, "app.v1.2.3"},
+		"app.v1.2.3.linux-amd64-v3.zst": {compress.Zstd, "app.v1.2.3.linux-amd64-v3"},
+		"app.v1.2.3.xz":                 {compress.Xz, "app.v1.2.3"},
+	} {
+		c, base := compress.FromFileName(name)
+		assert.Equal(t, want[0], c, name)
+		assert.Equal(t, want[1], base, name)
+	}
+}
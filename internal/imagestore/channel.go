@@ -0,0 +1,69 @@
+package imagestore
+
+import (
+	"strings"
+
+	"github.com/hashicorp/go-version"
+	"github.com/pkg/errors"
+)
+
+// Release channels from the most stable to the least stable one.
+// A channel also follows the releases of the more stable channels,
+// e.g. the beta channel gets a stable release if it's newer than the last beta.
+const (
+	ChannelStable  = "stable"
+	ChannelBeta    = "beta"
+	ChannelNightly = "nightly"
+
+	DefaultChannel = ChannelStable
+)
+
+var channels = []string{ChannelStable, ChannelBeta, ChannelNightly}
+
+// Channels returns all known channels from the most stable to the least stable one.
+func Channels() []string {
+	return append([]string(nil), channels...)
+}
+
+// channelRank returns the position of the channel in channels or -1.
+func channelRank(channel string) int {
+	for i, c := range channels {
+		if c == channel {
+			return i
+		}
+	}
+
+	return -1
+}
+
+// CheckChannel returns an error for an unknown channel.
+func CheckChannel(channel string) error {
+	if channelRank(channel) < 0 {
+		return errors.Errorf("unknown channel %q, expected one of %s", channel, strings.Join(channels, ", "))
+	}
+
+	return nil
+}
+
+// Follows reports whether the subscribers of the channel get the releases of the releaseChannel.
+func Follows(channel, releaseChannel string) bool {
+	r := channelRank(releaseChannel)
+	return r >= 0 && r <= channelRank(channel)
+}
+
+// ChannelFromVersion gets the channel from the pre-release part of the version:
+// v1.2.3 is stable, v1.2.3-nightly.20240901 is nightly.
+// Unknown pre-releases (v1.2.3-rc.1) go to the beta channel, they are never stable.
+func ChannelFromVersion(v *version.Version) string {
+	pre := v.Prerelease()
+	if pre == "" {
+		return ChannelStable
+	}
+
+	name, _, _ := strings.Cut(pre, ".")
+	if channelRank(name) > 0 {
+		return name
+	}
+
+	return ChannelBeta
+}
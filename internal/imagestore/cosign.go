@@ -0,0 +1,122 @@
+package imagestore
+
+import (
+	"encoding/json"
+	"log"
+	"path"
+	"slices"
+	"sort"
+	"time"
+)
+
+// CosignFile is the manifest co-signed offline by the release keys (see cmd/nametag-sign)
+// in the image directory. The server adds its signatures to the releases, the rollback directive
+// and the revocation list with the same signed json, so the clients which require several signatures
+// accept them. The co-signed releases are not re-signed before they expire, the co-signers renew them.
+const CosignFile = "cosign.json"
+
+// ReleasesPath is the uri of all releases on the image server, the co-signers sign them
+// before the staged rollouts start.
+const ReleasesPath = "/releases"
+
+// GetReleases returns the json of the manifest with all the published releases
+// and the other documents of the targets role.
+func (im *AllImages) GetReleases() ([]byte, error) {
+	im.mx.RLock()
+	defer im.mx.RUnlock()
+
+	m := &Manifest{Rotations: im.rotations, Rollback: im.rollback, Revoked: im.revokedSigned}
+	for name := range im.Images {
+		image := im.Images[name]
+		if im.revoked.Revoked(image.Version) == nil {
+			m.Releases = append(m.Releases, &image)
+		}
+	}
+	sort.Slice(m.Releases, func(i, j int) bool {
+		return m.Releases[i].Image < m.Releases[j].Image
+	})
+
+	return json.Marshal(m)
+}
+
+// loadCosignatures reads the co-signed manifest if it was changed.
+func (im *AllImages) loadCosignatures() error {
+	im.mx.RLock()
+	lastModTime := im.cosignModTime
+	im.mx.RUnlock()
+
+	m := &Manifest{}
+	modTime, changed, err := readDocument(path.Join(im.dir, CosignFile), lastModTime, m)
+	if err != nil {
+		im.skipDocument(&im.cosignModTime, modTime)
+		return err
+	}
+	if !changed {
+		return nil
+	}
+
+	// the signatures are found by the hash of the signed json
+	cosignatures := map[string][]Signature{}
+	documents := []*Signed{m.Rollback, m.Revoked}
+	for _, image := range m.Releases {
+		if image != nil {
+			documents = append(documents, image.Release)
+		}
+	}
+	for _, s := range documents {
+		if s != nil {
+			cosignatures[s.FileSum] = append(cosignatures[s.FileSum], s.AllSignatures()...)
+		}
+	}
+
+	im.mx.Lock()
+	im.cosignatures, im.cosignModTime = cosignatures, modTime
+	im.mx.Unlock()
+
+	log.Printf("Loaded co-signatures of %d documents", len(cosignatures))
+	return nil
+}
+
+// applyCosignatures adds the co-signatures to the documents with the same signed json.
+func (im *AllImages) applyCosignatures() {
+	im.mx.Lock()
+	defer im.mx.Unlock()
+
+	for name, image := range im.Images {
+		if r, ok := im.cosign(image.Release); ok {
+			image.Release = r
+			im.Images[name] = image
+			log.Printf("Release %s has %d co-signatures", image.Image, len(r.Signatures))
+		}
+	}
+
+	if r, ok := im.cosign(im.rollback); ok {
+		im.rollback = r
+	}
+	if r, ok := im.cosign(im.revokedSigned); ok {
+		im.revokedSigned = r
+	}
+}
+
+// cosign returns the copy of the document with the co-signatures if they are changed,
+// the document isn't changed in place, the manifests are built from it.
+func (im *AllImages) cosign(s *Signed) (*Signed, bool) {
+	if s == nil {
+		return nil, false
+	}
+
+	r := *s
+	r.Signatures = nil
+	r.Merge(im.cosignatures[r.FileSum]...)
+	if slices.Equal(r.Signatures, s.Signatures) {
+		return nil, false
+	}
+
+	return &r, true
+}
+
+// cosigned reports whether the release of the image is co-signed and isn't expired,
+// it must not be re-signed then.
+func (image *Image) cosigned(now time.Time) bool {
+	return image.Release != nil && len(image.Release.Signatures) > 0 && now.Before(image.expiresAt)
+}
@@ -0,0 +1,132 @@
+package imagestore
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/base64"
+	"os"
+	"path"
+	"sort"
+
+	"github.com/hashicorp/go-version"
+	"github.com/pkg/errors"
+
+	"nametag/internal/bsdiff"
+)
+
+const (
+	// PatchDir is the subdirectory of the image directory for the binary patches.
+	PatchDir = "patches"
+
+	// DefaultPatchCount is the number of the previous versions
+	// for which the patches to the new version are generated.
+	DefaultPatchCount = 3
+)
+
+// Patch is the bsdiff patch from the previous version to the image.
+// The patches are signed in the Release, the clients check FileSum before they apply the patch.
+type Patch struct {
+	From    *version.Version `json:"from"`
+	BaseSum string           `json:"base_sum"` // FileSum of the previous version
+	Uri     string           `json:"uri"`
+	Size    int64            `json:"size"`
+	FileSum string           `json:"file_sum"` // sha256 of the patch file
+}
+
+func (im *AllImages) SetPatchCount(patchCount int) {
+	im.patchCount = patchCount
+}
+
+// previousImages returns up to patchCount images of the platform with the lower versions, the newest first.
+func (im *AllImages) previousImages(ver *version.Version, platform Platform) []Image {
+	im.mx.RLock()
+	defer im.mx.RUnlock()
+
+	out := make([]Image, 0, len(im.Images))
+	for _, image := range im.Images {
+		if image.Version.LessThan(ver) && image.Platform == platform.String() {
+			out = append(out, image)
+		}
+	}
+
+	sort.Slice(out, func(i, j int) bool {
+		return out[j].Version.LessThan(out[i].Version)
+	})
+
+	if len(out) > im.patchCount {
+		out = out[:im.patchCount]
+	}
+
+	return out
+}
+
+// makePatches generates the patches from the previous versions to the new image.
+// The existing patch files are reused after the restart.
+func (im *AllImages) makePatches(fileName string, ver *version.Version, platform Platform, compression string) ([]Patch, error) {
+	if im.patchCount <= 0 {
+		return nil, nil
+	}
+
+	patchDir := path.Join(im.dir, PatchDir)
+	if err := os.MkdirAll(patchDir, 0755); err != nil {
+		return nil, errors.Wrap(err, "patch dir")
+	}
+
+	patches := make([]Patch, 0, im.patchCount)
+	for _, base := range im.previousImages(ver, platform) {
+		patchName := path.Join(patchDir, base.Image+"_"+fileName+".bsdiff")
+
+		data, err := os.ReadFile(patchName)
+		if os.IsNotExist(err) {
+			if err := makePatch(path.Join(im.dir, base.Image), base.Compression, path.Join(im.dir, fileName), compression, patchName); err != nil {
+				return nil, errors.Wrapf(err, "patch from %s to %s", base.Image, fileName)
+			}
+			data, err = os.ReadFile(patchName)
+		}
+		if err != nil {
+			return nil, err
+		}
+
+		sum := sha256.Sum256(data)
+		patches = append(patches, Patch{
+			From:    base.Version,
+			BaseSum: base.FileSum,
+			Uri:     patchName,
+			Size:    int64(len(data)),
+			FileSum: base64.URLEncoding.EncodeToString(sum[:]),
+		})
+	}
+
+	return patches, nil
+}
+
+func makePatch(oldName, oldCompression, newName, newCompression, patchName string) error {
+	// the patches are made for the uncompressed images
+	oldData, err := readImage(oldName, oldCompression)
+	if err != nil {
+		return err
+	}
+
+	newData, err := readImage(newName, newCompression)
+	if err != nil {
+		return err
+	}
+
+	// write to the temporary file, the half-written patch must not be published after a crash
+	tmpName := patchName + ".tmp"
+	patchFile, err := os.Create(tmpName)
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmpName)
+
+	if err := bsdiff.Diff(bytes.NewReader(oldData), bytes.NewReader(newData), patchFile); err != nil {
+		_ = patchFile.Close()
+		return err
+	}
+	if err := patchFile.Close(); err != nil {
+		return err
+	}
+
+	return os.Rename(tmpName, patchName)
+}
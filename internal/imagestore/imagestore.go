@@ -2,11 +2,14 @@ package imagestore
 
 // AllImages is a struct that holds all the images in the image repository.
 // It provides methods to add new images and scan the image directory for new images.
-// For each added file, it calculates a sha256 hash and signs it with a private key.
+// For each added file, it calculates a sha256 hash and signs it with a private key,
+// the release fields used by the clients are signed together with the hash (see release.go).
+// The offline repository holds no private key, it checks the signatures made offline instead (see sidecar.go).
+// Each image belongs to a release channel (see channel.go), the manifest contains
+// the last image for each channel which is rolled out for the client (see rollout.go).
 
 import (
 	"context"
-	"crypto/sha512"
 	"encoding/base64"
 	"encoding/json"
 	"io"
@@ -15,23 +18,36 @@ import (
 	"path"
 	"path/filepath"
 	"regexp"
+	"sort"
+	"strings"
 	"sync"
 	"time"
 
 	"github.com/hashicorp/go-version"
 	"github.com/pkg/errors"
+
+	"nametag/internal/compress"
 )
 
 const (
+	// MaxImageSize limits the uncompressed image, it protects the server from the decompression bombs.
+	MaxImageSize = 1 << 30
+
 	// DefaultScanFrequency specifies how often the image repository should check the catalog for new images.
 	// todo: move to configuration
 	DefaultScanFrequency = 10 * time.Second
 )
 
-var releaseVersion = regexp.MustCompile(`\.(v[0-9.]+)$`)
+// releaseVersion matches "app.v1.2.3", "app.v1.2.3-beta.1" and the platform builds "app.v1.2.3.linux-amd64-v3"
+var releaseVersion = regexp.MustCompile(`\.(v[0-9.]+(?:-[0-9A-Za-z.]+)?)(?:\.([0-9a-z]+-[0-9a-z]+(?:-v[0-9]+)?))?$`)
 
+// Signer returns the hash of the data and the signature of the hash.
+// KeyID identifies the key, so the clients with several trusted keys know which one to use.
+// Alg is the signature algorithm, see the signature package.
 type Signer interface {
-	SignFile(string) ([]byte, []byte, error)
+	Sign([]byte) ([]byte, []byte, error)
+	KeyID() string
+	Alg() string
 }
 
 type Image struct {
@@ -41,6 +57,26 @@ type Image struct {
 	FileSum   string           `json:"file_sum"`
 	Sign      string           `json:"sign"`
 	Version   *version.Version `json:"version"`
+	Channel   string           `json:"channel"`
+	Platform  string           `json:"platform,omitempty"`
+
+	// Compression of the file, FileSum and Size are of the uncompressed image
+	Compression string  `json:"compression,omitempty"`
+	Size        int64   `json:"size,omitempty"`
+	Rollout     Rollout `json:"rollout,omitempty"`
+	Patches     []Patch `json:"patches,omitempty"`
+
+	// Critical releases are applied by the clients outside the maintenance windows
+	Critical bool `json:"critical,omitempty"`
+
+	// Release is the signed Release, the clients trust only its fields
+	Release   *Signed `json:"release"`
+	expiresAt time.Time
+
+	// metadataModTime is used to reload the changed sidecar metadata,
+	// sidecarModTimes are of the sidecar signature and metadata of the offline server
+	metadataModTime time.Time
+	sidecarModTimes [2]time.Time
 }
 
 type AllImages struct {
@@ -50,8 +86,65 @@ type AllImages struct {
 	dir           string
 	Sing          Signer
 	Images        map[string]Image
-	LastImage     string // json string for quick access to last image
 	scanFrequency time.Duration
+	patchCount    int
+	releaseTTL    time.Duration
+
+	// nextCheckAfter is sent to the clients in the manifest
+	nextCheckAfter time.Duration
+
+	// rollback is the signed directive from RollbackFile, nil if there is no rollback
+	// or its target isn't published, rollbackDirective has the target sums it was signed with
+	rollback          *Signed
+	rollbackDirective *Rollback
+	rollbackModTime   time.Time
+
+	// revoked are the versions from RevokedFile, they are not published
+	revoked        *Revocations
+	revokedSigned  *Signed
+	revokedModTime time.Time
+
+	// rotations are the key rotation documents from RotationFile, they are signed offline by the old keys
+	rotations        []*Signed
+	rotationsModTime time.Time
+
+	// roleSigners sign the documents of the roles instead of Sing
+	roleSigners map[string]Signer
+
+	// roots are the signed Root documents from RootFile
+	roots        []*Signed
+	rootsModTime time.Time
+
+	// snapshot pins the signed documents of the targets role
+	snapshot       Snapshot
+	snapshotSigned *Signed
+	snapshotTTL    time.Duration
+
+	// cosignatures are the signatures from CosignFile by the hash of the signed release
+	cosignatures  map[string][]Signature
+	cosignModTime time.Time
+
+	// timestamp is the signed freshness of the manifest
+	timestamp       Timestamp
+	timestampSigned *Signed
+	timestampTTL    time.Duration
+
+	// verifier checks the sidecar signatures of the offline server which has no private key (see sidecar.go),
+	// unsigned are the modification times of the sidecars of the images without the valid signatures
+	verifier               Verifier
+	unsigned               map[string][2]time.Time
+	manifestSidecarModTime time.Time
+
+	// notImages are the files without the version in the name, they're reported once
+	notImages map[string]bool
+
+	// badMetadata are the modification times of the bad sidecar metadata of the new images,
+	// the images are not published until it's changed
+	badMetadata map[string]time.Time
+
+	// badImages are the modification times of the images which can't be decompressed
+	// or patched, e.g. the half-uploaded ones, they are retried when the file is changed
+	badImages map[string]time.Time
 }
 
 func New(httpDir, dir string, sign Signer) *AllImages {
@@ -61,6 +154,13 @@ func New(httpDir, dir string, sign Signer) *AllImages {
 		Sing:          sign,
 		Images:        map[string]Image{},
 		scanFrequency: DefaultScanFrequency,
+		patchCount:    DefaultPatchCount,
+		releaseTTL:    DefaultReleaseTTL,
+		timestampTTL:  DefaultTimestampTTL,
+		snapshotTTL:   DefaultSnapshotTTL,
+		notImages:     map[string]bool{},
+		badMetadata:   map[string]time.Time{},
+		badImages:     map[string]time.Time{},
 	}
 }
 
@@ -68,6 +168,11 @@ func (im *AllImages) SetScanFrequency(scanFrequency time.Duration) {
 	im.scanFrequency = scanFrequency
 }
 
+// SetNextCheckAfter asks the clients to check the manifest not more often than d.
+func (im *AllImages) SetNextCheckAfter(d time.Duration) {
+	im.nextCheckAfter = d
+}
+
 func (im *AllImages) CheckFile(fileName string) bool {
 	im.mx.RLock()
 	defer im.mx.RUnlock()
@@ -77,73 +182,234 @@ func (im *AllImages) CheckFile(fileName string) bool {
 }
 
 func (im *AllImages) AddFile(fileName string) error {
-	ver, err := GetVersion(fileName)
+	ver, platform, err := ParseFileName(fileName)
 	if err != nil {
 		return err
 	}
+	compression, _ := compress.FromFileName(fileName)
 
 	fullName := path.Join(im.dir, fileName)
 
-	f, err := os.Open(fullName)
+	im.mx.RLock()
+	badModTime, bad := im.badMetadata[fileName]
+	badImageModTime, badImage := im.badImages[fileName]
+	im.mx.RUnlock()
+	if bad && badModTime.Equal(metadataModTime(fullName)) {
+		return nil
+	}
+	if badImage && badImageModTime.Equal(imageModTime(fullName)) {
+		return nil
+	}
+
+	md, err := ReadMetadata(fullName)
 	if err != nil {
-		return err
+		im.mx.Lock()
+		im.badMetadata[fileName] = metadataModTime(fullName)
+		im.mx.Unlock()
+
+		log.Printf("Skipped file with bad metadata: %s: %s", fileName, err)
+		return nil
 	}
 
-	h := sha512.New()
-	if _, err := io.Copy(h, f); err != nil {
-		return err
+	channel := md.Channel
+	if channel == "" {
+		channel = ChannelFromVersion(ver)
 	}
-	defer f.Close()
 
-	sign, fileSign, err := im.Sing.SignFile(fullName)
+	// the signature covers the uncompressed image, it's checked after the decompression
+	data, err := readImage(fullName, compression)
 	if err != nil {
-		return err
+		im.skipBadImage(fileName, err)
+		return nil
 	}
 
-	im.mx.Lock()
-	defer im.mx.Unlock()
+	image := Image{
+		Uri:             path.Join(im.dir, fileName),
+		Image:           fileName,
+		CreatedAt:       time.Now().Format(time.DateTime),
+		Version:         ver,
+		Channel:         channel,
+		Platform:        platform.String(),
+		Compression:     compression,
+		Size:            int64(len(data)),
+		Rollout:         md.Rollout,
+		Critical:        md.Critical,
+		metadataModTime: md.ModTime,
+	}
 
-	im.Images[fileName] = Image{
-		Uri:       path.Join(im.dir, fileName),
-		Image:     fileName,
-		FileSum:   base64.URLEncoding.EncodeToString(sign),
-		Sign:      base64.URLEncoding.EncodeToString(fileSign),
-		CreatedAt: time.Now().Format(time.DateTime),
-		Version:   ver,
+	if im.verifier != nil {
+		// the offline server publishes the images signed offline only,
+		// the patches signed with the release are generated offline too
+		modTimes := sidecarModTimes(fullName)
+		if err := im.applySidecar(&image, data, time.Now()); err != nil {
+			im.mx.Lock()
+			im.unsigned[fileName] = modTimes
+			im.mx.Unlock()
+
+			log.Printf("Skipped unsigned file: %s: %s", fileName, err)
+			return nil
+		}
+		image.sidecarModTimes = modTimes
+	} else {
+		sign, fileSign, err := im.signer(RoleTargets).Sign(data)
+		if err != nil {
+			return err
+		}
+		image.FileSum = base64.URLEncoding.EncodeToString(sign)
+		image.Sign = base64.URLEncoding.EncodeToString(fileSign)
+
+		// the patches are signed with the release, it's slow, so it's done without the lock
+		image.Patches, err = im.makePatches(fileName, ver, platform, compression)
+		if err != nil {
+			im.skipBadImage(fileName, err)
+			return nil
+		}
+
+		if err := im.signRelease(&image, time.Now()); err != nil {
+			return err
+		}
 	}
 
-	oldLastImage := im.LastImage
-	lastImage := im.Images[fileName]
-	for _, f := range im.Images {
-		if lastImage.Version.LessThan(f.Version) {
-			lastImage = f
+	im.mx.Lock()
+	im.Images[fileName] = image
+	delete(im.unsigned, fileName)
+	delete(im.badMetadata, fileName)
+	delete(im.badImages, fileName)
+	im.mx.Unlock()
+
+	log.Printf("Added new file: %s, channel: %s, platform: %s, rollout: %v%%", fileName, channel, platform, md.Rollout.Percent(time.Now()))
+	return nil
+}
+
+// ReloadMetadata rereads the sidecar metadata of the added image if it was changed,
+// e.g. to ramp up the rollout manually.
+func (im *AllImages) ReloadMetadata(fileName string) error {
+	fullName := path.Join(im.dir, fileName)
+
+	im.mx.RLock()
+	image, find := im.Images[fileName]
+	im.mx.RUnlock()
+
+	if find && im.verifier != nil {
+		// the signed fields are changed by the new sidecar only, the image is checked again
+		if image.sidecarModTimes == sidecarModTimes(fullName) {
+			return nil
 		}
+
+		im.mx.Lock()
+		delete(im.Images, fileName)
+		im.mx.Unlock()
+
+		return im.AddFile(fileName)
 	}
 
-	b, err := json.Marshal(lastImage)
+	if !find || image.metadataModTime.Equal(metadataModTime(fullName)) {
+		return nil
+	}
+
+	md, err := ReadMetadata(fullName)
 	if err != nil {
-		return err
+		// the image keeps the last good metadata until the sidecar is changed again
+		image.metadataModTime = metadataModTime(fullName)
+
+		im.mx.Lock()
+		im.Images[fileName] = image
+		im.mx.Unlock()
+
+		log.Printf("Skipped bad metadata: %s: %s", fileName, err)
+		return nil
 	}
 
-	im.LastImage = string(b)
-	if oldLastImage != im.LastImage {
-		log.Printf("Added new file: %s", im.LastImage)
+	channel := md.Channel
+	if channel == "" {
+		channel = ChannelFromVersion(image.Version)
+	}
+	changed := channel != image.Channel || md.Critical != image.Critical
+
+	image.Channel = channel
+	image.Rollout = md.Rollout
+	image.Critical = md.Critical
+	image.metadataModTime = md.ModTime
+
+	// the channel and the critical flag are signed, the rollout isn't. The co-signed release
+	// keeps its co-signatures until it expires, then resignReleases signs the new fields.
+	now := time.Now()
+	switch {
+	case !changed:
+	case image.cosigned(now):
+		log.Printf("Release %s is co-signed, the channel and the critical flag are signed after it expires", fileName)
+	default:
+		if err := im.signRelease(&image, now); err != nil {
+			return err
+		}
 	}
 
+	im.mx.Lock()
+	im.Images[fileName] = image
+	im.mx.Unlock()
+
+	log.Printf("Reloaded metadata: %s, channel: %s, rollout: %v%%", fileName, image.Channel, md.Rollout.Percent(now))
 	return nil
 }
 
+// GetManifest returns the json manifest for the client with instanceID.
+func (im *AllImages) GetManifest(instanceID string) ([]byte, error) {
+	im.mx.RLock()
+	defer im.mx.RUnlock()
+
+	m := buildManifest(im.published(), im.revoked, instanceID, time.Now())
+	m.NextCheckAfter = int(im.nextCheckAfter.Seconds())
+	m.Rollback = im.rollback
+	m.Revoked = im.revokedSigned
+	m.Rotations = im.rotations
+	m.Roots = im.roots
+	m.Snapshot = im.snapshotSigned
+	m.Timestamp = im.timestampSigned
+
+	return json.Marshal(m)
+}
+
+// GetLastImage returns the json of the last fully rolled out stable image.
+// The old clients know nothing about channels and instance IDs, they get the stable releases only.
+func (im *AllImages) GetLastImage() ([]byte, error) {
+	im.mx.RLock()
+	defer im.mx.RUnlock()
+
+	m := buildManifest(im.published(), im.revoked, "", time.Now())
+	if m.Channels[ChannelStable] == nil {
+		// the old clients can't handle "null"
+		return nil, nil
+	}
+
+	return json.Marshal(m.Channels[ChannelStable])
+}
+
 // GetVersion extracts the version from the file name
 // it's a simple helper.
 func GetVersion(fileName string) (*version.Version, error) {
+	ver, _, err := ParseFileName(fileName)
+	return ver, err
+}
+
+// ParseFileName extracts the version and the platform from the file name,
+// the platform is zero for the names without the platform suffix.
+// The extension of the compressed file is skipped: "app.v1.2.3.linux-amd64.zst".
+func ParseFileName(fileName string) (*version.Version, Platform, error) {
 	_, file := filepath.Split(fileName)
+	_, file = compress.FromFileName(file)
 
 	s := releaseVersion.FindStringSubmatch(file)
-	if len(s) != 2 {
-		return nil, errors.Errorf("not found version in %s", file)
+	if len(s) != 3 {
+		return nil, Platform{}, errors.Errorf("not found version in %s", file)
 	}
 
-	return version.NewVersion(s[1])
+	ver, err := version.NewVersion(s[1])
+	if err != nil {
+		return nil, Platform{}, err
+	}
+
+	platform, err := ParsePlatform(strings.ReplaceAll(s[2], "-", "/"))
+	return ver, platform, err
 }
 
 // ScanImages scans the image directory for new images
@@ -177,6 +443,8 @@ func (im *AllImages) ScanImagesInDir() error {
 		return err
 	}
 
+	newFiles := make([]string, 0)
+	found := make(map[string]bool, len(entries))
 	for _, e := range entries {
 		info, err := e.Info()
 		if err != nil {
@@ -186,18 +454,149 @@ func (im *AllImages) ScanImagesInDir() error {
 		perm := info.Mode().Perm()
 		executed := perm&0100 == 1 || perm&0010 == 1 || perm&0001 == 1
 
-		if e.IsDir() || !executed {
+		// the compressed images are not executed
+		compression, _ := compress.FromFileName(e.Name())
+
+		if e.IsDir() || (!executed && compression == compress.None) {
 			continue
 		}
 
+		found[e.Name()] = true
+		if im.verifier != nil && !im.CheckFile(e.Name()) && !im.unsignedChanged(e.Name()) {
+			continue
+		}
 		if im.CheckFile(e.Name()) {
+			if err := im.ReloadMetadata(e.Name()); err != nil {
+				return err
+			}
 			continue
 		}
 
-		if err := im.AddFile(e.Name()); err != nil {
+		newFiles = append(newFiles, e.Name())
+	}
+
+	im.forgetRemoved(found)
+
+	// add the files in order of versions, so the patches
+	// from the previous versions are the same after the restart
+	versions := make(map[string]*version.Version, len(newFiles))
+	images := newFiles[:0]
+	for _, fileName := range newFiles {
+		// e.g. the rotated log archive, it's not an image
+		ver, err := GetVersion(fileName)
+		if err != nil {
+			if !im.notImages[fileName] {
+				im.notImages[fileName] = true
+				log.Printf("Skipped file without version: %s: %s", fileName, err)
+			}
+			continue
+		}
+		versions[fileName] = ver
+		images = append(images, fileName)
+	}
+	newFiles = images
+	sort.Slice(newFiles, func(i, j int) bool {
+		return versions[newFiles[i]].LessThan(versions[newFiles[j]])
+	})
+
+	for _, fileName := range newFiles {
+		if err := im.AddFile(fileName); err != nil {
 			return err
 		}
 	}
 
-	return nil
+	if im.verifier != nil {
+		return im.scanSigned()
+	}
+
+	if err := im.resignReleases(time.Now()); err != nil {
+		return err
+	}
+
+	if err := im.loadRevoked(); err != nil {
+		log.Printf("Skipped revocation list: %s", err)
+	}
+
+	if err := im.loadRotations(); err != nil {
+		log.Printf("Skipped key rotations: %s", err)
+	}
+
+	// the target of the rollback may be added or removed just now
+	if err := im.loadRollback(); err != nil {
+		log.Printf("Skipped rollback: %s", err)
+	}
+
+	if err := im.loadRoots(); err != nil {
+		log.Printf("Skipped root documents: %s", err)
+	}
+
+	if err := im.loadCosignatures(); err != nil {
+		log.Printf("Skipped co-signatures: %s", err)
+	}
+	im.applyCosignatures()
+
+	if err := im.signSnapshot(time.Now()); err != nil {
+		return err
+	}
+
+	return im.signTimestamp(time.Now())
+}
+
+// forgetRemoved removes the images which files are removed from the directory.
+func (im *AllImages) forgetRemoved(found map[string]bool) {
+	im.mx.Lock()
+	defer im.mx.Unlock()
+
+	for fileName := range im.Images {
+		if !found[fileName] {
+			delete(im.Images, fileName)
+			log.Printf("Removed file: %s", fileName)
+		}
+	}
+	for fileName := range im.badMetadata {
+		if !found[fileName] {
+			delete(im.badMetadata, fileName)
+		}
+	}
+	for fileName := range im.badImages {
+		if !found[fileName] {
+			delete(im.badImages, fileName)
+		}
+	}
+}
+
+// skipBadImage remembers the image which can't be added until the file is changed.
+func (im *AllImages) skipBadImage(fileName string, err error) {
+	im.mx.Lock()
+	im.badImages[fileName] = imageModTime(path.Join(im.dir, fileName))
+	im.mx.Unlock()
+
+	log.Printf("Skipped bad image: %s: %s", fileName, err)
+}
+
+func imageModTime(fullName string) time.Time {
+	info, err := os.Stat(fullName)
+	if err != nil {
+		return time.Time{}
+	}
+
+	return info.ModTime()
+}
+
+// readImage reads the uncompressed image.
+func readImage(fullName, compression string) ([]byte, error) {
+	f, err := os.Open(fullName)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	r, err := compress.NewReader(f, compression)
+	if err != nil {
+		return nil, errors.Wrapf(err, "decompress %s", fullName)
+	}
+	defer r.Close()
+
+	b, err := io.ReadAll(compress.LimitReader(r, MaxImageSize))
+	return b, errors.Wrapf(err, "decompress %s", fullName)
 }
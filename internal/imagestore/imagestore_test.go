@@ -0,0 +1,883 @@
+package imagestore_test
+
+import (
+	"bytes"
+	"compress/gzip"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/hashicorp/go-version"
+	"github.com/stretchr/testify/assert"
+
+	"nametag/internal/compress"
+	"nametag/internal/imagestore"
+)
+
+type fakeSigner struct{}
+
+func (fakeSigner) Sign(b []byte) ([]byte, []byte, error) {
+	sum := sha256.Sum256(b)
+	return sum[:], []byte("sign"), nil
+}
+
+func (fakeSigner) KeyID() string {
+	return "fake"
+}
+
+func (fakeSigner) Alg() string {
+	return "fake"
+}
+
+func writeImage(t *testing.T, dir, name, metadata string) {
+	err := os.WriteFile(filepath.Join(dir, name), []byte(name), 0755)
+	assert.Nil(t, err, "WriteFile")
+
+	if metadata != "" {
+		err := os.WriteFile(filepath.Join(dir, name+imagestore.MetadataExt), []byte(metadata), 0644)
+		assert.Nil(t, err, "WriteFile metadata")
+	}
+}
+
+func Test_ChannelFromVersion(t *testing.T) {
+	for v, ch := range map[string]string{
+		"v1.2.3":                  imagestore.ChannelStable,
+		"v1.2.3-beta.1":           imagestore.ChannelBeta,
+		"v1.2.3-rc.1":             imagestore.ChannelBeta,
+		"v1.2.3-nightly.20240901": imagestore.ChannelNightly,
+	} {
+		assert.Equal(t, ch, imagestore.ChannelFromVersion(version.Must(version.NewVersion(v))), v)
+	}
+
+	assert.True(t, imagestore.Follows(imagestore.ChannelBeta, imagestore.ChannelStable))
+	assert.False(t, imagestore.Follows(imagestore.ChannelStable, imagestore.ChannelBeta))
+	assert.NotNil(t, imagestore.CheckChannel("alpha"))
+}
+
+func Test_Manifest(t *testing.T) {
+	dir := t.TempDir()
+	writeImage(t, dir, "app.v1.0.0", "")
+	writeImage(t, dir, "app.v1.1.0-beta.1", "")
+	writeImage(t, dir, "app.v1.2.0", `{"channel": "nightly"}`)
+
+	im := imagestore.New("/data", dir, fakeSigner{})
+	assert.Nil(t, im.ScanImagesInDir(), "ScanImagesInDir")
+
+	b, err := im.GetManifest("")
+	assert.Nil(t, err, "GetManifest")
+
+	m := &imagestore.Manifest{}
+	assert.Nil(t, json.Unmarshal(b, m), "Unmarshal")
+
+	assert.Equal(t, "1.0.0", m.Channels[imagestore.ChannelStable].Version.String())
+	assert.Equal(t, "1.1.0-beta.1", m.Channels[imagestore.ChannelBeta].Version.String())
+	assert.Equal(t, "1.2.0", m.Channels[imagestore.ChannelNightly].Version.String())
+
+	if assert.Len(t, m.Releases, 3) {
+		assert.Equal(t, "1.2.0", m.Releases[0].Version.String(), "the newest first")
+		assert.Equal(t, "1.0.0", m.Releases[2].Version.String())
+	}
+
+	// the patches from the previous versions, the newest first
+	patches := m.Channels[imagestore.ChannelNightly].Patches
+	if assert.Len(t, patches, 2) {
+		assert.Equal(t, "1.1.0-beta.1", patches[0].From.String())
+		assert.FileExists(t, patches[0].Uri)
+
+		data, err := os.ReadFile(patches[0].Uri)
+		assert.Nil(t, err, "ReadFile")
+		sum := sha256.Sum256(data)
+		assert.Equal(t, base64.URLEncoding.EncodeToString(sum[:]), patches[0].FileSum)
+		assert.Equal(t, int64(len(data)), patches[0].Size)
+	}
+
+	// the patches are signed with the release
+	payload, err := base64.URLEncoding.DecodeString(m.Channels[imagestore.ChannelNightly].Release.Payload)
+	assert.Nil(t, err, "DecodeString")
+	r := &imagestore.Release{}
+	assert.Nil(t, json.Unmarshal(payload, r), "Unmarshal release")
+	assert.Equal(t, patches, r.Patches)
+
+	b, err = im.GetLastImage()
+	assert.Nil(t, err, "GetLastImage")
+
+	last := &imagestore.Image{}
+	assert.Nil(t, json.Unmarshal(b, last), "Unmarshal")
+	assert.Equal(t, "1.0.0", last.Version.String())
+}
+
+func Test_BadMetadata(t *testing.T) {
+	dir := t.TempDir()
+	writeImage(t, dir, "app.v1.0.0", `{"channel": "beta"}`)
+	writeImage(t, dir, "app.v1.1.0", `{"channel": "alpha"}`)
+
+	im := imagestore.New("/data", dir, fakeSigner{})
+	assert.Nil(t, im.ScanImagesInDir(), "ScanImagesInDir")
+	assert.True(t, im.CheckFile("app.v1.0.0"))
+	assert.False(t, im.CheckFile("app.v1.1.0"), "not published with the bad metadata")
+
+	// the image is added when its metadata is fixed
+	time.Sleep(10 * time.Millisecond)
+	writeImage(t, dir, "app.v1.1.0", `{"channel": "beta"}`)
+	assert.Nil(t, im.ScanImagesInDir(), "ScanImagesInDir")
+	assert.True(t, im.CheckFile("app.v1.1.0"))
+
+	// the published image keeps the last good metadata
+	writeImage(t, dir, "app.v1.0.0", `{"channel": "beta", "rollout": [{"percent": 101}]}`)
+	assert.Nil(t, im.ScanImagesInDir(), "ScanImagesInDir")
+
+	b, err := im.GetManifest("")
+	assert.Nil(t, err, "GetManifest")
+
+	m := &imagestore.Manifest{}
+	assert.Nil(t, json.Unmarshal(b, m), "Unmarshal")
+	assert.Equal(t, "1.1.0", m.Channels[imagestore.ChannelBeta].Version.String())
+	if assert.Len(t, m.Releases, 2) {
+		assert.Equal(t, imagestore.ChannelBeta, m.Releases[1].Channel, "the last good channel")
+	}
+}
+
+func Test_Rollout(t *testing.T) {
+	now := time.Now()
+	r := imagestore.Rollout{
+		{At: now.Add(2 * time.Hour), Percent: 100},
+		{At: now.Add(-time.Hour), Percent: 1},
+		{At: now.Add(time.Hour), Percent: 10},
+	}
+	assert.Nil(t, r.Check(), "Check")
+
+	assert.Equal(t, 0.0, r.Percent(now.Add(-2*time.Hour)))
+	assert.Equal(t, 1.0, r.Percent(now))
+	assert.Equal(t, 10.0, r.Percent(now.Add(90*time.Minute)))
+	assert.Equal(t, 100.0, r.Percent(now.Add(3*time.Hour)))
+	assert.Equal(t, 100.0, imagestore.Rollout{}.Percent(now))
+
+	assert.NotNil(t, imagestore.Rollout{{At: now, Percent: 101}}.Check())
+}
+
+func Test_InCohort(t *testing.T) {
+	v := version.Must(version.NewVersion("v1.2.3"))
+
+	in := 0
+	for i := 0; i < 1000; i++ {
+		id := fmt.Sprintf("instance-%d", i)
+		b := imagestore.Bucket(id, v)
+		assert.Equal(t, b, imagestore.Bucket(id, v), "deterministic")
+
+		// the client stays in the cohort while the rollout grows
+		if imagestore.InCohort(id, v, 10) {
+			in++
+			assert.True(t, imagestore.InCohort(id, v, 50))
+		}
+	}
+
+	assert.InDelta(t, 100, in, 40, "about 10% of the clients")
+	assert.False(t, imagestore.InCohort("", v, 99), "no instance id")
+	assert.True(t, imagestore.InCohort("", v, 100), "no instance id")
+}
+
+func Test_ManifestRollout(t *testing.T) {
+	dir := t.TempDir()
+	writeImage(t, dir, "app.v1.0.0", "")
+	writeImage(t, dir, "app.v1.1.0", `{"rollout": [{"at": "2000-01-01T00:00:00Z", "percent": 0}]}`)
+
+	im := imagestore.New("/data", dir, fakeSigner{})
+	assert.Nil(t, im.ScanImagesInDir(), "ScanImagesInDir")
+
+	b, err := im.GetManifest("instance")
+	assert.Nil(t, err, "GetManifest")
+
+	m := &imagestore.Manifest{}
+	assert.Nil(t, json.Unmarshal(b, m), "Unmarshal")
+	assert.Equal(t, "1.0.0", m.Channels[imagestore.ChannelStable].Version.String())
+
+	// the clients select their cohort by the rollout signed in the snapshot
+	if !assert.Len(t, m.Releases, 2, "all the releases are listed") {
+		return
+	}
+	payload, err := base64.URLEncoding.DecodeString(m.Snapshot.Payload)
+	assert.Nil(t, err, "DecodeString")
+	s := &imagestore.Snapshot{}
+	assert.Nil(t, json.Unmarshal(payload, s), "Unmarshal snapshot")
+	assert.Equal(t, 0.0, s.Rollout(m.Releases[0].Release).Percent(time.Now()), "v1.1.0")
+	assert.Equal(t, 100.0, s.Rollout(m.Releases[1].Release).Percent(time.Now()), "v1.0.0")
+}
+
+func Test_Rollback(t *testing.T) {
+	dir := t.TempDir()
+	writeImage(t, dir, "app.v1.4.3", "")
+	writeImage(t, dir, "app.v1.5.0", "")
+
+	err := os.WriteFile(filepath.Join(dir, imagestore.RollbackFile), []byte(`{"target": "v1.4.3", "from": ">= 1.5.0, < 1.5.1", "reason": "broken"}`), 0644)
+	assert.Nil(t, err, "WriteFile")
+
+	im := imagestore.New("/data", dir, fakeSigner{})
+	assert.Nil(t, im.ScanImagesInDir(), "ScanImagesInDir")
+
+	b, err := im.GetManifest("")
+	assert.Nil(t, err, "GetManifest")
+
+	m := &imagestore.Manifest{}
+	assert.Nil(t, json.Unmarshal(b, m), "Unmarshal")
+	if !assert.NotNil(t, m.Rollback, "rollback") {
+		return
+	}
+
+	payload, err := base64.URLEncoding.DecodeString(m.Rollback.Payload)
+	assert.Nil(t, err, "DecodeString")
+
+	r := &imagestore.Rollback{}
+	assert.Nil(t, json.Unmarshal(payload, r), "Unmarshal")
+	assert.Equal(t, "1.4.3", r.Target.String())
+	assert.Equal(t, []string{m.Releases[1].FileSum}, r.TargetSums, "the hash of the target image")
+	assert.True(t, r.Applies(version.Must(version.NewVersion("v1.5.0"))))
+	assert.True(t, r.Applies(version.Must(version.NewVersion("v1.5.0-beta.1"))))
+	assert.False(t, r.Applies(version.Must(version.NewVersion("v1.5.1"))))
+
+	// the target images are resolved again when they are changed
+	assert.Nil(t, os.Remove(filepath.Join(dir, "app.v1.4.3")), "Remove")
+	assert.Nil(t, im.ScanImagesInDir(), "ScanImagesInDir")
+	assert.Nil(t, getRollback(t, im), "the target is removed")
+
+	writeImage(t, dir, "app.v1.4.3.linux-amd64", "")
+	assert.Nil(t, im.ScanImagesInDir(), "ScanImagesInDir")
+	r = getRollback(t, im)
+	if assert.NotNil(t, r, "the target is published again") {
+		assert.Len(t, r.TargetSums, 1)
+		assert.NotEqual(t, m.Releases[1].FileSum, r.TargetSums[0], "the hash of the new target image")
+	}
+
+	// the bad directive is skipped, the server keeps serving
+	err = os.WriteFile(filepath.Join(dir, imagestore.RollbackFile), []byte(`{"target": "v1.4.3", "from": ">= 1.5.0,"}`), 0644)
+	assert.Nil(t, err, "WriteFile")
+	assert.Nil(t, im.ScanImagesInDir(), "bad directive")
+	assert.NotNil(t, getRollback(t, im), "the last good directive")
+
+	// the directive waits for its target to be published
+	err = os.WriteFile(filepath.Join(dir, imagestore.RollbackFile), []byte(`{"target": "v1.4.2", "from": ">= 1.5.0"}`), 0644)
+	assert.Nil(t, err, "WriteFile")
+	assert.Nil(t, im.ScanImagesInDir(), "unknown target")
+	assert.Nil(t, getRollback(t, im), "unknown target")
+
+	writeImage(t, dir, "app.v1.4.2", "")
+	assert.Nil(t, im.ScanImagesInDir(), "ScanImagesInDir")
+	r = getRollback(t, im)
+	if assert.NotNil(t, r, "the target is published") {
+		assert.Equal(t, "1.4.2", r.Target.String())
+	}
+
+	// the rollback is canceled
+	assert.Nil(t, os.Remove(filepath.Join(dir, imagestore.RollbackFile)), "Remove")
+	assert.Nil(t, im.ScanImagesInDir(), "ScanImagesInDir")
+
+	b, err = im.GetManifest("")
+	assert.Nil(t, err, "GetManifest")
+	m = &imagestore.Manifest{}
+	assert.Nil(t, json.Unmarshal(b, m), "Unmarshal")
+	assert.Nil(t, m.Rollback, "canceled")
+}
+
+// getRollback returns the rollback directive from the manifest, nil if there is no rollback.
+func getRollback(t *testing.T, im *imagestore.AllImages) *imagestore.Rollback {
+	b, err := im.GetManifest("")
+	assert.Nil(t, err, "GetManifest")
+
+	m := &imagestore.Manifest{}
+	assert.Nil(t, json.Unmarshal(b, m), "Unmarshal")
+	if m.Rollback == nil {
+		return nil
+	}
+
+	payload, err := base64.URLEncoding.DecodeString(m.Rollback.Payload)
+	assert.Nil(t, err, "DecodeString")
+
+	r := &imagestore.Rollback{}
+	assert.Nil(t, json.Unmarshal(payload, r), "Unmarshal")
+	return r
+}
+
+func Test_Revoked(t *testing.T) {
+	dir := t.TempDir()
+	writeImage(t, dir, "app.v1.4.3", "")
+	writeImage(t, dir, "app.v1.5.0", "")
+
+	err := os.WriteFile(filepath.Join(dir, imagestore.RevokedFile), []byte(`{"versions": [{"version": "v1.5.0", "reason": "cve"}]}`), 0644)
+	assert.Nil(t, err, "WriteFile")
+
+	im := imagestore.New("/data", dir, fakeSigner{})
+	assert.Nil(t, im.ScanImagesInDir(), "ScanImagesInDir")
+
+	b, err := im.GetManifest("")
+	assert.Nil(t, err, "GetManifest")
+
+	m := &imagestore.Manifest{}
+	assert.Nil(t, json.Unmarshal(b, m), "Unmarshal")
+	assert.Equal(t, "1.4.3", m.Channels[imagestore.ChannelStable].Version.String(), "the revoked version is not published")
+	assert.Len(t, m.Releases, 1)
+	assert.NotNil(t, m.Revoked, "revoked")
+
+	// the bad list is skipped, the revoked version isn't published again
+	err = os.WriteFile(filepath.Join(dir, imagestore.RevokedFile), []byte(`{"versions": [{"reason": "typo"}]}`), 0644)
+	assert.Nil(t, err, "WriteFile")
+	assert.Nil(t, im.ScanImagesInDir(), "bad list")
+
+	b, err = im.GetManifest("")
+	assert.Nil(t, err, "GetManifest")
+	m = &imagestore.Manifest{}
+	assert.Nil(t, json.Unmarshal(b, m), "Unmarshal")
+	assert.Len(t, m.Releases, 1, "the last good list")
+
+	// the removed image is forgotten
+	assert.Nil(t, os.Remove(filepath.Join(dir, "app.v1.4.3")), "Remove")
+	assert.Nil(t, im.ScanImagesInDir(), "ScanImagesInDir")
+	assert.False(t, im.CheckFile("app.v1.4.3"))
+
+	b, err = im.GetLastImage()
+	assert.Nil(t, err, "GetLastImage")
+	assert.Empty(t, b, "no stable image")
+}
+
+func Test_ParseFileName(t *testing.T) {
+	for name, want := range map[string][2]string{
+		"app.v1.2.3":                        {"1.2.3", ""},
+		"app.v1.2.3-nightly.20240901":       {"1.2.3-nightly.20240901", ""},
+		"app.v1.2.3.linux-arm64":            {"1.2.3", "linux/arm64"},
+		"app.v1.2.3-rc.1.linux-amd64-v3":    {"1.2.3-rc.1", "linux/amd64/v3"},
+		"data/app.v1.2.3.darwin-arm64":      {"1.2.3", "darwin/arm64"},
+		"app.v1.2.3-beta.1.windows-386":     {"1.2.3-beta.1", "windows/386"},
+		"app.v1.2.3-beta.1.freebsd-riscv64": {"1.2.3-beta.1", "freebsd/riscv64"},
+	} {
+		v, p, err := imagestore.ParseFileName(name)
+		if assert.Nil(t, err, name) {
+			assert.Equal(t, want[0], v.String(), name)
+			assert.Equal(t, want[1], p.String(), name)
+		}
+	}
+
+	_, _, err := imagestore.ParseFileName("app.linux-amd64")
+	assert.NotNil(t, err)
+
+	v3, err := imagestore.ParsePlatform("linux/amd64/v3")
+	assert.Nil(t, err, "ParsePlatform")
+	assert.True(t, v3.Supports(imagestore.Platform{OS: "linux", Arch: "amd64", Variant: "v2"}))
+	assert.True(t, v3.Supports(imagestore.Platform{OS: "linux", Arch: "amd64"}))
+	assert.False(t, v3.Supports(imagestore.Platform{}), "the old builds")
+	assert.False(t, v3.Supports(imagestore.Platform{OS: "linux", Arch: "amd64", Variant: "v4"}))
+	assert.False(t, v3.Supports(imagestore.Platform{OS: "linux", Arch: "arm64"}))
+}
+
+func Test_ManifestPlatforms(t *testing.T) {
+	dir := t.TempDir()
+	writeImage(t, dir, "app.v1.0.0", "")
+	writeImage(t, dir, "app.v1.0.0.linux-arm64", "")
+	writeImage(t, dir, "app.v1.1.0.linux-amd64", "")
+	writeImage(t, dir, "app.v1.1.0.linux-arm64", "")
+
+	im := imagestore.New("/data", dir, fakeSigner{})
+	assert.Nil(t, im.ScanImagesInDir(), "ScanImagesInDir")
+
+	b, err := im.GetManifest("")
+	assert.Nil(t, err, "GetManifest")
+
+	m := &imagestore.Manifest{}
+	assert.Nil(t, json.Unmarshal(b, m), "Unmarshal")
+
+	// the old clients get the build without the platform
+	assert.Equal(t, "1.0.0", m.Channels[imagestore.ChannelStable].Version.String())
+	assert.Equal(t, "", m.Channels[imagestore.ChannelStable].Platform)
+
+	if assert.Len(t, m.Releases, 4) {
+		assert.Equal(t, "linux/amd64", m.Releases[0].Platform)
+		assert.Equal(t, "linux/arm64", m.Releases[1].Platform)
+
+		// the patches from the same platform only
+		if assert.Len(t, m.Releases[1].Patches, 1) {
+			assert.Equal(t, "1.0.0", m.Releases[1].Patches[0].From.String())
+			assert.Contains(t, m.Releases[1].Patches[0].Uri, "app.v1.0.0.linux-arm64_app.v1.1.0.linux-arm64")
+		}
+		assert.Len(t, m.Releases[0].Patches, 0)
+	}
+}
+
+func Test_ManifestCompressed(t *testing.T) {
+	dir := t.TempDir()
+	writeImage(t, dir, "app.v1.0.0", "")
+
+	data := bytes.Repeat([]byte("app.v1.1.0 "), 1000)
+	buf := &bytes.Buffer{}
+	w := gzip.NewWriter(buf)
+	_, err := w.Write(data)
+	assert.Nil(t, err, "Write")
+	assert.Nil(t, w.Close(), "Close")
+
+	// the compressed images are not executable
+	assert.Nil(t, os.WriteFile(filepath.Join(dir, "app.v1.1.0.gz"), buf.Bytes(), 0644), "WriteFile")
+	// the log archive without the version isn't an image
+	assert.Nil(t, os.WriteFile(filepath.Join(dir, "server.log.1.gz"), buf.Bytes(), 0644), "WriteFile")
+
+	im := imagestore.New("/data", dir, fakeSigner{})
+	assert.Nil(t, im.ScanImagesInDir(), "ScanImagesInDir")
+
+	b, err := im.GetManifest("")
+	assert.Nil(t, err, "GetManifest")
+
+	m := &imagestore.Manifest{}
+	assert.Nil(t, json.Unmarshal(b, m), "Unmarshal")
+
+	last := m.Channels[imagestore.ChannelStable]
+	assert.Equal(t, "1.1.0", last.Version.String())
+	assert.Equal(t, compress.Gzip, last.Compression)
+	assert.Equal(t, int64(len(data)), last.Size)
+
+	// the signed sum is of the uncompressed image
+	sum := sha256.Sum256(data)
+	assert.Equal(t, base64.URLEncoding.EncodeToString(sum[:]), last.FileSum)
+	assert.Len(t, last.Patches, 1)
+}
+
+func Test_BadCompressedImage(t *testing.T) {
+	dir := t.TempDir()
+	writeImage(t, dir, "app.v1.0.0", "")
+
+	// e.g. the half-uploaded image
+	assert.Nil(t, os.WriteFile(filepath.Join(dir, "app.v1.1.0.gz"), []byte("app.v1.1.0"), 0644), "WriteFile")
+
+	im := imagestore.New("/data", dir, fakeSigner{})
+	assert.Nil(t, im.ScanImagesInDir(), "ScanImagesInDir")
+	assert.True(t, im.CheckFile("app.v1.0.0"))
+	assert.False(t, im.CheckFile("app.v1.1.0.gz"), "not published")
+
+	// the unchanged image isn't retried
+	assert.Nil(t, im.ScanImagesInDir(), "ScanImagesInDir")
+	assert.False(t, im.CheckFile("app.v1.1.0.gz"), "not published")
+
+	// the image is added when the upload is finished
+	time.Sleep(10 * time.Millisecond)
+	buf := &bytes.Buffer{}
+	w := gzip.NewWriter(buf)
+	_, err := w.Write([]byte("app.v1.1.0"))
+	assert.Nil(t, err, "Write")
+	assert.Nil(t, w.Close(), "Close")
+	assert.Nil(t, os.WriteFile(filepath.Join(dir, "app.v1.1.0.gz"), buf.Bytes(), 0644), "WriteFile")
+
+	assert.Nil(t, im.ScanImagesInDir(), "ScanImagesInDir")
+	assert.True(t, im.CheckFile("app.v1.1.0.gz"))
+}
+
+func Test_Release(t *testing.T) {
+	dir := t.TempDir()
+	writeImage(t, dir, "app.v1.0.0.linux-amd64", `{"critical": true}`)
+
+	im := imagestore.New("/data", dir, fakeSigner{})
+	im.SetReleaseTTL(2 * time.Second)
+	assert.Nil(t, im.ScanImagesInDir(), "ScanImagesInDir")
+
+	release := func() (*imagestore.Image, *imagestore.Release) {
+		b, err := im.GetManifest("")
+		assert.Nil(t, err, "GetManifest")
+
+		m := &imagestore.Manifest{}
+		assert.Nil(t, json.Unmarshal(b, m), "Unmarshal")
+		if !assert.Len(t, m.Releases, 1) || !assert.NotNil(t, m.Releases[0].Release) {
+			t.FailNow()
+		}
+
+		payload, err := base64.URLEncoding.DecodeString(m.Releases[0].Release.Payload)
+		assert.Nil(t, err, "DecodeString")
+
+		r := &imagestore.Release{}
+		assert.Nil(t, json.Unmarshal(payload, r), "Unmarshal release")
+		return m.Releases[0], r
+	}
+
+	image, r := release()
+	assert.Nil(t, r.Check(time.Now(), 0), "Check")
+	assert.Equal(t, "1.0.0", r.Version.String())
+	assert.Equal(t, "linux/amd64", r.Platform)
+	assert.Equal(t, image.FileSum, r.FileSum)
+	assert.Equal(t, image.Uri, r.Uri)
+	assert.Equal(t, int64(len("app.v1.0.0.linux-amd64")), r.Size)
+	assert.True(t, r.Critical)
+	assert.NotNil(t, r.Check(r.ExpiresAt, 0), "expired")
+	assert.Nil(t, r.Check(r.ExpiresAt, time.Minute), "clock skew")
+
+	// the release is re-signed before it expires
+	time.Sleep(1100 * time.Millisecond)
+	assert.Nil(t, im.ScanImagesInDir(), "ScanImagesInDir")
+
+	_, resigned := release()
+	assert.True(t, resigned.ExpiresAt.After(r.ExpiresAt), "re-signed")
+}
+
+func Test_Timestamp(t *testing.T) {
+	dir := t.TempDir()
+	writeImage(t, dir, "app.v1.0.0", "")
+
+	im := imagestore.New("/data", dir, fakeSigner{})
+	assert.Nil(t, im.ScanImagesInDir(), "ScanImagesInDir")
+
+	timestamp := func() (*imagestore.Manifest, *imagestore.Timestamp) {
+		b, err := im.GetManifest("")
+		assert.Nil(t, err, "GetManifest")
+
+		m := &imagestore.Manifest{}
+		assert.Nil(t, json.Unmarshal(b, m), "Unmarshal")
+		if !assert.NotNil(t, m.Timestamp, "timestamp") {
+			t.FailNow()
+		}
+
+		payload, err := base64.URLEncoding.DecodeString(m.Timestamp.Payload)
+		assert.Nil(t, err, "DecodeString")
+
+		ts := &imagestore.Timestamp{}
+		assert.Nil(t, json.Unmarshal(payload, ts), "Unmarshal timestamp")
+		return m, ts
+	}
+
+	m, ts := timestamp()
+	assert.Nil(t, ts.Check(time.Now(), 0), "Check")
+	assert.True(t, ts.Matches(m), "Matches")
+	assert.Equal(t, imagestore.DefaultTimestampTTL, ts.ExpiresAt.Sub(ts.IssuedAt))
+	assert.NotNil(t, ts.Check(ts.ExpiresAt, 0), "expired")
+	assert.Nil(t, ts.Check(ts.ExpiresAt, time.Minute), "clock skew")
+	assert.NotNil(t, ts.Check(ts.IssuedAt.Add(-time.Hour), time.Minute), "issued in the future")
+
+	// the fresh timestamp is kept
+	assert.Nil(t, im.ScanImagesInDir(), "ScanImagesInDir")
+	_, same := timestamp()
+	assert.Equal(t, ts.Version, same.Version, "kept")
+
+	// the new revocation list is pinned by the new timestamp
+	err := os.WriteFile(filepath.Join(dir, imagestore.RevokedFile), []byte(`{"versions": [{"version": "v0.9.0"}]}`), 0644)
+	assert.Nil(t, err, "WriteFile")
+	assert.Nil(t, im.ScanImagesInDir(), "ScanImagesInDir")
+
+	m, resigned := timestamp()
+	assert.Greater(t, resigned.Version, ts.Version, "re-signed")
+	assert.NotEmpty(t, resigned.Revoked, "pinned")
+	assert.True(t, resigned.Matches(m), "Matches")
+
+	m.Revoked = nil
+	assert.False(t, resigned.Matches(m), "stripped revocation list")
+}
+
+func Test_Rotations(t *testing.T) {
+	dir := t.TempDir()
+	writeImage(t, dir, "app.v1.0.0", "")
+
+	rotation, err := imagestore.NewSigned(fakeSigner{}, &imagestore.KeyRotation{KeyID: "new", Key: "a2V5", Retire: []string{"fake"}})
+	assert.Nil(t, err, "NewSigned")
+	assert.Equal(t, "fake", rotation.KeyID, "signed by the old key")
+
+	b, err := json.Marshal([]*imagestore.Signed{rotation})
+	assert.Nil(t, err, "Marshal")
+	assert.Nil(t, os.WriteFile(filepath.Join(dir, imagestore.RotationFile), b, 0644), "WriteFile")
+
+	im := imagestore.New("/data", dir, fakeSigner{})
+	assert.Nil(t, im.ScanImagesInDir(), "ScanImagesInDir")
+
+	b, err = im.GetManifest("")
+	assert.Nil(t, err, "GetManifest")
+
+	m := &imagestore.Manifest{}
+	assert.Nil(t, json.Unmarshal(b, m), "Unmarshal")
+	assert.Equal(t, []*imagestore.Signed{rotation}, m.Rotations, "published as is")
+
+	// the bad rotations are skipped, the server keeps serving the last good ones
+	assert.Nil(t, os.WriteFile(filepath.Join(dir, imagestore.RotationFile), []byte(`[{"payload": "e30="}]`), 0644), "WriteFile")
+	assert.Nil(t, im.ScanImagesInDir(), "no key id")
+
+	b, err = im.GetManifest("")
+	assert.Nil(t, err, "GetManifest")
+	m = &imagestore.Manifest{}
+	assert.Nil(t, json.Unmarshal(b, m), "Unmarshal")
+	assert.Equal(t, []*imagestore.Signed{rotation}, m.Rotations, "the last good rotations")
+
+	assert.NotNil(t, (&imagestore.KeyRotation{KeyID: "new", Key: "a2V5", Retire: []string{"new"}}).Check(), "the new key is retired")
+}
+
+// cosigner is the offline release key.
+type cosigner struct{ fakeSigner }
+
+func (cosigner) KeyID() string {
+	return "cosigner"
+}
+
+func Test_Cosign(t *testing.T) {
+	dir := t.TempDir()
+	writeImage(t, dir, "app.v1.0.0", "")
+	writeImage(t, dir, "app.v1.1.0", `{"rollout": [{"at": "2000-01-01T00:00:00Z", "percent": 0}]}`)
+
+	im := imagestore.New("/data", dir, fakeSigner{})
+	im.SetReleaseTTL(4 * time.Second)
+	assert.Nil(t, im.ScanImagesInDir(), "ScanImagesInDir")
+
+	// the co-signers sign all releases, even before the rollout
+	b, err := im.GetReleases()
+	assert.Nil(t, err, "GetReleases")
+
+	m := &imagestore.Manifest{}
+	assert.Nil(t, json.Unmarshal(b, m), "Unmarshal")
+	if !assert.Len(t, m.Releases, 2) {
+		return
+	}
+	for _, image := range m.Releases {
+		assert.Nil(t, image.Release.AddSignature(cosigner{}), "AddSignature")
+		assert.Nil(t, image.Release.AddSignature(cosigner{}), "the signature is replaced")
+		assert.Len(t, image.Release.AllSignatures(), 2)
+	}
+
+	tampered := *m.Releases[0].Release
+	tampered.Payload = base64.URLEncoding.EncodeToString([]byte(`{"version": "9.0.0"}`))
+	assert.NotNil(t, tampered.AddSignature(cosigner{}), "the payload doesn't match")
+
+	b, err = json.Marshal(m)
+	assert.Nil(t, err, "Marshal")
+	assert.Nil(t, os.WriteFile(filepath.Join(dir, imagestore.CosignFile), b, 0644), "WriteFile")
+	assert.Nil(t, im.ScanImagesInDir(), "ScanImagesInDir")
+
+	cosigned := func() *imagestore.Signed {
+		b, err := im.GetManifest("")
+		assert.Nil(t, err, "GetManifest")
+
+		m := &imagestore.Manifest{}
+		assert.Nil(t, json.Unmarshal(b, m), "Unmarshal")
+		if !assert.Len(t, m.Releases, 2) {
+			t.FailNow()
+		}
+		return m.Releases[1].Release
+	}
+
+	r := cosigned()
+	if assert.Len(t, r.Signatures, 1) {
+		assert.Equal(t, "cosigner", r.Signatures[0].KeyID)
+	}
+
+	// the co-signed release is not re-signed before it expires
+	time.Sleep(2100 * time.Millisecond)
+	assert.Nil(t, im.ScanImagesInDir(), "ScanImagesInDir")
+	assert.Equal(t, r, cosigned(), "not re-signed")
+
+	// the bad co-signed manifest is skipped, the server keeps the last good co-signatures
+	assert.Nil(t, os.WriteFile(filepath.Join(dir, imagestore.CosignFile), []byte(`{"releases": {}}`), 0644), "WriteFile")
+	assert.Nil(t, im.ScanImagesInDir(), "bad manifest")
+	assert.Equal(t, r, cosigned(), "the last good co-signatures")
+}
+
+func Test_CosignRollout(t *testing.T) {
+	dir := t.TempDir()
+	writeImage(t, dir, "app.v1.1.0", `{"rollout": [{"at": "2000-01-01T00:00:00Z", "percent": 0}]}`)
+
+	im := imagestore.New("/data", dir, fakeSigner{})
+	assert.Nil(t, im.ScanImagesInDir(), "ScanImagesInDir")
+
+	b, err := im.GetReleases()
+	assert.Nil(t, err, "GetReleases")
+
+	m := &imagestore.Manifest{}
+	assert.Nil(t, json.Unmarshal(b, m), "Unmarshal")
+	if !assert.Len(t, m.Releases, 1) {
+		return
+	}
+	assert.Nil(t, m.Releases[0].Release.AddSignature(cosigner{}), "AddSignature")
+	want := m.Releases[0].Release
+
+	b, err = json.Marshal(m)
+	assert.Nil(t, err, "Marshal")
+	assert.Nil(t, os.WriteFile(filepath.Join(dir, imagestore.CosignFile), b, 0644), "WriteFile")
+	assert.Nil(t, im.ScanImagesInDir(), "ScanImagesInDir")
+
+	// the rollout is ramped up later, the signed fields are the same
+	time.Sleep(1100 * time.Millisecond)
+	metadata := filepath.Join(dir, "app.v1.1.0"+imagestore.MetadataExt)
+	assert.Nil(t, os.WriteFile(metadata, []byte(`{"rollout": [{"at": "2000-01-01T00:00:00Z", "percent": 100}]}`), 0644), "WriteFile")
+	later := time.Now().Add(time.Minute)
+	assert.Nil(t, os.Chtimes(metadata, later, later), "Chtimes")
+	assert.Nil(t, im.ScanImagesInDir(), "ScanImagesInDir")
+
+	b, err = im.GetManifest("")
+	assert.Nil(t, err, "GetManifest")
+
+	m = &imagestore.Manifest{}
+	assert.Nil(t, json.Unmarshal(b, m), "Unmarshal")
+	if !assert.Len(t, m.Releases, 1, "rolled out") {
+		return
+	}
+
+	// the release is signed by the server and the co-signer as before
+	r := m.Releases[0].Release
+	assert.Equal(t, want.FileSum, r.FileSum, "not re-signed")
+	keys := make([]string, 0)
+	for _, s := range r.AllSignatures() {
+		keys = append(keys, s.KeyID)
+	}
+	assert.ElementsMatch(t, []string{fakeSigner{}.KeyID(), "cosigner"}, keys)
+}
+
+func Test_Roles(t *testing.T) {
+	dir := t.TempDir()
+	writeImage(t, dir, "app.v1.0.0", "")
+	writeImage(t, dir, "app.v1.1.0", `{"rollout": [{"at": "2000-01-01T00:00:00Z", "percent": 0}]}`)
+
+	root, err := imagestore.NewSigned(fakeSigner{}, &imagestore.Root{Version: 1})
+	assert.Nil(t, err, "NewSigned")
+	b, err := json.Marshal([]*imagestore.Signed{root})
+	assert.Nil(t, err, "Marshal")
+	assert.Nil(t, os.WriteFile(filepath.Join(dir, imagestore.RootFile), b, 0644), "WriteFile")
+
+	// the snapshot is signed by the role key, the other documents by the server key
+	im := imagestore.New("/data", dir, fakeSigner{})
+	im.SetRoleSigner(imagestore.RoleSnapshot, cosigner{})
+	assert.Nil(t, im.ScanImagesInDir(), "ScanImagesInDir")
+
+	manifest := func() (*imagestore.Manifest, *imagestore.Snapshot) {
+		b, err := im.GetManifest("")
+		assert.Nil(t, err, "GetManifest")
+
+		m := &imagestore.Manifest{}
+		assert.Nil(t, json.Unmarshal(b, m), "Unmarshal")
+		if !assert.NotNil(t, m.Snapshot, "snapshot") {
+			t.FailNow()
+		}
+
+		payload, err := base64.URLEncoding.DecodeString(m.Snapshot.Payload)
+		assert.Nil(t, err, "DecodeString")
+
+		s := &imagestore.Snapshot{}
+		assert.Nil(t, json.Unmarshal(payload, s), "Unmarshal snapshot")
+		return m, s
+	}
+
+	m, s := manifest()
+	assert.Equal(t, []*imagestore.Signed{root}, m.Roots, "published as is")
+	assert.Equal(t, "cosigner", m.Snapshot.KeyID)
+	assert.Equal(t, "fake", m.Timestamp.KeyID)
+	assert.Len(t, s.Releases, 2, "all the releases are pinned")
+	assert.True(t, s.Matches(m), "Matches")
+	assert.Nil(t, s.Check(time.Now(), 0), "Check")
+	assert.NotNil(t, s.Check(s.ExpiresAt, 0), "expired")
+
+	// the new release is pinned by the new snapshot and timestamp
+	writeImage(t, dir, "app.v1.2.0", "")
+	assert.Nil(t, im.ScanImagesInDir(), "ScanImagesInDir")
+
+	m2, s2 := manifest()
+	assert.Greater(t, s2.Version, s.Version, "re-signed")
+	assert.Len(t, s2.Releases, 3)
+	assert.True(t, s2.Matches(m2), "Matches")
+	assert.False(t, s.Matches(m2), "the old snapshot doesn't pin the new release")
+
+	// the newest release can't be hidden from the clients
+	m2.Releases = m2.Releases[1:]
+	assert.False(t, s2.Matches(m2), "the pinned release is deleted")
+	m2, _ = manifest()
+	assert.NotEqual(t, m.Timestamp.Payload, m2.Timestamp.Payload, "the new snapshot is pinned")
+
+	// the bad roots are skipped, the server keeps serving the last good ones
+	assert.Nil(t, os.WriteFile(filepath.Join(dir, imagestore.RootFile), []byte(`{"payload": "e30="}`), 0644), "WriteFile")
+	assert.Nil(t, im.ScanImagesInDir(), "not a list")
+
+	m3, _ := manifest()
+	assert.Equal(t, []*imagestore.Signed{root}, m3.Roots, "the last good roots")
+
+	assert.NotNil(t, (&imagestore.Root{Version: 1}).Check(), "no roles")
+}
+
+// fakeVerifier trusts the signatures of fakeSigner only.
+type fakeVerifier struct{}
+
+func (fakeVerifier) Verify(_, keyID, _, sign string) (string, error) {
+	if keyID != "fake" || sign != base64.URLEncoding.EncodeToString([]byte("sign")) {
+		return "", fmt.Errorf("untrusted key %s", keyID)
+	}
+
+	return keyID, nil
+}
+
+func Test_Offline(t *testing.T) {
+	dir := t.TempDir()
+	writeImage(t, dir, "app.v1.0.0", "")
+	writeImage(t, dir, "app.v1.1.0", `{"channel": "stable"}`)
+	assert.Nil(t, os.WriteFile(filepath.Join(dir, imagestore.RevokedFile), []byte(`{"versions": [{"version": "v0.9.0"}]}`), 0644), "WriteFile")
+
+	// the images are signed on the air-gapped machine
+	signing := imagestore.New("/data", dir, fakeSigner{})
+	assert.Nil(t, signing.ScanImagesInDir(), "ScanImagesInDir")
+	assert.Nil(t, signing.WriteSidecars(), "WriteSidecars")
+	assert.FileExists(t, filepath.Join(dir, "app.v1.0.0"+imagestore.SidecarExt))
+	assert.FileExists(t, filepath.Join(dir, imagestore.ManifestSidecarFile))
+
+	// the image without the sidecar, with the sidecar of the other image and signed by the untrusted key
+	writeImage(t, dir, "app.v1.2.0", "")
+	writeImage(t, dir, "app.v1.3.0", "")
+	b, err := os.ReadFile(filepath.Join(dir, "app.v1.1.0"+imagestore.SidecarExt))
+	assert.Nil(t, err, "ReadFile")
+	assert.Nil(t, os.WriteFile(filepath.Join(dir, "app.v1.3.0"+imagestore.SidecarExt), b, 0644), "WriteFile")
+	writeImage(t, dir, "app.v1.4.0", "")
+	sc := &imagestore.Sidecar{}
+	b, err = os.ReadFile(filepath.Join(dir, "app.v1.0.0"+imagestore.SidecarExt))
+	assert.Nil(t, err, "ReadFile")
+	assert.Nil(t, json.Unmarshal(b, sc), "Unmarshal")
+	sc.KeyID = "other"
+	b, err = json.Marshal(sc)
+	assert.Nil(t, err, "Marshal")
+	assert.Nil(t, os.WriteFile(filepath.Join(dir, "app.v1.4.0"+imagestore.SidecarExt), b, 0644), "WriteFile")
+
+	im := imagestore.NewOffline("/data", dir, fakeVerifier{})
+	assert.Nil(t, im.ScanImagesInDir(), "ScanImagesInDir")
+	assert.Nil(t, im.Sing, "no private key")
+
+	manifest := func() *imagestore.Manifest {
+		b, err := im.GetManifest("")
+		assert.Nil(t, err, "GetManifest")
+
+		m := &imagestore.Manifest{}
+		assert.Nil(t, json.Unmarshal(b, m), "Unmarshal")
+		return m
+	}
+
+	versions := func(m *imagestore.Manifest) []string {
+		out := make([]string, 0)
+		for _, image := range m.Releases {
+			out = append(out, image.Version.String())
+		}
+		return out
+	}
+
+	m := manifest()
+	assert.Equal(t, []string{"1.1.0", "1.0.0"}, versions(m), "signed only")
+	assert.Equal(t, "1.1.0", m.Channels[imagestore.ChannelStable].Version.String())
+	if assert.NotNil(t, m.Timestamp, "timestamp") && assert.NotNil(t, m.Revoked, "revocation list") {
+		assert.Equal(t, signing.Images["app.v1.0.0"].Release, m.Releases[1].Release, "published as is")
+	}
+	// the patches are signed offline with the release
+	if assert.Len(t, m.Releases[0].Patches, 1) {
+		assert.Equal(t, signing.Images["app.v1.1.0"].Patches[0].FileSum, m.Releases[0].Patches[0].FileSum, "signed patch")
+		assert.Equal(t, "1.0.0", m.Releases[0].Patches[0].From.String())
+	}
+
+	// the signed channel doesn't match the new metadata
+	time.Sleep(10 * time.Millisecond)
+	writeImage(t, dir, "app.v1.1.0", `{"channel": "beta"}`)
+	assert.Nil(t, im.ScanImagesInDir(), "ScanImagesInDir")
+	assert.Equal(t, []string{"1.0.0"}, versions(manifest()), "the changed metadata isn't signed")
+
+	// the new image is published after the next offline signing
+	assert.Nil(t, os.Remove(filepath.Join(dir, "app.v1.3.0")), "Remove")
+	assert.Nil(t, os.Remove(filepath.Join(dir, "app.v1.4.0")), "Remove")
+	assert.Nil(t, signing.ScanImagesInDir(), "ScanImagesInDir")
+	assert.Nil(t, signing.WriteSidecars(), "WriteSidecars")
+	assert.Nil(t, im.ScanImagesInDir(), "ScanImagesInDir")
+	assert.Equal(t, []string{"1.2.0", "1.1.0", "1.0.0"}, versions(manifest()))
+
+	// the bad sidecar is skipped, the server keeps serving the last good one
+	timestamp := manifest().Timestamp
+	assert.Nil(t, os.WriteFile(filepath.Join(dir, imagestore.ManifestSidecarFile), []byte(`{"timestamp": {"payload": "e30="}}`), 0644), "WriteFile")
+	assert.Nil(t, im.ScanImagesInDir(), "unsigned timestamp")
+	assert.Equal(t, timestamp, manifest().Timestamp, "the last good sidecar")
+}
@@ -0,0 +1,81 @@
+package imagestore
+
+import (
+	"log"
+	"path"
+
+	"github.com/pkg/errors"
+
+	"nametag/internal/signature"
+)
+
+// RotationFile is the list of the signed KeyRotation documents in the image directory,
+// the oldest first. The server publishes them in the manifest as is: each one is signed
+// offline by a key which the clients already trust (see cmd/rotate-key).
+const RotationFile = "keys.json"
+
+// KeyRotation adds the new trusted key and retires the old ones.
+// It's signed by the old key, so the clients trust the new key without a reinstall,
+// and by the new key, so its holder proves that it has the private key.
+type KeyRotation struct {
+	// KeyID is the id of the new key, Alg is its signature algorithm, RSA-PSS if it's empty,
+	// and Key is the public key: the base64 of PKCS1 form for RSA, the base64 of the Ed25519 key
+	// or the text of the minisign .pub file.
+	KeyID string `json:"key_id"`
+	Alg   string `json:"alg,omitempty"`
+	Key   string `json:"key"`
+
+	// Retire are the ids of the keys which are not trusted anymore, e.g. the leaked ones.
+	Retire []string `json:"retire,omitempty"`
+}
+
+// Check checks that the rotation is usable.
+func (r *KeyRotation) Check() error {
+	if r.KeyID == "" || r.Key == "" {
+		return errors.Errorf("key rotation: empty key")
+	}
+	if err := signature.Check(r.Alg); err != nil {
+		return errors.Wrap(err, "key rotation")
+	}
+
+	for _, id := range r.Retire {
+		if id == r.KeyID {
+			return errors.Errorf("key rotation: the new key %s is retired", id)
+		}
+	}
+
+	return nil
+}
+
+// loadRotations reads the key rotation documents if they were changed.
+func (im *AllImages) loadRotations() error {
+	im.mx.RLock()
+	lastModTime := im.rotationsModTime
+	im.mx.RUnlock()
+
+	rotations := make([]*Signed, 0)
+	modTime, changed, err := readDocument(path.Join(im.dir, RotationFile), lastModTime, &rotations)
+	for i, s := range rotations {
+		if err == nil && (s == nil || s.KeyID == "") {
+			err = errors.Errorf("%s: rotation %d has no key id", RotationFile, i)
+		}
+	}
+	if err != nil {
+		im.skipDocument(&im.rotationsModTime, modTime)
+		return err
+	}
+	if !changed {
+		return nil
+	}
+
+	if len(rotations) == 0 {
+		rotations = nil
+	}
+
+	im.mx.Lock()
+	im.rotations, im.rotationsModTime = rotations, modTime
+	im.mx.Unlock()
+
+	log.Printf("Loaded %d key rotations", len(rotations))
+	return nil
+}
@@ -0,0 +1,76 @@
+package imagestore
+
+import (
+	"sort"
+	"time"
+)
+
+// ManifestPath is the uri of the manifest on the image server.
+const ManifestPath = "/manifest"
+
+// Manifest is published by the image server.
+// It contains the last image for each channel and all the releases,
+// so the clients with the version constraints can find an older suitable release.
+type Manifest struct {
+	// Channels are for the old clients which know nothing about the platforms,
+	// they contain the images without the platform only.
+	Channels map[string]*Image `json:"channels"`
+
+	// Releases are sorted by version, the newest first, there is one entry for each platform build.
+	// They are all the releases, including the ones of the staged rollouts which the client doesn't get yet.
+	Releases []*Image `json:"releases,omitempty"`
+
+	// Rollback is the signed Rollback directive, nil if there is no rollback.
+	Rollback *Signed `json:"rollback,omitempty"`
+
+	// Revoked is the signed Revocations list, nil if nothing is revoked.
+	Revoked *Signed `json:"revoked,omitempty"`
+
+	// Rotations are the signed KeyRotation documents, the oldest first.
+	Rotations []*Signed `json:"rotations,omitempty"`
+
+	// Roots are the signed Root documents, the oldest first.
+	Roots []*Signed `json:"roots,omitempty"`
+
+	// Snapshot is the signed Snapshot which pins the releases, the rollback directive and the revocation list.
+	Snapshot *Signed `json:"snapshot,omitempty"`
+
+	// Timestamp is the signed Timestamp, the manifest without the fresh timestamp is rejected.
+	Timestamp *Signed `json:"timestamp,omitempty"`
+
+	// NextCheckAfter asks the clients to wait at least that many seconds before the next check.
+	NextCheckAfter int `json:"next_check_after,omitempty"`
+}
+
+// buildManifest lists the images which are not revoked and selects the last of them
+// for each channel which is rolled out for the client with instanceID.
+// The releases are listed all, they are pinned by the snapshot, and the clients
+// select their cohort by the signed rollout of the snapshot.
+func buildManifest(images map[string]Image, revoked *Revocations, instanceID string, now time.Time) *Manifest {
+	m := &Manifest{Channels: map[string]*Image{}}
+
+	for name := range images {
+		im := images[name]
+		if revoked.Revoked(im.Version) == nil {
+			m.Releases = append(m.Releases, &im)
+		}
+	}
+	sort.Slice(m.Releases, func(i, j int) bool {
+		if c := m.Releases[i].Version.Compare(m.Releases[j].Version); c != 0 {
+			return c > 0
+		}
+		return m.Releases[i].Platform < m.Releases[j].Platform
+	})
+
+	// the first release which the channel follows is the last one
+	for _, ch := range channels {
+		for _, im := range m.Releases {
+			if im.Platform == "" && Follows(ch, im.Channel) && InCohort(instanceID, im.Version, im.Rollout.Percent(now)) {
+				m.Channels[ch] = im
+				break
+			}
+		}
+	}
+
+	return m
+}
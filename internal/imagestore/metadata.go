@@ -0,0 +1,74 @@
+package imagestore
+
+import (
+	"encoding/json"
+	"os"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// MetadataExt is the extension of the sidecar metadata file.
+// The metadata of the image "app.v1.2.3" is stored in "app.v1.2.3.json".
+const MetadataExt = ".json"
+
+// Metadata is the optional release information stored next to the image.
+type Metadata struct {
+	// Channel overrides the channel which is got from the version.
+	Channel string `json:"channel"`
+
+	// Rollout is the schedule of the staged rollout.
+	Rollout Rollout `json:"rollout"`
+
+	// Critical marks the security release, the clients apply it outside the maintenance windows.
+	Critical bool `json:"critical"`
+
+	// ModTime is the modification time of the sidecar file, it's used to reload the metadata.
+	ModTime time.Time `json:"-"`
+}
+
+// ReadMetadata reads the sidecar metadata of the image.
+// It returns the empty metadata if there is no sidecar file.
+func ReadMetadata(fullName string) (*Metadata, error) {
+	md := &Metadata{}
+
+	info, err := os.Stat(fullName + MetadataExt)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return md, nil
+		}
+		return nil, errors.Wrap(err, "read metadata")
+	}
+
+	b, err := os.ReadFile(fullName + MetadataExt)
+	if err != nil {
+		return nil, errors.Wrap(err, "read metadata")
+	}
+
+	if err := json.Unmarshal(b, md); err != nil {
+		return nil, errors.Wrapf(err, "metadata %s", fullName+MetadataExt)
+	}
+
+	if md.Channel != "" {
+		if err := CheckChannel(md.Channel); err != nil {
+			return nil, errors.Wrapf(err, "metadata %s", fullName+MetadataExt)
+		}
+	}
+
+	if err := md.Rollout.Check(); err != nil {
+		return nil, errors.Wrapf(err, "metadata %s", fullName+MetadataExt)
+	}
+
+	md.ModTime = info.ModTime()
+	return md, nil
+}
+
+// metadataModTime returns the modification time of the sidecar file or zero time.
+func metadataModTime(fullName string) time.Time {
+	info, err := os.Stat(fullName + MetadataExt)
+	if err != nil {
+		return time.Time{}
+	}
+
+	return info.ModTime()
+}
@@ -0,0 +1,66 @@
+package imagestore
+
+import (
+	"strings"
+
+	"github.com/pkg/errors"
+)
+
+// Platform is the target of the build, e.g. linux/amd64/v3.
+// Variant is the microarchitecture level, e.g. GOAMD64 v1-v4 for amd64, empty means the base level.
+//
+// The platform is the suffix of the file name: "app.v1.2.3.linux-amd64-v3".
+// The images without the suffix are published for the old clients, the platform of the build
+// is unknown, so the updater never installs them.
+type Platform struct {
+	OS      string
+	Arch    string
+	Variant string
+}
+
+// ParsePlatform parses "os/arch" or "os/arch/variant", the empty string is the zero platform.
+func ParsePlatform(s string) (Platform, error) {
+	if s == "" {
+		return Platform{}, nil
+	}
+
+	parts := strings.Split(s, "/")
+	if len(parts) < 2 || len(parts) > 3 || parts[0] == "" || parts[1] == "" {
+		return Platform{}, errors.Errorf("platform %q: want os/arch or os/arch/variant", s)
+	}
+
+	p := Platform{OS: parts[0], Arch: parts[1]}
+	if len(parts) == 3 {
+		p.Variant = parts[2]
+	}
+
+	return p, nil
+}
+
+// String returns "os/arch" or "os/arch/variant", the empty string for the zero platform.
+func (p Platform) String() string {
+	if p.IsZero() {
+		return ""
+	}
+	if p.Variant == "" {
+		return p.OS + "/" + p.Arch
+	}
+
+	return p.OS + "/" + p.Arch + "/" + p.Variant
+}
+
+// IsZero reports whether the platform is unknown.
+func (p Platform) IsZero() bool {
+	return p == Platform{}
+}
+
+// Supports reports whether the build for the platform b runs on the platform p.
+// Variant of p is the highest supported level, the levels are compared as strings: v1 < v2 < v3.
+// The build for the unknown platform isn't supported, e.g. the linux/amd64 one may be offered to darwin/arm64.
+func (p Platform) Supports(b Platform) bool {
+	if b.IsZero() {
+		return false
+	}
+
+	return b.OS == p.OS && b.Arch == p.Arch && b.Variant <= p.Variant
+}
@@ -0,0 +1,128 @@
+package imagestore
+
+import (
+	"log"
+	"time"
+
+	"github.com/hashicorp/go-version"
+	"github.com/pkg/errors"
+)
+
+// DefaultReleaseTTL is the lifetime of the release signature.
+// The server re-signs the releases when half of it is left,
+// so the clients reject the releases of a frozen server or a replayed manifest.
+const DefaultReleaseTTL = 30 * 24 * time.Hour
+
+// Release is the signed part of the image which binds all the fields used by the clients.
+// The signed json is the canonical form: the clients decode the verified payload
+// and never trust the unsigned fields of the image.
+type Release struct {
+	Version     *version.Version `json:"version"`
+	Channel     string           `json:"channel"`
+	Platform    string           `json:"platform,omitempty"`
+	Uri         string           `json:"uri"`
+	Compression string           `json:"compression,omitempty"`
+	Size        int64            `json:"size"`
+	FileSum     string           `json:"file_sum"`
+	Critical    bool             `json:"critical,omitempty"`
+	Patches     []Patch          `json:"patches,omitempty"`
+	IssuedAt    time.Time        `json:"issued_at"`
+	ExpiresAt   time.Time        `json:"expires_at"`
+}
+
+// Check checks that the release is complete and is not expired at now,
+// skew is the tolerated difference of the clocks.
+func (r *Release) Check(now time.Time, skew time.Duration) error {
+	if r.Version == nil {
+		return errors.Errorf("release: empty version")
+	}
+	if r.FileSum == "" {
+		return errors.Errorf("release %s: empty file sum", r.Version)
+	}
+	if r.Size <= 0 {
+		return errors.Errorf("release %s: empty size", r.Version)
+	}
+	if !now.Add(-skew).Before(r.ExpiresAt) {
+		return errors.Errorf("release %s: expired at %s", r.Version, r.ExpiresAt.Format(time.RFC3339))
+	}
+
+	return nil
+}
+
+// Apply copies the signed fields to the image.
+func (r *Release) Apply(image *Image) {
+	image.Version = r.Version
+	image.Channel = r.Channel
+	image.Platform = r.Platform
+	image.Uri = r.Uri
+	image.Compression = r.Compression
+	image.Size = r.Size
+	image.FileSum = r.FileSum
+	image.Critical = r.Critical
+	image.Patches = r.Patches
+}
+
+// SetReleaseTTL sets the lifetime of the release signatures.
+func (im *AllImages) SetReleaseTTL(ttl time.Duration) {
+	im.releaseTTL = ttl
+}
+
+// signRelease signs the release of the image, it must be called after any change of the signed fields.
+func (im *AllImages) signRelease(image *Image, now time.Time) error {
+	issuedAt := now.UTC().Truncate(time.Second)
+	r := &Release{
+		Version:     image.Version,
+		Channel:     image.Channel,
+		Platform:    image.Platform,
+		Uri:         image.Uri,
+		Compression: image.Compression,
+		Size:        image.Size,
+		FileSum:     image.FileSum,
+		Critical:    image.Critical,
+		Patches:     image.Patches,
+		IssuedAt:    issuedAt,
+		ExpiresAt:   issuedAt.Add(im.releaseTTL),
+	}
+
+	signed, err := NewSigned(im.signer(RoleTargets), r)
+	if err != nil {
+		return errors.Wrapf(err, "sign release %s", image.Image)
+	}
+
+	image.Release = signed
+	image.expiresAt = r.ExpiresAt
+	return nil
+}
+
+// resignReleases re-signs the releases which expire in less than half of the TTL
+// except the co-signed ones.
+func (im *AllImages) resignReleases(now time.Time) error {
+	im.mx.RLock()
+	images := make([]Image, 0)
+	for _, image := range im.Images {
+		if image.expiresAt.Sub(now) < im.releaseTTL/2 && !image.cosigned(now) {
+			images = append(images, image)
+		}
+	}
+	im.mx.RUnlock()
+
+	// signing is slow, so it's done without the lock
+	for i := range images {
+		if err := im.signRelease(&images[i], now); err != nil {
+			return err
+		}
+	}
+
+	im.mx.Lock()
+	defer im.mx.Unlock()
+
+	for _, image := range images {
+		// the image may be removed or changed in the meantime
+		if old, find := im.Images[image.Image]; find && old.metadataModTime.Equal(image.metadataModTime) {
+			im.Images[image.Image] = image
+			log.Printf("Re-signed release: %s, expires at %s", image.Image, image.expiresAt.Format(time.RFC3339))
+		}
+	}
+
+	return nil
+}
@@ -0,0 +1,96 @@
+package imagestore
+
+import (
+	"log"
+	"path"
+
+	"github.com/hashicorp/go-version"
+	"github.com/pkg/errors"
+)
+
+// RevokedFile is the list of the revoked (yanked) versions in the image directory,
+// it's published signed in the manifest. The revoked images are not offered to the clients,
+// the clients running a revoked version must leave it.
+const RevokedFile = "revoked.json"
+
+// Revocation is the revoked version.
+type Revocation struct {
+	Version *version.Version `json:"version"`
+	Reason  string           `json:"reason,omitempty"`
+}
+
+// Revocations is the list of the revoked versions.
+type Revocations struct {
+	Versions []Revocation `json:"versions"`
+}
+
+// Check checks that the list is usable.
+func (r *Revocations) Check() error {
+	for i, rv := range r.Versions {
+		if rv.Version == nil {
+			return errors.Errorf("revocation %d: empty version", i)
+		}
+	}
+
+	return nil
+}
+
+// Revoked returns the revocation of the version v, nil if it's not revoked.
+// The nil list revokes nothing.
+func (r *Revocations) Revoked(v *version.Version) *Revocation {
+	if r == nil {
+		return nil
+	}
+
+	for i := range r.Versions {
+		if r.Versions[i].Version.Equal(v) {
+			return &r.Versions[i]
+		}
+	}
+
+	return nil
+}
+
+// loadRevoked reads and signs the revocation list if it was changed.
+func (im *AllImages) loadRevoked() error {
+	im.mx.RLock()
+	lastModTime := im.revokedModTime
+	im.mx.RUnlock()
+
+	r := &Revocations{}
+	modTime, changed, err := readDocument(path.Join(im.dir, RevokedFile), lastModTime, r)
+	if err == nil && changed && !modTime.IsZero() {
+		err = r.Check()
+	}
+	if err != nil {
+		// the revoked versions of the last good list are not published again
+		im.skipDocument(&im.revokedModTime, modTime)
+		return err
+	}
+	if !changed {
+		return nil
+	}
+
+	if modTime.IsZero() {
+		im.mx.Lock()
+		im.revoked, im.revokedSigned, im.revokedModTime = nil, nil, modTime
+		im.mx.Unlock()
+
+		log.Printf("Revocation list is removed")
+		return nil
+	}
+
+	signed, err := NewSigned(im.signer(RoleTargets), r)
+	if err != nil {
+		return err
+	}
+
+	im.mx.Lock()
+	im.revoked, im.revokedSigned, im.revokedModTime = r, signed, modTime
+	im.mx.Unlock()
+
+	for _, rv := range r.Versions {
+		log.Printf("Revoked version %s: %s", rv.Version, rv.Reason)
+	}
+	return nil
+}
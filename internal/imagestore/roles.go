@@ -0,0 +1,261 @@
+package imagestore
+
+import (
+	"log"
+	"maps"
+	"path"
+	"slices"
+	"sort"
+	"time"
+
+	"github.com/pkg/errors"
+
+	"nametag/internal/signature"
+)
+
+// The roles of the signing keys after The Update Framework:
+// root signs the Root documents and the key rotations, targets signs the releases,
+// the rollback directive and the revocation list, snapshot signs the Snapshot
+// and timestamp signs the Timestamp.
+const (
+	RoleRoot      = "root"
+	RoleTargets   = "targets"
+	RoleSnapshot  = "snapshot"
+	RoleTimestamp = "timestamp"
+)
+
+var roles = []string{RoleRoot, RoleTargets, RoleSnapshot, RoleTimestamp}
+
+// RootFile is the list of the signed Root documents in the image directory, the oldest first.
+// They are signed offline (see cmd/nametag-root) and published in the manifest as is,
+// so the clients verify each new root by the previous one.
+const RootFile = "root.json"
+
+// DefaultSnapshotTTL is the lifetime of the snapshot, the server re-signs it when half of it is passed.
+const DefaultSnapshotTTL = 7 * 24 * time.Hour
+
+// PublicKey is the public key of the root document, see KeyRotation.Key for its form.
+type PublicKey struct {
+	Alg string `json:"alg,omitempty"`
+	Key string `json:"key"`
+}
+
+// Role lists the keys of the role and the number of them which must sign the document.
+type Role struct {
+	KeyIDs    []string `json:"key_ids"`
+	Threshold int      `json:"threshold"`
+}
+
+// Root assigns the keys to the roles. Each new root is signed by the threshold
+// of the root keys of the previous root and of its own root keys.
+type Root struct {
+	Version   int64                `json:"version"`
+	ExpiresAt time.Time            `json:"expires_at"`
+	Keys      map[string]PublicKey `json:"keys"`
+	Roles     map[string]Role      `json:"roles"`
+}
+
+// Check checks that the root is complete, the expiry is checked by the clients
+// for the last root only.
+func (r *Root) Check() error {
+	if r.Version <= 0 {
+		return errors.Errorf("root: version must be positive")
+	}
+
+	for id, key := range r.Keys {
+		if key.Key == "" {
+			return errors.Errorf("root %d: empty key %s", r.Version, id)
+		}
+		if err := signature.Check(key.Alg); err != nil {
+			return errors.Wrapf(err, "root %d", r.Version)
+		}
+	}
+
+	for _, name := range roles {
+		role, ok := r.Roles[name]
+		if !ok {
+			return errors.Errorf("root %d: no role %s", r.Version, name)
+		}
+		if role.Threshold < 1 || role.Threshold > len(role.KeyIDs) {
+			return errors.Errorf("root %d: role %s has threshold %d of %d keys", r.Version, name, role.Threshold, len(role.KeyIDs))
+		}
+		for _, id := range role.KeyIDs {
+			if _, ok := r.Keys[id]; !ok {
+				return errors.Errorf("root %d: role %s has unknown key %s", r.Version, name, id)
+			}
+		}
+	}
+
+	return nil
+}
+
+// Snapshot pins the signed documents of the targets role, so the clients reject
+// the manifest which mixes the documents of the different times.
+type Snapshot struct {
+	Version   int64     `json:"version"`
+	IssuedAt  time.Time `json:"issued_at"`
+	ExpiresAt time.Time `json:"expires_at"`
+
+	// Releases are the FileSum of the signed releases of all the images which are not revoked, sorted.
+	// The manifest lists all of them, so the release can't be hidden from the clients.
+	Releases []string `json:"releases"`
+
+	// Rollouts are the schedules of the staged rollouts by the FileSum of the release,
+	// the clients select their cohort by them. The releases without the rollout are not listed.
+	Rollouts map[string]Rollout `json:"rollouts,omitempty"`
+
+	// Rollback and Revoked are the FileSum of the signed documents, empty if there are none.
+	Rollback string `json:"rollback,omitempty"`
+	Revoked  string `json:"revoked,omitempty"`
+}
+
+// Check checks the snapshot at now, skew is the tolerated difference of the clocks.
+func (s *Snapshot) Check(now time.Time, skew time.Duration) error {
+	if !now.Add(-skew).Before(s.ExpiresAt) {
+		return errors.Errorf("snapshot %d is expired at %s", s.Version, s.ExpiresAt.Format(time.RFC3339))
+	}
+
+	return nil
+}
+
+// Matches reports whether the manifest has exactly the documents pinned by the snapshot.
+// The manifest without the pinned release is rejected: the deleted newest releases
+// would freeze the clients on the old version.
+func (s *Snapshot) Matches(m *Manifest) bool {
+	if s.Rollback != signedSum(m.Rollback) || s.Revoked != signedSum(m.Revoked) {
+		return false
+	}
+
+	listed := make(map[string]bool, len(m.Releases))
+	for _, image := range m.Releases {
+		if image == nil || image.Release == nil || !s.Pins(image.Release) {
+			return false
+		}
+		listed[image.Release.FileSum] = true
+	}
+
+	for _, sum := range s.Releases {
+		if !listed[sum] {
+			return false
+		}
+	}
+
+	return true
+}
+
+// Rollout returns the signed schedule of the staged rollout of the release.
+func (s *Snapshot) Rollout(release *Signed) Rollout {
+	return s.Rollouts[release.FileSum]
+}
+
+// Pins reports whether the signed release is pinned by the snapshot.
+func (s *Snapshot) Pins(release *Signed) bool {
+	i := sort.SearchStrings(s.Releases, release.FileSum)
+	return i < len(s.Releases) && s.Releases[i] == release.FileSum
+}
+
+// SetRoleSigner signs the documents of the role by the signer instead of Sing.
+// The root documents are signed offline.
+func (im *AllImages) SetRoleSigner(role string, signer Signer) {
+	im.mx.Lock()
+	defer im.mx.Unlock()
+
+	if im.roleSigners == nil {
+		im.roleSigners = map[string]Signer{}
+	}
+	im.roleSigners[role] = signer
+}
+
+// signer returns the signer of the role.
+func (im *AllImages) signer(role string) Signer {
+	im.mx.RLock()
+	defer im.mx.RUnlock()
+
+	if s, ok := im.roleSigners[role]; ok {
+		return s
+	}
+
+	return im.Sing
+}
+
+// SetSnapshotTTL sets the lifetime of the snapshot.
+func (im *AllImages) SetSnapshotTTL(ttl time.Duration) {
+	im.snapshotTTL = ttl
+}
+
+// loadRoots reads the root documents if they were changed.
+func (im *AllImages) loadRoots() error {
+	im.mx.RLock()
+	lastModTime := im.rootsModTime
+	im.mx.RUnlock()
+
+	roots := make([]*Signed, 0)
+	modTime, changed, err := readDocument(path.Join(im.dir, RootFile), lastModTime, &roots)
+	if err != nil {
+		im.skipDocument(&im.rootsModTime, modTime)
+		return err
+	}
+	if !changed {
+		return nil
+	}
+
+	if len(roots) == 0 {
+		roots = nil
+	}
+
+	im.mx.Lock()
+	im.roots, im.rootsModTime = roots, modTime
+	im.mx.Unlock()
+
+	log.Printf("Loaded %d root documents", len(roots))
+	return nil
+}
+
+// signSnapshot signs the new snapshot if half of its lifetime is passed
+// or the signed documents are changed.
+func (im *AllImages) signSnapshot(now time.Time) error {
+	im.mx.RLock()
+	s := Snapshot{
+		Version:  im.snapshot.Version,
+		Releases: make([]string, 0, len(im.Images)),
+		Rollouts: map[string]Rollout{},
+		Rollback: signedSum(im.rollback),
+		Revoked:  signedSum(im.revokedSigned),
+	}
+	for _, image := range im.Images {
+		if image.Release == nil || im.revoked.Revoked(image.Version) != nil {
+			continue
+		}
+		s.Releases = append(s.Releases, image.Release.FileSum)
+		if len(image.Rollout) > 0 {
+			s.Rollouts[image.Release.FileSum] = image.Rollout
+		}
+	}
+	sort.Strings(s.Releases)
+
+	fresh := im.snapshotSigned != nil && im.snapshot.ExpiresAt.Sub(now) >= im.snapshotTTL/2 &&
+		im.snapshot.Rollback == s.Rollback && im.snapshot.Revoked == s.Revoked && slices.Equal(im.snapshot.Releases, s.Releases) &&
+		maps.EqualFunc(im.snapshot.Rollouts, s.Rollouts, Rollout.Equal)
+	im.mx.RUnlock()
+
+	if fresh {
+		return nil
+	}
+
+	// the version is the time of the signing as for the timestamp
+	s.IssuedAt = now.UTC().Truncate(time.Second)
+	s.ExpiresAt = s.IssuedAt.Add(im.snapshotTTL)
+	s.Version = max(s.Version+1, s.IssuedAt.Unix())
+
+	signed, err := NewSigned(im.signer(RoleSnapshot), s)
+	if err != nil {
+		return errors.Wrap(err, "sign snapshot")
+	}
+
+	im.mx.Lock()
+	im.snapshot, im.snapshotSigned = s, signed
+	im.mx.Unlock()
+
+	log.Printf("Signed snapshot %d of %d releases, expires at %s", s.Version, len(s.Releases), s.ExpiresAt.Format(time.RFC3339))
+	return nil
+}
@@ -0,0 +1,131 @@
+package imagestore
+
+import (
+	"log"
+	"path"
+	"slices"
+	"sort"
+
+	"github.com/hashicorp/go-version"
+	"github.com/pkg/errors"
+)
+
+// RollbackFile is the rollback directive in the image directory,
+// it's published signed in the manifest. Remove the file to cancel the rollback.
+const RollbackFile = "rollback.json"
+
+// Rollback asks the clients running the broken versions to go back to Target.
+// The clients install the older version by the signed directive only.
+type Rollback struct {
+	// Target is the version to go back to, it must be published.
+	Target *version.Version `json:"target"`
+
+	// TargetSums are the hashes of the target images, one for each platform build.
+	// They are set by the server, so the directive can't be used with another image.
+	TargetSums []string `json:"target_sums"`
+
+	// From are the broken versions in go-version syntax, e.g. ">= 1.5.0, < 1.5.1".
+	// The pre-releases are checked by their release part.
+	From string `json:"from"`
+
+	Reason string `json:"reason,omitempty"`
+}
+
+// Check checks that the directive is usable.
+func (r *Rollback) Check() error {
+	if r.Target == nil {
+		return errors.Errorf("rollback: empty target")
+	}
+
+	if r.From == "" {
+		return errors.Errorf("rollback: empty from, the broken versions are required")
+	}
+	if _, err := version.NewConstraint(r.From); err != nil {
+		return errors.Wrap(err, "rollback from")
+	}
+
+	if r.Applies(r.Target) {
+		return errors.Errorf("rollback: target %s is in %q", r.Target, r.From)
+	}
+
+	return nil
+}
+
+// Applies reports whether the version v must go back to the target.
+func (r *Rollback) Applies(v *version.Version) bool {
+	c, err := version.NewConstraint(r.From)
+	if err != nil {
+		return false
+	}
+
+	return v.GreaterThan(r.Target) && c.Check(v.Core())
+}
+
+// loadRollback reads the rollback directive if it was changed and signs it with the hashes
+// of the target images. The target images are resolved on every scan, they may be added
+// or removed after the directive.
+func (im *AllImages) loadRollback() error {
+	im.mx.RLock()
+	lastModTime, r := im.rollbackModTime, im.rollbackDirective
+	im.mx.RUnlock()
+
+	d := &Rollback{}
+	modTime, changed, err := readDocument(path.Join(im.dir, RollbackFile), lastModTime, d)
+	if err == nil && changed && !modTime.IsZero() {
+		err = d.Check()
+	}
+	if err != nil {
+		im.skipDocument(&im.rollbackModTime, modTime)
+		return err
+	}
+
+	if changed && modTime.IsZero() {
+		im.mx.Lock()
+		im.rollback, im.rollbackDirective, im.rollbackModTime = nil, nil, modTime
+		im.mx.Unlock()
+
+		log.Printf("Rollback is canceled")
+		return nil
+	}
+	if changed {
+		r = d
+	}
+	if r == nil {
+		return nil
+	}
+
+	im.mx.RLock()
+	sums := make([]string, 0)
+	for _, image := range im.Images {
+		if image.Version.Equal(r.Target) {
+			sums = append(sums, image.FileSum)
+		}
+	}
+	im.mx.RUnlock()
+	sort.Strings(sums)
+
+	if !changed && slices.Equal(sums, r.TargetSums) {
+		return nil
+	}
+
+	// the directive waits for its target without the signature
+	directive := *r
+	directive.TargetSums = sums
+	var signed *Signed
+	if len(sums) > 0 {
+		if signed, err = NewSigned(im.signer(RoleTargets), &directive); err != nil {
+			return err
+		}
+	}
+
+	im.mx.Lock()
+	im.rollback, im.rollbackDirective, im.rollbackModTime = signed, &directive, modTime
+	im.mx.Unlock()
+
+	if signed == nil {
+		return errors.Errorf("rollback: target %s is not published", r.Target)
+	}
+
+	log.Printf("Rollback from %s to %s: %s", r.From, r.Target, r.Reason)
+	return nil
+}
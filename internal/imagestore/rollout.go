@@ -0,0 +1,91 @@
+package imagestore
+
+import (
+	"crypto/sha256"
+	"encoding/binary"
+	"slices"
+	"sort"
+	"time"
+
+	"github.com/hashicorp/go-version"
+	"github.com/pkg/errors"
+)
+
+// InstanceHeader is the http header with the stable client instance ID.
+const InstanceHeader = "X-Nametag-Instance"
+
+// bucketCount is the number of the cohort buckets, it allows percents like 0.5%.
+const bucketCount = 10000
+
+// RolloutStep sets the percent of the clients which get the release since At.
+type RolloutStep struct {
+	At      time.Time `json:"at"`
+	Percent float64   `json:"percent"`
+}
+
+// Rollout is the schedule of the staged rollout, e.g. 1% -> 10% -> 100%.
+// The empty schedule means the release is available for all clients at once.
+type Rollout []RolloutStep
+
+// Check checks the percents and sorts the steps by time.
+func (r Rollout) Check() error {
+	for _, s := range r {
+		if s.Percent < 0 || s.Percent > 100 {
+			return errors.Errorf("rollout percent %v at %s is out of [0, 100]", s.Percent, s.At.Format(time.RFC3339))
+		}
+	}
+
+	sort.SliceStable(r, func(i, j int) bool {
+		return r[i].At.Before(r[j].At)
+	})
+
+	return nil
+}
+
+// Equal reports whether the schedules have the same steps.
+func (r Rollout) Equal(other Rollout) bool {
+	return slices.EqualFunc(r, other, func(a, b RolloutStep) bool {
+		return a.At.Equal(b.At) && a.Percent == b.Percent
+	})
+}
+
+// Percent returns the percent of the clients which get the release at the moment.
+// The release is hidden before the first step.
+func (r Rollout) Percent(now time.Time) float64 {
+	if len(r) == 0 {
+		return 100
+	}
+
+	percent := 0.0
+	for _, s := range r {
+		if s.At.After(now) {
+			break
+		}
+		percent = s.Percent
+	}
+
+	return percent
+}
+
+// Bucket returns the deterministic bucket of the client for the version in [0, 100).
+// The version is a part of the hash, so the first 1% of the clients
+// is different for each release.
+func Bucket(instanceID string, v *version.Version) float64 {
+	h := sha256.Sum256([]byte(instanceID + "/" + v.String()))
+	return float64(binary.BigEndian.Uint64(h[:8])%bucketCount) * 100 / bucketCount
+}
+
+// InCohort reports whether the client gets the release with the rollout percent.
+// The client which is in the cohort stays in it when the percent grows.
+// The clients without instance ID get the fully rolled out releases only.
+func InCohort(instanceID string, v *version.Version, percent float64) bool {
+	if percent >= 100 {
+		return true
+	}
+
+	if instanceID == "" {
+		return false
+	}
+
+	return Bucket(instanceID, v) < percent
+}
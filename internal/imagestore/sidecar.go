@@ -0,0 +1,289 @@
+package imagestore
+
+import (
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"log"
+	"os"
+	"path"
+	"time"
+
+	"github.com/pkg/errors"
+
+	"nametag/internal/signature"
+)
+
+// SidecarExt is the extension of the detached signature of the image made offline (see cmd/nametag-sign).
+// The signature of the image "app.v1.2.3" is stored in "app.v1.2.3.sig".
+const SidecarExt = ".sig"
+
+// ManifestSidecarFile is the detached signed documents of the manifest in the image directory:
+// the rollback directive, the revocation list, the snapshot and the timestamp.
+// They are published by the offline server as is, rollback.json and revoked.json are not used.
+const ManifestSidecarFile = "manifest.sig"
+
+// Verifier checks the signature of the message by the trusted key and returns its id, see the signature package.
+type Verifier interface {
+	Verify(alg, keyID, message, signature string) (string, error)
+}
+
+// Sidecar is the detached signature of the image: the signature of the image hash
+// for the old clients and the signed Release.
+type Sidecar struct {
+	FileSum string  `json:"file_sum"`
+	Sign    string  `json:"sign"`
+	KeyID   string  `json:"key_id,omitempty"`
+	Alg     string  `json:"alg,omitempty"`
+	Release *Signed `json:"release"`
+}
+
+// NewOffline returns the image repository without the private key. It publishes the images
+// which have the valid sidecar signatures and are pinned by the snapshot of ManifestSidecarFile,
+// the signatures are checked by v. The documents expire, so they are signed again offline
+// before it, see cmd/nametag-sign.
+func NewOffline(httpDir, dir string, v Verifier) *AllImages {
+	im := New(httpDir, dir, nil)
+	im.verifier = v
+	im.unsigned = map[string][2]time.Time{}
+
+	return im
+}
+
+// WriteSidecars writes the signatures of the images and the documents of the manifest
+// into the image directory, it's run offline after ScanImagesInDir.
+func (im *AllImages) WriteSidecars() error {
+	s := im.signer(RoleTargets)
+
+	im.mx.RLock()
+	defer im.mx.RUnlock()
+
+	for _, image := range im.Images {
+		sc := &Sidecar{FileSum: image.FileSum, Sign: image.Sign, KeyID: s.KeyID(), Alg: s.Alg(), Release: image.Release}
+		if err := writeJSON(path.Join(im.dir, image.Image+SidecarExt), sc); err != nil {
+			return err
+		}
+	}
+
+	m := &Manifest{Rollback: im.rollback, Revoked: im.revokedSigned, Snapshot: im.snapshotSigned, Timestamp: im.timestampSigned}
+	return writeJSON(path.Join(im.dir, ManifestSidecarFile), m)
+}
+
+// sidecarModTimes returns the modification times of the sidecar signature and metadata
+// of the image, the image is checked again if they are changed.
+func sidecarModTimes(fullName string) [2]time.Time {
+	out := [2]time.Time{{}, metadataModTime(fullName)}
+	if info, err := os.Stat(fullName + SidecarExt); err == nil {
+		out[0] = info.ModTime()
+	}
+
+	return out
+}
+
+// unsignedChanged reports whether the image without the valid sidecar may be valid now.
+func (im *AllImages) unsignedChanged(fileName string) bool {
+	im.mx.RLock()
+	defer im.mx.RUnlock()
+
+	modTimes, find := im.unsigned[fileName]
+	return !find || modTimes != sidecarModTimes(path.Join(im.dir, fileName))
+}
+
+// applySidecar checks the sidecar signature of the image with data and copies it to the image.
+func (im *AllImages) applySidecar(image *Image, data []byte, now time.Time) error {
+	fullName := path.Join(im.dir, image.Image)
+
+	b, err := os.ReadFile(fullName + SidecarExt)
+	if err != nil {
+		return errors.Wrap(err, "read sidecar")
+	}
+
+	sc := &Sidecar{}
+	if err := json.Unmarshal(b, sc); err != nil {
+		return errors.Wrapf(err, "sidecar %s", fullName+SidecarExt)
+	}
+	if sc.Release == nil {
+		return errors.Errorf("sidecar %s: no release", fullName+SidecarExt)
+	}
+
+	sum := sha256.Sum256(data)
+	if base64.URLEncoding.EncodeToString(sum[:]) != sc.FileSum {
+		return errors.Errorf("sidecar %s: the image doesn't match the hash", fullName+SidecarExt)
+	}
+
+	message := sc.FileSum
+	if signature.Normalize(sc.Alg) == signature.AlgMinisign {
+		message = base64.URLEncoding.EncodeToString(data)
+	}
+	if _, err := im.verifier.Verify(sc.Alg, sc.KeyID, message, sc.Sign); err != nil {
+		return errors.Wrapf(err, "sidecar %s", fullName+SidecarExt)
+	}
+
+	r := &Release{}
+	if err := im.openSigned(sc.Release, r); err != nil {
+		return errors.Wrapf(err, "sidecar %s", fullName+SidecarExt)
+	}
+	if err := r.Check(now, 0); err != nil {
+		return errors.Wrapf(err, "sidecar %s", fullName+SidecarExt)
+	}
+
+	// the signed fields are the ones which the server would sign
+	signed := *image
+	r.Apply(&signed)
+	if !signed.Version.Equal(image.Version) || signed.Channel != image.Channel || signed.Platform != image.Platform ||
+		signed.Uri != image.Uri || signed.Compression != image.Compression || signed.Size != image.Size ||
+		signed.Critical != image.Critical || r.FileSum != sc.FileSum {
+		return errors.Errorf("sidecar %s: the release doesn't match the image or its metadata", fullName+SidecarExt)
+	}
+
+	image.FileSum, image.Sign, image.Patches = sc.FileSum, sc.Sign, signed.Patches
+	image.Release, image.expiresAt = sc.Release, r.ExpiresAt
+	return nil
+}
+
+// openSigned checks the signature of the document by any trusted key and unmarshals it into v.
+func (im *AllImages) openSigned(s *Signed, v any) error {
+	b, err := base64.URLEncoding.DecodeString(s.Payload)
+	if err != nil {
+		return errors.Wrap(err, "payload DecodeString")
+	}
+
+	sum := sha256.Sum256(b)
+	if base64.URLEncoding.EncodeToString(sum[:]) != s.FileSum {
+		return errors.Errorf("payload doesn't match the signed hash")
+	}
+
+	err = errors.Errorf("no signature")
+	for _, sig := range s.AllSignatures() {
+		if _, err = im.verifier.Verify(sig.Alg, sig.KeyID, s.Message(sig.Alg), sig.Sign); err == nil {
+			return json.Unmarshal(b, v)
+		}
+	}
+
+	return err
+}
+
+// scanSigned loads the documents signed offline, the server signs nothing.
+func (im *AllImages) scanSigned() error {
+	if err := im.loadRotations(); err != nil {
+		log.Printf("Skipped key rotations: %s", err)
+	}
+
+	if err := im.loadRoots(); err != nil {
+		log.Printf("Skipped root documents: %s", err)
+	}
+
+	if err := im.loadCosignatures(); err != nil {
+		log.Printf("Skipped co-signatures: %s", err)
+	}
+	im.applyCosignatures()
+
+	if err := im.loadManifestSidecar(time.Now()); err != nil {
+		log.Printf("Skipped manifest sidecar: %s", err)
+	}
+
+	return nil
+}
+
+// loadManifestSidecar reads and checks the signed documents of the manifest if they were changed.
+// The bad sidecar is skipped until it's changed, the last good one is published.
+func (im *AllImages) loadManifestSidecar(now time.Time) (err error) {
+	im.mx.RLock()
+	lastModTime := im.manifestSidecarModTime
+	im.mx.RUnlock()
+
+	m := &Manifest{}
+	modTime, changed, err := readDocument(path.Join(im.dir, ManifestSidecarFile), lastModTime, m)
+	defer func() {
+		if err != nil {
+			im.skipDocument(&im.manifestSidecarModTime, modTime)
+		}
+	}()
+	if err != nil || !changed {
+		return err
+	}
+
+	rollback, revoked, snapshot, timestamp := &Rollback{}, &Revocations{}, Snapshot{}, Timestamp{}
+	if m.Rollback != nil {
+		if err := im.openSigned(m.Rollback, rollback); err != nil {
+			return errors.Wrap(err, "manifest sidecar rollback")
+		}
+		if err := rollback.Check(); err != nil {
+			return err
+		}
+	}
+	if m.Revoked != nil {
+		if err := im.openSigned(m.Revoked, revoked); err != nil {
+			return errors.Wrap(err, "manifest sidecar revocation list")
+		}
+		if err := revoked.Check(); err != nil {
+			return err
+		}
+	} else {
+		revoked = nil
+	}
+	if m.Snapshot != nil {
+		if err := im.openSigned(m.Snapshot, &snapshot); err != nil {
+			return errors.Wrap(err, "manifest sidecar snapshot")
+		}
+	}
+	if m.Timestamp != nil {
+		if err := im.openSigned(m.Timestamp, &timestamp); err != nil {
+			return errors.Wrap(err, "manifest sidecar timestamp")
+		}
+		if !timestamp.Matches(m) {
+			return errors.Errorf("manifest sidecar: timestamp %d doesn't match the documents", timestamp.Version)
+		}
+	}
+
+	im.mx.Lock()
+	im.rollback, im.revoked, im.revokedSigned = m.Rollback, revoked, m.Revoked
+	im.snapshot, im.snapshotSigned = snapshot, m.Snapshot
+	im.timestamp, im.timestampSigned = timestamp, m.Timestamp
+	im.manifestSidecarModTime = modTime
+	im.mx.Unlock()
+
+	if m.Timestamp == nil {
+		log.Printf("Manifest sidecar is removed, the manifest is not signed")
+		return nil
+	}
+
+	log.Printf("Loaded manifest sidecar: snapshot %d of %d releases, timestamp %d expires at %s",
+		snapshot.Version, len(snapshot.Releases), timestamp.Version, timestamp.ExpiresAt.Format(time.RFC3339))
+	if !now.Before(timestamp.ExpiresAt) {
+		log.Printf("Timestamp %d is expired, sign the manifest sidecar again", timestamp.Version)
+	}
+	return nil
+}
+
+// published returns the images which are published: all of them or, offline, the ones pinned by the snapshot,
+// the clients reject the manifest with the releases which aren't pinned or without the pinned ones.
+// It's called under the lock.
+func (im *AllImages) published() map[string]Image {
+	if im.verifier == nil {
+		return im.Images
+	}
+
+	out := make(map[string]Image, len(im.Images))
+	for name, image := range im.Images {
+		if im.snapshotSigned != nil && im.snapshot.Pins(image.Release) {
+			out[name] = image
+		}
+	}
+
+	return out
+}
+
+// writeJSON writes the indented json of v to the file through the temporary file.
+func writeJSON(fileName string, v any) error {
+	b, err := json.MarshalIndent(v, "", "  ")
+	if err != nil {
+		return err
+	}
+
+	if err := os.WriteFile(fileName+".tmp", append(b, '\n'), 0644); err != nil {
+		return errors.Wrapf(err, "write %s", fileName)
+	}
+
+	return errors.Wrapf(os.Rename(fileName+".tmp", fileName), "write %s", fileName)
+}
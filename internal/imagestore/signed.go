@@ -0,0 +1,148 @@
+package imagestore
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"os"
+	"time"
+
+	"github.com/pkg/errors"
+
+	"nametag/internal/signature"
+)
+
+// Signed is the signed json document in the manifest, e.g. the rollback directive.
+// Payload is the base64 json, FileSum is the hash of Payload and Sign is the signature of the hash,
+// the same as for the images, so the clients check it by the same Verifier.
+// KeyID is the id of the signing key and Alg is the signature algorithm,
+// they are empty in the documents of the old servers which are signed by RSA-PSS.
+// Signatures are the signatures of the other keys, the clients may require several of them.
+type Signed struct {
+	Payload string `json:"payload"`
+	FileSum string `json:"file_sum"`
+	Sign    string `json:"sign"`
+	KeyID   string `json:"key_id,omitempty"`
+	Alg     string `json:"alg,omitempty"`
+
+	Signatures []Signature `json:"signatures,omitempty"`
+}
+
+// Signature is one more signature of the signed document.
+type Signature struct {
+	KeyID string `json:"key_id"`
+	Alg   string `json:"alg,omitempty"`
+	Sign  string `json:"sign"`
+}
+
+// NewSigned signs the json of v.
+func NewSigned(s Signer, v any) (*Signed, error) {
+	b, err := json.Marshal(v)
+	if err != nil {
+		return nil, err
+	}
+
+	sum, sign, err := s.Sign(b)
+	if err != nil {
+		return nil, errors.Wrap(err, "sign document")
+	}
+
+	return &Signed{
+		Payload: base64.URLEncoding.EncodeToString(b),
+		FileSum: base64.URLEncoding.EncodeToString(sum),
+		Sign:    base64.URLEncoding.EncodeToString(sign),
+		KeyID:   s.KeyID(),
+		Alg:     s.Alg(),
+	}, nil
+}
+
+// Message returns the base64 of the message signed by the algorithm: the document itself for minisign,
+// the standard tool signs the files, and the hash of the document for the other algorithms.
+func (s *Signed) Message(alg string) string {
+	if alg == signature.AlgMinisign {
+		return s.Payload
+	}
+
+	return s.FileSum
+}
+
+// AllSignatures returns the signature of Sign and the additional ones.
+func (s *Signed) AllSignatures() []Signature {
+	out := make([]Signature, 0, len(s.Signatures)+1)
+	out = append(out, Signature{KeyID: s.KeyID, Alg: s.Alg, Sign: s.Sign})
+
+	return append(out, s.Signatures...)
+}
+
+// AddSignature signs the document by one more key, the previous signature of the key is replaced.
+func (s *Signed) AddSignature(signer Signer) error {
+	b, err := base64.URLEncoding.DecodeString(s.Payload)
+	if err != nil {
+		return errors.Wrap(err, "payload DecodeString")
+	}
+
+	sum, sign, err := signer.Sign(b)
+	if err != nil {
+		return errors.Wrap(err, "sign document")
+	}
+	if base64.URLEncoding.EncodeToString(sum) != s.FileSum {
+		return errors.Errorf("payload doesn't match the signed hash")
+	}
+
+	s.Merge(Signature{KeyID: signer.KeyID(), Alg: signer.Alg(), Sign: base64.URLEncoding.EncodeToString(sign)})
+	return nil
+}
+
+// Merge adds the signatures of the other keys, the signature of the same key is replaced.
+func (s *Signed) Merge(signatures ...Signature) {
+	for _, sig := range signatures {
+		if sig.KeyID == "" || sig.KeyID == s.KeyID {
+			continue
+		}
+
+		replaced := false
+		for i := range s.Signatures {
+			if s.Signatures[i].KeyID == sig.KeyID {
+				s.Signatures[i], replaced = sig, true
+			}
+		}
+		if !replaced {
+			s.Signatures = append(s.Signatures, sig)
+		}
+	}
+}
+
+// readDocument reads the json file from the image directory into v if it was changed after modTime.
+// It returns the modification time of the file, zero time if there is no file. The modification time
+// of the file which isn't valid json is returned with the error, so it's skipped until it's changed.
+func readDocument(fullName string, modTime time.Time, v any) (time.Time, bool, error) {
+	info, err := os.Stat(fullName)
+	if os.IsNotExist(err) {
+		return time.Time{}, !modTime.IsZero(), nil
+	}
+	if err != nil {
+		return modTime, false, errors.Wrapf(err, "read %s", fullName)
+	}
+
+	if info.ModTime().Equal(modTime) {
+		return modTime, false, nil
+	}
+
+	b, err := os.ReadFile(fullName)
+	if err != nil {
+		return modTime, false, errors.Wrapf(err, "read %s", fullName)
+	}
+
+	if err := json.Unmarshal(b, v); err != nil {
+		return info.ModTime(), true, errors.Wrapf(err, "read %s", fullName)
+	}
+
+	return info.ModTime(), true, nil
+}
+
+// skipDocument remembers the modification time of the bad document, so it isn't read
+// and reported again until its file is changed. The last good document is still published.
+func (im *AllImages) skipDocument(lastModTime *time.Time, modTime time.Time) {
+	im.mx.Lock()
+	*lastModTime = modTime
+	im.mx.Unlock()
+}
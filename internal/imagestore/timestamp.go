@@ -0,0 +1,95 @@
+package imagestore
+
+import (
+	"log"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// DefaultTimestampTTL is the lifetime of the manifest timestamp.
+// The server re-signs the timestamp when half of it is left, so the clients
+// find out that they get a stale manifest (a freeze attack) within a day.
+const DefaultTimestampTTL = 24 * time.Hour
+
+// Timestamp is the signed freshness of the manifest.
+// It pins the current snapshot, rollback directive and revocation list, so they can't be
+// removed from the manifest or replaced with the old ones.
+type Timestamp struct {
+	// Version grows with each signing, the clients reject the manifests
+	// with the lower version than the one they have seen.
+	Version   int64     `json:"version"`
+	IssuedAt  time.Time `json:"issued_at"`
+	ExpiresAt time.Time `json:"expires_at"`
+
+	// Rollback, Revoked and Snapshot are the FileSum of the signed documents, empty if there are none.
+	Rollback string `json:"rollback,omitempty"`
+	Revoked  string `json:"revoked,omitempty"`
+	Snapshot string `json:"snapshot,omitempty"`
+}
+
+// Check checks the timestamp at now, skew is the tolerated difference of the clocks.
+func (t *Timestamp) Check(now time.Time, skew time.Duration) error {
+	if t.IssuedAt.After(now.Add(skew)) {
+		return errors.Errorf("timestamp %d is issued in the future at %s", t.Version, t.IssuedAt.Format(time.RFC3339))
+	}
+	if !now.Add(-skew).Before(t.ExpiresAt) {
+		return errors.Errorf("timestamp %d is expired at %s", t.Version, t.ExpiresAt.Format(time.RFC3339))
+	}
+
+	return nil
+}
+
+// Matches reports whether the timestamp pins the documents of the manifest.
+func (t *Timestamp) Matches(m *Manifest) bool {
+	return t.Rollback == signedSum(m.Rollback) && t.Revoked == signedSum(m.Revoked) && t.Snapshot == signedSum(m.Snapshot)
+}
+
+func signedSum(s *Signed) string {
+	if s == nil {
+		return ""
+	}
+
+	return s.FileSum
+}
+
+// SetTimestampTTL sets the lifetime of the manifest timestamp.
+func (im *AllImages) SetTimestampTTL(ttl time.Duration) {
+	im.timestampTTL = ttl
+}
+
+// signTimestamp signs the new timestamp if half of its lifetime is passed
+// or the signed documents are changed.
+func (im *AllImages) signTimestamp(now time.Time) error {
+	im.mx.RLock()
+	t := Timestamp{
+		Version:  im.timestamp.Version,
+		Rollback: signedSum(im.rollback),
+		Revoked:  signedSum(im.revokedSigned),
+		Snapshot: signedSum(im.snapshotSigned),
+	}
+	fresh := im.timestampSigned != nil && im.timestamp.ExpiresAt.Sub(now) >= im.timestampTTL/2 &&
+		im.timestamp.Rollback == t.Rollback && im.timestamp.Revoked == t.Revoked && im.timestamp.Snapshot == t.Snapshot
+	im.mx.RUnlock()
+
+	if fresh {
+		return nil
+	}
+
+	// the version is the time of the signing, so it keeps growing after the restart of the server
+	t.IssuedAt = now.UTC().Truncate(time.Second)
+	t.ExpiresAt = t.IssuedAt.Add(im.timestampTTL)
+	t.Version = max(t.Version+1, t.IssuedAt.Unix())
+
+	signed, err := NewSigned(im.signer(RoleTimestamp), t)
+	if err != nil {
+		return errors.Wrap(err, "sign timestamp")
+	}
+
+	im.mx.Lock()
+	im.timestamp, im.timestampSigned = t, signed
+	im.mx.Unlock()
+
+	log.Printf("Signed timestamp %d, expires at %s", t.Version, t.ExpiresAt.Format(time.RFC3339))
+	return nil
+}
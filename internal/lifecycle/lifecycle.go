@@ -0,0 +1,89 @@
+package lifecycle
+
+/*
+	lifecycle stops the http server of the old version gracefully:
+	it stops accepting new connections, closes the keep-alive connections
+	and waits for the in-flight requests for the drain timeout.
+*/
+
+import (
+	"context"
+	"net/http"
+	"sync/atomic"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// DefaultDrainTimeout is the time for the in-flight requests to finish.
+const DefaultDrainTimeout = 30 * time.Second
+
+type Server struct {
+	srv          *http.Server
+	drainTimeout time.Duration
+
+	inFlight atomic.Int64
+	draining atomic.Bool
+}
+
+// New wraps the handler of srv to count the in-flight requests,
+// so it must be called before srv.Serve.
+func New(srv *http.Server, drainTimeout time.Duration) *Server {
+	s := &Server{
+		srv:          srv,
+		drainTimeout: drainTimeout,
+	}
+
+	next := srv.Handler
+	if next == nil {
+		next = http.DefaultServeMux
+	}
+
+	// the response writer isn't wrapped, so the handlers keep http.Flusher and http.Hijacker.
+	// The server with the disabled keep-alives answers with "Connection: close" itself.
+	srv.Handler = http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		s.inFlight.Add(1)
+		defer s.inFlight.Add(-1)
+
+		next.ServeHTTP(w, r)
+	})
+
+	return s
+}
+
+// InFlight returns the number of the requests which are being handled.
+func (s *Server) InFlight() int64 {
+	return s.inFlight.Load()
+}
+
+// Draining reports whether Drain is called.
+func (s *Server) Draining() bool {
+	return s.draining.Load()
+}
+
+// Drain stops the server gracefully by http.Server.Shutdown.
+// If the requests don't finish in the drain timeout, the server is closed forcibly
+// and Drain returns the number of the requests which were still in flight.
+func (s *Server) Drain(ctx context.Context) (int64, error) {
+	s.draining.Store(true)
+	s.srv.SetKeepAlivesEnabled(false)
+
+	ctx, cancel := context.WithTimeout(ctx, s.drainTimeout)
+	defer cancel()
+
+	err := s.srv.Shutdown(ctx)
+	if err == nil {
+		return 0, nil
+	}
+
+	if !errors.Is(err, context.DeadlineExceeded) && !errors.Is(err, context.Canceled) {
+		return 0, err
+	}
+
+	inFlight := s.inFlight.Load()
+	if err := s.srv.Close(); err != nil {
+		return inFlight, errors.Wrap(err, "drain close")
+	}
+
+	return inFlight, errors.Wrapf(err, "drain forced with %d requests in flight", inFlight)
+}
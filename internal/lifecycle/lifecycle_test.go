@@ -0,0 +1,100 @@
+package lifecycle_test
+
+import (
+	"context"
+	"net"
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+
+	"nametag/internal/lifecycle"
+)
+
+func serve(t *testing.T, handler http.HandlerFunc, drainTimeout time.Duration) (*lifecycle.Server, string) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	assert.Nil(t, err, "Listen")
+
+	srv := &http.Server{Handler: handler}
+	ls := lifecycle.New(srv, drainTimeout)
+	go func() {
+		_ = srv.Serve(l)
+	}()
+
+	return ls, "http://" + l.Addr().String()
+}
+
+func Test_Drain(t *testing.T) {
+	release := make(chan struct{})
+	started := make(chan struct{})
+	ls, url := serve(t, func(w http.ResponseWriter, r *http.Request) {
+		close(started)
+		<-release
+	}, time.Second)
+
+	done := make(chan *http.Response, 1)
+	go func() {
+		resp, err := http.Get(url)
+		assert.Nil(t, err, "Get")
+		done <- resp
+	}()
+	<-started
+
+	assert.Equal(t, int64(1), ls.InFlight())
+	go func() {
+		time.Sleep(100 * time.Millisecond)
+		close(release)
+	}()
+
+	inFlight, err := ls.Drain(context.Background())
+	assert.Nil(t, err, "Drain")
+	assert.Equal(t, int64(0), inFlight)
+	assert.True(t, ls.Draining())
+
+	resp := <-done
+	if resp != nil {
+		assert.True(t, resp.Close, "Connection: close")
+		_ = resp.Body.Close()
+	}
+}
+
+func Test_DrainForced(t *testing.T) {
+	started := make(chan struct{})
+	ls, url := serve(t, func(w http.ResponseWriter, r *http.Request) {
+		close(started)
+		<-r.Context().Done()
+	}, 100*time.Millisecond)
+
+	go func() {
+		resp, err := http.Get(url)
+		if err == nil {
+			_ = resp.Body.Close()
+		}
+	}()
+	<-started
+
+	inFlight, err := ls.Drain(context.Background())
+	assert.NotNil(t, err, "Drain")
+	assert.Equal(t, int64(1), inFlight)
+}
+
+func Test_ResponseWriter(t *testing.T) {
+	_, url := serve(t, func(w http.ResponseWriter, r *http.Request) {
+		_, flusher := w.(http.Flusher)
+		assert.True(t, flusher, "http.Flusher")
+
+		conn, _, err := http.NewResponseController(w).Hijack()
+		if !assert.Nil(t, err, "Hijack") {
+			return
+		}
+		_, _ = conn.Write([]byte("HTTP/1.1 204 No Content\r\nConnection: close\r\n\r\n"))
+		_ = conn.Close()
+	}, time.Second)
+
+	resp, err := http.Get(url)
+	if assert.Nil(t, err, "Get") {
+		assert.Equal(t, http.StatusNoContent, resp.StatusCode, "hijacked")
+		_ = resp.Body.Close()
+	}
+}
@@ -0,0 +1,164 @@
+package listener
+
+/*
+	listener passes the open listeners to the new process,
+	so the new process doesn't need to bind the same address (SO_REUSEPORT).
+	It works for unix sockets too.
+
+	Protocol: the parent appends the listener files to exec.Cmd.ExtraFiles
+	and sets NAMETAG_LISTENERS="name1=fd1,name2=fd2". The child picks them up by name,
+	on a fresh start the listeners are created.
+*/
+
+import (
+	"fmt"
+	"net"
+	"os"
+	"os/exec"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/pkg/errors"
+)
+
+// EnvListeners is the list of the inherited listeners: "name1=fd1,name2=fd2"
+const EnvListeners = "NAMETAG_LISTENERS"
+
+// ListenFunc creates a new listener on a fresh start.
+type ListenFunc func(network, address string) (net.Listener, error)
+
+// filer is implemented by *net.TCPListener and *net.UnixListener
+type filer interface {
+	File() (*os.File, error)
+}
+
+type Registry struct {
+	mx sync.Mutex
+
+	// ListenFunc is used if there is no inherited listener, net.Listen by default.
+	ListenFunc ListenFunc
+
+	inherited map[string]*os.File
+	listeners map[string]net.Listener
+	names     []string // in order of creation
+}
+
+// New reads the inherited listeners from the environment.
+func New() (*Registry, error) {
+	r := &Registry{
+		ListenFunc: net.Listen,
+		inherited:  map[string]*os.File{},
+		listeners:  map[string]net.Listener{},
+	}
+
+	s, ok := os.LookupEnv(EnvListeners)
+	if !ok || s == "" {
+		return r, nil
+	}
+	// the next version gets its own list
+	_ = os.Unsetenv(EnvListeners)
+
+	for _, pair := range strings.Split(s, ",") {
+		name, fdStr, find := strings.Cut(pair, "=")
+		if !find || name == "" {
+			return nil, errors.Errorf("%s: bad item %q", EnvListeners, pair)
+		}
+
+		fd, err := strconv.Atoi(fdStr)
+		if err != nil {
+			return nil, errors.Wrapf(err, "%s: bad item %q", EnvListeners, pair)
+		}
+
+		r.inherited[name] = os.NewFile(uintptr(fd), name)
+	}
+
+	return r, nil
+}
+
+// Inherited reports whether the listener with the name is got from the parent process.
+func (r *Registry) Inherited(name string) bool {
+	r.mx.Lock()
+	defer r.mx.Unlock()
+
+	_, find := r.inherited[name]
+	return find
+}
+
+// Listen returns the inherited listener with the name
+// or creates a new one by ListenFunc on a fresh start.
+func (r *Registry) Listen(name, network, address string) (net.Listener, error) {
+	r.mx.Lock()
+	defer r.mx.Unlock()
+
+	if _, find := r.listeners[name]; find {
+		return nil, errors.Errorf("listener %s is already created", name)
+	}
+
+	var l net.Listener
+	var err error
+	if f, find := r.inherited[name]; find {
+		l, err = net.FileListener(f)
+		// FileListener dups the descriptor
+		_ = f.Close()
+		delete(r.inherited, name)
+		if err != nil {
+			return nil, errors.Wrapf(err, "inherited listener %s", name)
+		}
+	} else {
+		l, err = r.ListenFunc(network, address)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	// the socket file must stay for the new process when the old one closes the listener
+	if ul, ok := l.(*net.UnixListener); ok {
+		ul.SetUnlinkOnClose(false)
+	}
+
+	r.listeners[name] = l
+	r.names = append(r.names, name)
+	return l, nil
+}
+
+// PrepareCommand passes the listeners to the new process.
+// It implements updater.CommandPreparer.
+func (r *Registry) PrepareCommand(c *exec.Cmd) (func(), error) {
+	r.mx.Lock()
+	defer r.mx.Unlock()
+
+	files := make([]*os.File, 0, len(r.names))
+	cleanup := func() {
+		for _, f := range files {
+			_ = f.Close()
+		}
+	}
+
+	items := make([]string, 0, len(r.names))
+	for _, name := range r.names {
+		fl, ok := r.listeners[name].(filer)
+		if !ok {
+			cleanup()
+			return nil, errors.Errorf("listener %s can't be passed to the new process", name)
+		}
+
+		f, err := fl.File()
+		if err != nil {
+			cleanup()
+			return nil, errors.Wrapf(err, "listener %s", name)
+		}
+		files = append(files, f)
+
+		// the extra files start from fd 3 after stdin, stdout and stderr
+		items = append(items, fmt.Sprintf("%s=%d", name, 3+len(c.ExtraFiles)))
+		c.ExtraFiles = append(c.ExtraFiles, f)
+	}
+
+	if c.Env == nil {
+		c.Env = os.Environ()
+	}
+	c.Env = append(c.Env, EnvListeners+"="+strings.Join(items, ","))
+
+	return cleanup, nil
+}
@@ -0,0 +1,71 @@
+package listener_test
+
+import (
+	"fmt"
+	"net"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+
+	"nametag/internal/listener"
+)
+
+func Test_Inherit(t *testing.T) {
+	for _, network := range []string{"tcp", "unix"} {
+		network := network
+		address := "127.0.0.1:0"
+		if network == "unix" {
+			address = filepath.Join(t.TempDir(), "app.sock")
+		}
+
+		parent, err := listener.New()
+		assert.Nil(t, err, "New")
+
+		l, err := parent.Listen("http", network, address)
+		assert.Nil(t, err, "Listen")
+		assert.False(t, parent.Inherited("http"))
+
+		c := exec.Command("true")
+		c.ExtraFiles = append(c.ExtraFiles, nil) // e.g. the handshake pipe
+		cleanup, err := parent.PrepareCommand(c)
+		assert.Nil(t, err, "PrepareCommand")
+		assert.Contains(t, c.Env, listener.EnvListeners+"=http=4")
+
+		// the child gets the same file by the descriptor number
+		t.Setenv(listener.EnvListeners, fmt.Sprintf("http=%d", c.ExtraFiles[1].Fd()))
+		child, err := listener.New()
+		assert.Nil(t, err, "New")
+		assert.True(t, child.Inherited("http"))
+
+		l2, err := child.Listen("http", network, "ignored")
+		assert.Nil(t, err, "Listen inherited")
+		assert.Equal(t, l.Addr().String(), l2.Addr().String())
+
+		// the old process stops, the new one keeps accepting
+		assert.Nil(t, l.Close())
+		cleanup()
+
+		dialed := make(chan struct{})
+		go func() {
+			defer close(dialed)
+			conn, err := net.Dial(network, l2.Addr().String())
+			if err == nil {
+				_ = conn.Close()
+			}
+		}()
+		conn, err := l2.Accept()
+		assert.Nil(t, err, "Accept")
+		if conn != nil {
+			_ = conn.Close()
+		}
+		<-dialed
+		assert.Nil(t, l2.Close())
+	}
+
+	t.Setenv(listener.EnvListeners, "http")
+	_, err := listener.New()
+	assert.True(t, err != nil && strings.Contains(err.Error(), listener.EnvListeners))
+}
@@ -0,0 +1,38 @@
+// Package signature names the signature algorithms of the signed documents.
+// The signers are in the sign package, the keyring of the clients is in the verify package.
+package signature
+
+import (
+	"github.com/pkg/errors"
+)
+
+const (
+	// AlgRSAPSS is RSA-PSS of sha256 of the document hash, the documents without the algorithm use it.
+	AlgRSAPSS = "rsa-pss-sha256"
+
+	// AlgEd25519 is Ed25519 of the document hash.
+	AlgEd25519 = "ed25519"
+
+	// AlgMinisign is the minisign detached signature of the document itself,
+	// so it's made by the standard tool: minisign -Sm release.json
+	AlgMinisign = "minisign"
+)
+
+// Normalize returns the algorithm, the empty one is AlgRSAPSS.
+func Normalize(alg string) string {
+	if alg == "" {
+		return AlgRSAPSS
+	}
+
+	return alg
+}
+
+// Check checks that the algorithm is supported.
+func Check(alg string) error {
+	switch Normalize(alg) {
+	case AlgRSAPSS, AlgEd25519, AlgMinisign:
+		return nil
+	}
+
+	return errors.Errorf("unknown signature algorithm %q", alg)
+}
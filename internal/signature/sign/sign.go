@@ -1,45 +1,120 @@
 package sign
 
 import (
+	"bytes"
 	"crypto"
+	"crypto/ed25519"
 	"crypto/rand"
 	"crypto/rsa"
 	"crypto/sha256"
 	"crypto/x509"
 	"embed"
+	"encoding/base64"
+	"encoding/pem"
 	"os"
 
+	"aead.dev/minisign"
 	"github.com/pkg/errors"
+
+	"nametag/internal/signature"
+	"nametag/internal/signature/verify"
 )
 
 //go:embed key/*
 var keyFile embed.FS
 
+// Signer signs the documents by one of the signature algorithms.
+type Signer interface {
+	// Sign returns the sha256 of binaryData and the signature.
+	Sign(binaryData []byte) (fileHash, sign []byte, err error)
+
+	// KeyID is the id of the public key, the clients find the key to check the signatures by it.
+	KeyID() string
+
+	// Alg is the signature algorithm, see the signature package.
+	Alg() string
+
+	// PublicKey returns the public key in the form of verify.Verifier.AddKey.
+	PublicKey() string
+}
+
+// Signature is the RSA-PSS signer.
 type Signature struct {
-	key *rsa.PrivateKey
+	key   *rsa.PrivateKey
+	keyID string
 }
 
+// New returns the signer of the embedded private key.
 func New() (*Signature, error) {
-	key, err := loadPrivateKey()
+	b, err := keyFile.ReadFile("key/id_nametag_key")
 	if err != nil {
-		return nil, err
+		return nil, errors.Wrap(err, "signature ReadFile")
 	}
 
-	out := &Signature{
-		key: key,
+	key, err := x509.ParsePKCS1PrivateKey(b)
+	if err != nil {
+		return nil, errors.Wrap(err, "signature ParsePKCS1PrivateKey")
 	}
 
-	return out, nil
+	return newSignature(key), nil
 }
 
-func loadPrivateKey() (*rsa.PrivateKey, error) {
-	b, err := keyFile.ReadFile("key/id_nametag_key")
+func newSignature(key *rsa.PrivateKey) *Signature {
+	return &Signature{
+		key:   key,
+		keyID: verify.KeyID(&key.PublicKey),
+	}
+}
+
+// Load returns the signer of the private key file, e.g. the new key after the rotation.
+// The RSA key is in PKCS1 or PKCS8 form, the Ed25519 key is in PKCS8 form, both may be PEM encoded.
+// The minisign key file is decrypted by the password.
+func Load(fileName, password string) (Signer, error) {
+	b, err := os.ReadFile(fileName)
 	if err != nil {
 		return nil, errors.Wrap(err, "signature ReadFile")
 	}
 
-	key, err := x509.ParsePKCS1PrivateKey(b)
-	return key, errors.Wrap(err, "signature ParsePKCS1PrivateKey")
+	if bytes.HasPrefix(b, []byte("untrusted comment:")) {
+		return LoadMinisign(fileName, password)
+	}
+
+	if block, _ := pem.Decode(b); block != nil {
+		b = block.Bytes
+	}
+
+	if key, err := x509.ParsePKCS1PrivateKey(b); err == nil {
+		return newSignature(key), nil
+	}
+
+	key, err := x509.ParsePKCS8PrivateKey(b)
+	if err != nil {
+		return nil, errors.Wrap(err, "signature ParsePKCS8PrivateKey")
+	}
+
+	switch key := key.(type) {
+	case *rsa.PrivateKey:
+		return newSignature(key), nil
+	case ed25519.PrivateKey:
+		return &Ed25519Signature{key: key, keyID: verify.Ed25519KeyID(key.Public().(ed25519.PublicKey))}, nil
+	}
+
+	return nil, errors.Errorf("signature: unsupported private key %T", key)
+}
+
+// KeyID is the id of the public key, the clients find the key to check the signatures by it.
+func (s *Signature) KeyID() string {
+	return s.keyID
+}
+
+// Alg is RSA-PSS.
+func (s *Signature) Alg() string {
+	return signature.AlgRSAPSS
+}
+
+// PublicKey returns the base64 of the public key in PKCS1 form.
+func (s *Signature) PublicKey() string {
+	return base64.URLEncoding.EncodeToString(x509.MarshalPKCS1PublicKey(&s.key.PublicKey))
 }
 
 // Sign creates a signature for binaryData using the provided RSA private key.
@@ -78,3 +153,68 @@ func (s *Signature) SignFile(fineName string) (fileHash, signatureOfHash []byte,
 
 	return s.Sign(b)
 }
+
+// Ed25519Signature signs the sha256 of the data by Ed25519.
+type Ed25519Signature struct {
+	key   ed25519.PrivateKey
+	keyID string
+}
+
+// KeyID is the id of the public key.
+func (s *Ed25519Signature) KeyID() string {
+	return s.keyID
+}
+
+// Alg is Ed25519.
+func (s *Ed25519Signature) Alg() string {
+	return signature.AlgEd25519
+}
+
+// PublicKey returns the base64 of the public key.
+func (s *Ed25519Signature) PublicKey() string {
+	return base64.URLEncoding.EncodeToString(s.key.Public().(ed25519.PublicKey))
+}
+
+// Sign returns the sha256 of binaryData and its Ed25519 signature.
+func (s *Ed25519Signature) Sign(binaryData []byte) (fileHash, sign []byte, err error) {
+	sum := sha256.Sum256(binaryData)
+	return sum[:], ed25519.Sign(s.key, sum[:]), nil
+}
+
+// MinisignSignature makes the minisign detached signatures of the data,
+// the same as the minisign tool makes for the file.
+type MinisignSignature struct {
+	key minisign.PrivateKey
+}
+
+// LoadMinisign returns the signer of the minisign private key file encrypted by the password.
+func LoadMinisign(fileName, password string) (*MinisignSignature, error) {
+	key, err := minisign.PrivateKeyFromFile(password, fileName)
+	if err != nil {
+		return nil, errors.Wrap(err, "signature minisign key")
+	}
+
+	return &MinisignSignature{key: key}, nil
+}
+
+// KeyID is the id of the key as the minisign tool prints it.
+func (s *MinisignSignature) KeyID() string {
+	return verify.MinisignKeyID(s.key.ID())
+}
+
+// Alg is minisign.
+func (s *MinisignSignature) Alg() string {
+	return signature.AlgMinisign
+}
+
+// PublicKey returns the text of the minisign public key file.
+func (s *MinisignSignature) PublicKey() string {
+	b, _ := s.key.Public().(minisign.PublicKey).MarshalText()
+	return string(b)
+}
+
+// Sign returns the sha256 of binaryData and the text of the minisign signature of binaryData.
+func (s *MinisignSignature) Sign(binaryData []byte) (fileHash, sign []byte, err error) {
+	sum := sha256.Sum256(binaryData)
+	return sum[:], minisign.Sign(s.key, binaryData), nil
+}
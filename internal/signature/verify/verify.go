@@ -2,65 +2,292 @@ package verify
 
 import (
 	"crypto"
+	"crypto/ed25519"
 	"crypto/rsa"
 	"crypto/sha256"
 	"crypto/x509"
 	"embed"
 	"encoding/base64"
+	"encoding/hex"
+	"io/fs"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
 
+	"aead.dev/minisign"
 	"github.com/pkg/errors"
+
+	"nametag/internal/signature"
 )
 
 //go:embed key/*
 var keyFile embed.FS
 
+// UnknownKeyError is returned for the signature of the key which isn't in the keyring.
+var UnknownKeyError = errors.Errorf("unknown key")
+
+// Verifier is the keyring of the trusted public keys.
+// The embedded keys are trusted from the start, the new keys are added
+// by the key rotation documents signed by the trusted keys.
 type Verifier struct {
-	key *rsa.PublicKey
+	mx      sync.RWMutex
+	keys    map[string]trustedKey
+	retired map[string]struct{}
+}
+
+// trustedKey checks the signatures of the key by its algorithm.
+type trustedKey struct {
+	alg    string
+	verify func(message, signature []byte) error
 }
 
+// New loads all embedded public keys: the RSA keys "key/*_pub" in PKCS1 form
+// and the minisign keys "key/*.pub".
 func New() (*Verifier, error) {
-	key, err := loadPublicKey()
-	if err != nil {
-		return nil, err
+	out := &Verifier{
+		keys:    map[string]trustedKey{},
+		retired: map[string]struct{}{},
 	}
 
-	out := &Verifier{
-		key: key,
+	for pattern, alg := range map[string]string{"key/*_pub": signature.AlgRSAPSS, "key/*.pub": signature.AlgMinisign} {
+		names, err := fs.Glob(keyFile, pattern)
+		if err != nil {
+			return nil, errors.Wrap(err, "signature Glob")
+		}
+
+		for _, name := range names {
+			b, err := keyFile.ReadFile(name)
+			if err != nil {
+				return nil, errors.Wrap(err, "signature ReadFile")
+			}
+
+			// the minisign keys are in the text form already
+			if alg == signature.AlgRSAPSS {
+				b = []byte(base64.URLEncoding.EncodeToString(b))
+			}
+
+			id, key, err := parseKey(alg, string(b))
+			if err != nil {
+				return nil, errors.Wrap(err, name)
+			}
+			out.keys[id] = key
+		}
+	}
+
+	if len(out.keys) == 0 {
+		return nil, errors.Errorf("no public keys")
 	}
 
 	return out, nil
 }
 
-func loadPublicKey() (*rsa.PublicKey, error) {
-	publicBytes, err := keyFile.ReadFile("key/id_nametag_key_pub")
+// KeyID is the short id of the RSA public key: the hex of the first 8 bytes of sha256 of its PKCS1 form.
+func KeyID(key *rsa.PublicKey) string {
+	sum := sha256.Sum256(x509.MarshalPKCS1PublicKey(key))
+	return hex.EncodeToString(sum[:8])
+}
+
+// Ed25519KeyID is the short id of the Ed25519 public key: the hex of the first 8 bytes of its sha256.
+func Ed25519KeyID(key ed25519.PublicKey) string {
+	sum := sha256.Sum256(key)
+	return hex.EncodeToString(sum[:8])
+}
+
+// MinisignKeyID is the id of the minisign key as the minisign tool prints it.
+func MinisignKeyID(id uint64) string {
+	return strings.ToUpper(strconv.FormatUint(id, 16))
+}
+
+// parseKey parses the public key of the algorithm:
+// the base64 of PKCS1 form for RSA, the base64 of 32 bytes for Ed25519
+// and the text of the .pub file for minisign. It returns the id of the key.
+func parseKey(alg, publicKey string) (string, trustedKey, error) {
+	switch signature.Normalize(alg) {
+	case signature.AlgRSAPSS:
+		b, err := base64.URLEncoding.DecodeString(publicKey)
+		if err != nil {
+			return "", trustedKey{}, errors.Wrap(err, "public key DecodeString")
+		}
+
+		key, err := x509.ParsePKCS1PublicKey(b)
+		if err != nil {
+			return "", trustedKey{}, errors.Wrap(err, "signature ParsePublicKey")
+		}
+
+		return KeyID(key), trustedKey{alg: signature.AlgRSAPSS, verify: func(message, sign []byte) error {
+			hash := sha256.Sum256(message)
+			return rsa.VerifyPSS(key, crypto.SHA256, hash[:], sign, nil)
+		}}, nil
+
+	case signature.AlgEd25519:
+		b, err := base64.URLEncoding.DecodeString(publicKey)
+		if err != nil {
+			return "", trustedKey{}, errors.Wrap(err, "public key DecodeString")
+		}
+		if len(b) != ed25519.PublicKeySize {
+			return "", trustedKey{}, errors.Errorf("ed25519 public key has %d bytes", len(b))
+		}
+
+		key := ed25519.PublicKey(b)
+		return Ed25519KeyID(key), trustedKey{alg: signature.AlgEd25519, verify: func(message, sign []byte) error {
+			if !ed25519.Verify(key, message, sign) {
+				return errors.Errorf("ed25519: verification error")
+			}
+			return nil
+		}}, nil
+
+	case signature.AlgMinisign:
+		key := minisign.PublicKey{}
+		if err := key.UnmarshalText([]byte(strings.TrimSpace(publicKey))); err != nil {
+			return "", trustedKey{}, err
+		}
+
+		return MinisignKeyID(key.ID()), trustedKey{alg: signature.AlgMinisign, verify: func(message, sign []byte) error {
+			if !minisign.Verify(key, message, sign) {
+				return errors.Errorf("minisign: verification error")
+			}
+			return nil
+		}}, nil
+	}
+
+	return "", trustedKey{}, signature.Check(alg)
+}
+
+// KeyIDs returns the ids of the trusted keys.
+func (v *Verifier) KeyIDs() []string {
+	v.mx.RLock()
+	defer v.mx.RUnlock()
+
+	out := make([]string, 0, len(v.keys))
+	for id := range v.keys {
+		out = append(out, id)
+	}
+	sort.Strings(out)
+
+	return out
+}
+
+// AddKey trusts the public key of the algorithm, see parseKey for its form.
+// The keyID must be its id, the retired keys are never trusted again.
+func (v *Verifier) AddKey(alg, keyID, publicKey string) error {
+	id, key, err := parseKey(alg, publicKey)
 	if err != nil {
-		return nil, errors.Wrap(err, "signature ReadFile")
+		return err
+	}
+
+	if id != keyID {
+		return errors.Errorf("key id %s doesn't match the key %s", keyID, id)
+	}
+
+	v.mx.Lock()
+	defer v.mx.Unlock()
+
+	if _, ok := v.retired[keyID]; ok {
+		return errors.Errorf("key %s is retired", keyID)
 	}
+	v.keys[keyID] = key
 
-	key, err := x509.ParsePKCS1PublicKey(publicBytes)
-	return key, errors.Wrap(err, "signature ParsePublicKey")
+	return nil
 }
 
-// Verify checks the signature of binaryData against a signature.
-func (v *Verifier) Verify(binaryData, signature string) error {
-	if v.key == nil {
-		return errors.Errorf("public key is empty. need to call v.loadPublicKey()")
+// RetireKey stops trusting the key. The last trusted key can't be retired.
+func (v *Verifier) RetireKey(keyID string) error {
+	v.mx.Lock()
+	defer v.mx.Unlock()
+
+	if _, ok := v.keys[keyID]; ok && len(v.keys) == 1 {
+		return errors.Errorf("key %s is the last trusted key", keyID)
 	}
 
-	binaryDataB, err := base64.URLEncoding.DecodeString(binaryData)
+	delete(v.keys, keyID)
+	v.retired[keyID] = struct{}{}
+
+	return nil
+}
+
+// VerifyKey checks the signature of the message by the public key which isn't trusted yet,
+// e.g. the key of the new root document before the document is accepted. The retired keys are rejected.
+func (v *Verifier) VerifyKey(alg, keyID, publicKey, message, sign string) error {
+	id, key, err := parseKey(alg, publicKey)
 	if err != nil {
-		return errors.Wrap(err, "binaryData DecodeString")
+		return err
+	}
+
+	if id != keyID {
+		return errors.Errorf("key id %s doesn't match the key %s", keyID, id)
 	}
 
-	signatureB, err := base64.URLEncoding.DecodeString(signature)
+	v.mx.RLock()
+	_, retired := v.retired[keyID]
+	v.mx.RUnlock()
+	if retired {
+		return errors.Errorf("key %s is retired", keyID)
+	}
+
+	messageB, err := base64.URLEncoding.DecodeString(message)
+	if err != nil {
+		return errors.Wrap(err, "message DecodeString")
+	}
+
+	signB, err := base64.URLEncoding.DecodeString(sign)
 	if err != nil {
 		return errors.Wrap(err, "signature DecodeString")
 	}
 
-	msgHash := sha256.New()
-	if _, err := msgHash.Write(binaryDataB); err != nil {
-		return errors.Wrap(err, "msgHash.Write")
+	return key.verify(messageB, signB)
+}
+
+// Verify checks the signature of the message by the key with keyID and the algorithm,
+// the message is the document hash for RSA-PSS and Ed25519 and the document itself for minisign.
+// The documents of the old servers have no key id and algorithm, they are checked by any trusted RSA key.
+// It returns the id of the key which verified the signature, so the signatures are counted by the keys.
+func (v *Verifier) Verify(alg, keyID, message, sign string) (string, error) {
+	alg = signature.Normalize(alg)
+	if err := signature.Check(alg); err != nil {
+		return "", err
+	}
+
+	messageB, err := base64.URLEncoding.DecodeString(message)
+	if err != nil {
+		return "", errors.Wrap(err, "message DecodeString")
+	}
+
+	signB, err := base64.URLEncoding.DecodeString(sign)
+	if err != nil {
+		return "", errors.Wrap(err, "signature DecodeString")
+	}
+
+	v.mx.RLock()
+	defer v.mx.RUnlock()
+
+	if keyID != "" {
+		key, ok := v.keys[keyID]
+		if !ok {
+			return "", errors.Wrap(UnknownKeyError, keyID)
+		}
+		if key.alg != alg {
+			return "", errors.Errorf("key %s is %s, not %s", keyID, key.alg, alg)
+		}
+		if err := key.verify(messageB, signB); err != nil {
+			return "", err
+		}
+		return keyID, nil
+	}
+
+	errs := make([]string, 0, len(v.keys))
+	for id, key := range v.keys {
+		if key.alg != alg {
+			continue
+		}
+
+		err := key.verify(messageB, signB)
+		if err == nil {
+			return id, nil
+		}
+		errs = append(errs, id+": "+err.Error())
 	}
+	sort.Strings(errs)
 
-	return rsa.VerifyPSS(v.key, crypto.SHA256, msgHash.Sum(nil), signatureB, nil)
+	return "", errors.Errorf("no trusted %s key matches the signature: %s", alg, strings.Join(errs, "; "))
 }
@@ -1,10 +1,21 @@
 package verify_test
 
 import (
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/pem"
+	"os"
+	"path/filepath"
+	"strings"
 	"testing"
 
 	"github.com/stretchr/testify/assert"
 
+	"nametag/internal/signature"
+	"nametag/internal/signature/sign"
 	"nametag/internal/signature/verify"
 )
 
@@ -19,7 +30,7 @@ func Test_Verify_1(t *testing.T) {
 	v, err := verify.New()
 	assert.Nil(t, err, "new verify")
 
-	err = v.Verify(sign, fileSign)
+	_, err = v.Verify("", "", sign, fileSign)
 	assert.Nil(t, err, "Verify")
 }
 
@@ -30,6 +41,117 @@ func Test_Verify_2(t *testing.T) {
 	v, err := verify.New()
 	assert.Nil(t, err, "new verify")
 
-	err = v.Verify(sign, fileSign)
+	_, err = v.Verify("", "", sign, fileSign)
 	assert.Nil(t, err, "Verify")
 }
+
+// verifyErr returns the error of Verify.
+func verifyErr(_ string, err error) error {
+	return err
+}
+
+// writeKey writes the private key into the temp file and loads its signer.
+func writeKey(t *testing.T, b []byte, password string) sign.Signer {
+	fileName := filepath.Join(t.TempDir(), "key")
+	assert.Nil(t, os.WriteFile(fileName, b, 0600), "WriteFile")
+
+	s, err := sign.Load(fileName, password)
+	assert.Nil(t, err, "sign.Load")
+	return s
+}
+
+// newKey returns the signer of the new generated RSA key.
+func newKey(t *testing.T) sign.Signer {
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	assert.Nil(t, err, "GenerateKey")
+
+	return writeKey(t, x509.MarshalPKCS1PrivateKey(key), "")
+}
+
+// signData returns the message and the signature for Verify.
+func signData(t *testing.T, s sign.Signer, data string) (string, string) {
+	sum, sig, err := s.Sign([]byte(data))
+	assert.Nil(t, err, "Sign")
+
+	message := sum
+	if s.Alg() == signature.AlgMinisign {
+		message = []byte(data)
+	}
+
+	return base64.URLEncoding.EncodeToString(message), base64.URLEncoding.EncodeToString(sig)
+}
+
+func Test_Keyring(t *testing.T) {
+	v, err := verify.New()
+	assert.Nil(t, err, "new verify")
+
+	old, err := sign.New()
+	assert.Nil(t, err, "new sign")
+	assert.Equal(t, []string{old.KeyID()}, v.KeyIDs(), "the embedded key")
+
+	s := newKey(t)
+	sum, sig := signData(t, s, "data")
+	assert.ErrorIs(t, verifyErr(v.Verify(s.Alg(), s.KeyID(), sum, sig)), verify.UnknownKeyError)
+	assert.NotNil(t, verifyErr(v.Verify("", "", sum, sig)), "not trusted")
+	assert.Nil(t, v.VerifyKey(s.Alg(), s.KeyID(), s.PublicKey(), sum, sig), "VerifyKey")
+	assert.NotNil(t, v.VerifyKey(s.Alg(), old.KeyID(), s.PublicKey(), sum, sig), "VerifyKey with the wrong key id")
+	assert.NotNil(t, verifyErr(v.Verify(s.Alg(), s.KeyID(), sum, sig)), "VerifyKey doesn't trust the key")
+
+	assert.NotNil(t, v.AddKey(s.Alg(), old.KeyID(), s.PublicKey()), "wrong key id")
+	assert.Nil(t, v.AddKey(s.Alg(), s.KeyID(), s.PublicKey()), "AddKey")
+	assert.Nil(t, verifyErr(v.Verify(s.Alg(), s.KeyID(), sum, sig)), "new key")
+	id, err := v.Verify("", "", sum, sig)
+	assert.Nil(t, err, "any key")
+	assert.Equal(t, s.KeyID(), id, "the key which verified the signature")
+
+	oldSum, oldSig := signData(t, old, "data")
+	assert.NotNil(t, verifyErr(v.Verify(s.Alg(), s.KeyID(), oldSum, oldSig)), "signed by the other key")
+	assert.Nil(t, verifyErr(v.Verify(old.Alg(), old.KeyID(), oldSum, oldSig)), "old key")
+
+	assert.Nil(t, v.RetireKey(old.KeyID()), "RetireKey")
+	assert.ErrorIs(t, verifyErr(v.Verify(old.Alg(), old.KeyID(), oldSum, oldSig)), verify.UnknownKeyError, "retired")
+	assert.NotNil(t, v.AddKey(old.Alg(), old.KeyID(), old.PublicKey()), "the retired key is not trusted again")
+	assert.NotNil(t, v.RetireKey(s.KeyID()), "the last key")
+	assert.Equal(t, []string{s.KeyID()}, v.KeyIDs())
+}
+
+func Test_Algorithms(t *testing.T) {
+	_, edKey, err := ed25519.GenerateKey(rand.Reader)
+	assert.Nil(t, err, "ed25519.GenerateKey")
+	der, err := x509.MarshalPKCS8PrivateKey(edKey)
+	assert.Nil(t, err, "MarshalPKCS8PrivateKey")
+
+	// minisign.EncryptKey uses the scrypt of 1 GiB, the test key is encrypted with the cheap parameters
+	minisignKey, err := sign.Load("testdata/minisign.key", "password")
+	assert.Nil(t, err, "sign.Load minisign")
+
+	signers := []sign.Signer{
+		writeKey(t, pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: der}), ""),
+		minisignKey,
+	}
+	assert.Equal(t, signature.AlgEd25519, signers[0].Alg())
+	assert.Equal(t, signature.AlgMinisign, signers[1].Alg())
+
+	v, err := verify.New()
+	assert.Nil(t, err, "new verify")
+
+	for _, s := range signers {
+		assert.Nil(t, v.AddKey(s.Alg(), s.KeyID(), s.PublicKey()), s.Alg())
+
+		message, sig := signData(t, s, "data")
+		assert.Nil(t, verifyErr(v.Verify(s.Alg(), s.KeyID(), message, sig)), s.Alg())
+		id, err := v.Verify(s.Alg(), "", message, sig)
+		assert.Nil(t, err, "any key of "+s.Alg())
+		assert.Equal(t, s.KeyID(), id, s.Alg())
+		assert.NotNil(t, verifyErr(v.Verify(signature.AlgRSAPSS, s.KeyID(), message, sig)), "other algorithm")
+
+		other, _ := signData(t, s, "other")
+		assert.NotNil(t, verifyErr(v.Verify(s.Alg(), s.KeyID(), other, sig)), "other message")
+	}
+
+	// the signature of the minisign tool
+	assert.True(t, strings.HasPrefix(signers[1].PublicKey(), "untrusted comment: minisign public key: "+signers[1].KeyID()))
+	_, sig := signData(t, signers[1], "data")
+	b, _ := base64.URLEncoding.DecodeString(sig)
+	assert.True(t, strings.HasPrefix(string(b), "untrusted comment: "), "minisig")
+}
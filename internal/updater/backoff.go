@@ -0,0 +1,154 @@
+package updater
+
+import (
+	"math"
+	"math/rand"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+const (
+	// MaxServerDelay limits the delay which the server can ask for.
+	MaxServerDelay = 24 * time.Hour
+
+	// scanJitter spreads the regular checks by ±10%
+	scanJitter = 0.1
+)
+
+// Backoff is the exponential backoff for one class of errors.
+type Backoff struct {
+	Initial    time.Duration
+	Max        time.Duration
+	Multiplier float64
+}
+
+// DefaultRunBackoff is the default backoff for RunError.
+var DefaultRunBackoff = Backoff{Initial: time.Minute, Max: time.Hour, Multiplier: 4}
+
+// DefaultNetBackoff returns the default backoff for NetError with the scan frequency:
+// the first retry is after 1-2 scan intervals, the delay grows up to 10 minutes or 8 scan intervals.
+func DefaultNetBackoff(scanFrequency time.Duration) Backoff {
+	return Backoff{Initial: 2 * scanFrequency, Max: max(10*time.Minute, 8*scanFrequency), Multiplier: 2}
+}
+
+// DefaultCheckVersionBackoff returns the default backoff for CheckVersionError with the scan frequency:
+// the first retry is after 1-2 scan intervals, the delay grows up to 30 minutes or 8 scan intervals.
+func DefaultCheckVersionBackoff(scanFrequency time.Duration) Backoff {
+	return Backoff{Initial: 2 * scanFrequency, Max: max(30*time.Minute, 8*scanFrequency), Multiplier: 2}
+}
+
+func (b Backoff) check() error {
+	if b.Initial <= 0 || b.Max < b.Initial || b.Multiplier < 1 {
+		return errors.Errorf("bad backoff: initial %s, max %s, multiplier %v", b.Initial, b.Max, b.Multiplier)
+	}
+
+	return nil
+}
+
+// Delay returns the delay without jitter after the failures in a row, failures >= 1.
+func (b Backoff) Delay(failures int) time.Duration {
+	d := float64(b.Initial) * math.Pow(b.Multiplier, float64(failures-1))
+	if d > float64(b.Max) {
+		return b.Max
+	}
+
+	return time.Duration(d)
+}
+
+// equalJitter returns a random delay in [d/2, d),
+// so the clients which fail at the same moment don't retry in lockstep.
+func equalJitter(d time.Duration) time.Duration {
+	if d < 2 {
+		return d
+	}
+
+	return d/2 + time.Duration(rand.Int63n(int64(d/2)))
+}
+
+// splay returns a random delay in [0, d) before the first check,
+// so the clients which start at the same moment don't check in lockstep.
+func splay(d time.Duration) time.Duration {
+	if d <= 0 {
+		return 0
+	}
+
+	return time.Duration(rand.Int63n(int64(d)))
+}
+
+// errorClass returns NetError, RunError or CheckVersionError for the error of checkAndRun.
+func errorClass(err error) error {
+	switch {
+	case errors.Is(err, NetError):
+		return NetError
+	case errors.Is(err, RunError):
+		return RunError
+	default:
+		return CheckVersionError
+	}
+}
+
+// backoffOf returns the backoff for the class of the error.
+func (u *Updater) backoffOf(class error) Backoff {
+	switch class {
+	case NetError:
+		return u.opts.NetBackoff
+	case RunError:
+		return u.opts.RunBackoff
+	default:
+		return u.opts.CheckVersionBackoff
+	}
+}
+
+// nextDelay returns the delay before the next check after the result of the last one.
+// The failed checks are not retried sooner than the regular ones, so the clients
+// don't check more often while the server is down.
+// The delay which is asked by the server or the hooks is respected.
+func (u *Updater) nextDelay(err error) time.Duration {
+	jitter := float64(u.opts.ScanFrequency) * scanJitter
+	d := u.opts.ScanFrequency - time.Duration(jitter) + time.Duration(rand.Int63n(int64(2*jitter)+1))
+
+	if err == nil {
+		clear(u.failures)
+	} else {
+		class := errorClass(err)
+		u.failures[class]++
+		d = max(d, equalJitter(u.backoffOf(class).Delay(u.failures[class])))
+	}
+
+	if u.minDelay > d {
+		d = u.minDelay
+	}
+
+	return d
+}
+
+// retryAfter parses the Retry-After header: seconds or http date.
+func retryAfter(h http.Header) time.Duration {
+	s := h.Get("Retry-After")
+	if s == "" {
+		return 0
+	}
+
+	if sec, err := strconv.Atoi(s); err == nil && sec > 0 {
+		return time.Duration(sec) * time.Second
+	}
+
+	if t, err := http.ParseTime(s); err == nil {
+		return time.Until(t)
+	}
+
+	return 0
+}
+
+// setMinDelay saves the delay which is asked by the server or the hooks.
+func (u *Updater) setMinDelay(d time.Duration) {
+	if d > MaxServerDelay {
+		d = MaxServerDelay
+	}
+	if d > u.minDelay {
+		u.minDelay = d
+	}
+}
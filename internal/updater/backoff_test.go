@@ -0,0 +1,182 @@
+package updater_test
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/stretchr/testify/assert"
+
+	"nametag/internal/updater"
+)
+
+func Test_Backoff_Delay(t *testing.T) {
+	b := updater.Backoff{Initial: time.Second, Max: 10 * time.Second, Multiplier: 2}
+
+	assert.Equal(t, time.Second, b.Delay(1))
+	assert.Equal(t, 2*time.Second, b.Delay(2))
+	assert.Equal(t, 8*time.Second, b.Delay(4))
+	assert.Equal(t, 10*time.Second, b.Delay(5), "max")
+	assert.Equal(t, 10*time.Second, b.Delay(100), "max")
+}
+
+func Test_Backoff_Options(t *testing.T) {
+	o, err := updater.DefaultOptions()
+	assert.Nil(t, err, "DefaultOptions")
+
+	b := updater.Backoff{Initial: time.Minute, Max: time.Hour, Multiplier: 3}
+	assert.Nil(t, updater.WithBackoff(updater.NetError, b)(&o))
+	assert.Equal(t, b, o.NetBackoff)
+	assert.Nil(t, o.Validate(), "Validate")
+
+	assert.NotNil(t, updater.WithBackoff(updater.HealthCheckError, b)(&o), "unknown class")
+
+	o.RunBackoff.Multiplier = 0.5
+	assert.NotNil(t, o.Validate(), "bad multiplier")
+}
+
+func Test_NextDelay(t *testing.T) {
+	u := newTestUpdater(t, `{"releases": []}`,
+		updater.WithScanFrequency(time.Second),
+		updater.WithBackoff(updater.NetError, updater.Backoff{Initial: 4 * time.Second, Max: 32 * time.Second, Multiplier: 2}),
+		updater.WithBackoff(updater.RunError, updater.Backoff{Initial: time.Minute, Max: time.Hour, Multiplier: 4}),
+	)
+	netErr, runErr := errors.Wrap(updater.NetError, "get"), errors.Wrap(updater.RunError, "start")
+
+	// the delay with the equal jitter is in [d/2, d)
+	between := func(d, min, max time.Duration, msg string) {
+		assert.GreaterOrEqual(t, d, min, msg)
+		assert.Less(t, d, max, msg)
+	}
+
+	between(u.NextDelay(netErr), 2*time.Second, 4*time.Second, "the first net error")
+	between(u.NextDelay(netErr), 4*time.Second, 8*time.Second, "the second net error")
+	between(u.NextDelay(runErr), 30*time.Second, time.Minute, "the failures are counted for each class")
+	between(u.NextDelay(netErr), 8*time.Second, 16*time.Second, "the third net error")
+
+	// the success resets the failures, the regular check is ±10%
+	between(u.NextDelay(nil), 900*time.Millisecond, 1100*time.Millisecond+1, "success")
+	between(u.NextDelay(netErr), 2*time.Second, 4*time.Second, "the net error after the success")
+	between(u.NextDelay(runErr), 30*time.Second, time.Minute, "the run error after the success")
+
+	// the failed request of the manifest is retried by the net backoff, the bad manifest by the check backoff
+	tests := []struct {
+		name   string
+		status int
+		class  error
+		min    time.Duration
+		max    time.Duration
+	}{
+		{"unavailable", http.StatusServiceUnavailable, updater.NetError, 2 * time.Second, 4 * time.Second},
+		{"bad manifest", http.StatusOK, updater.CheckVersionError, 5 * time.Minute, 10 * time.Minute},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				w.WriteHeader(tt.status)
+				_, _ = w.Write([]byte("not a manifest"))
+			}))
+			defer srv.Close()
+
+			u := newRawTestUpdater(t, "",
+				updater.WithCheckURL(srv.URL),
+				updater.WithScanFrequency(time.Second),
+				updater.WithBackoff(updater.NetError, updater.Backoff{Initial: 4 * time.Second, Max: 32 * time.Second, Multiplier: 2}),
+				updater.WithBackoff(updater.CheckVersionError, updater.Backoff{Initial: 10 * time.Minute, Max: time.Hour, Multiplier: 2}),
+			)
+
+			success, err := u.CheckOnce()
+			assert.False(t, success)
+			assert.ErrorIs(t, err, tt.class)
+			between(u.NextDelay(err), tt.min, tt.max, tt.name)
+		})
+	}
+}
+
+func Test_NextDelay_LongScanFrequency(t *testing.T) {
+	netErr := errors.Wrap(updater.NetError, "get")
+	between := func(d, min, max time.Duration, msg string) {
+		assert.GreaterOrEqual(t, d, min, msg)
+		assert.Less(t, d, max, msg)
+	}
+
+	// the default backoff starts at the scan frequency
+	u := newTestUpdater(t, `{"releases": []}`, updater.WithScanFrequency(time.Hour))
+	between(u.NextDelay(netErr), time.Hour, 2*time.Hour, "the first net error")
+	between(u.NextDelay(netErr), 2*time.Hour, 4*time.Hour, "the second net error")
+	for i := 0; i < 10; i++ {
+		u.NextDelay(netErr)
+	}
+	between(u.NextDelay(netErr), 4*time.Hour, 8*time.Hour, "max")
+
+	// the short backoff doesn't make the failed checks more frequent than the regular ones
+	u = newTestUpdater(t, `{"releases": []}`,
+		updater.WithScanFrequency(time.Hour),
+		updater.WithBackoff(updater.NetError, updater.Backoff{Initial: time.Second, Max: time.Minute, Multiplier: 2}),
+	)
+	between(u.NextDelay(netErr), 54*time.Minute, 66*time.Minute+1, "the regular check")
+}
+
+func Test_RetryAfter(t *testing.T) {
+	h := http.Header{}
+	assert.Equal(t, time.Duration(0), updater.RetryAfter(h), "no header")
+
+	h.Set("Retry-After", "120")
+	assert.Equal(t, 2*time.Minute, updater.RetryAfter(h), "seconds")
+
+	h.Set("Retry-After", time.Now().Add(time.Hour).UTC().Format(http.TimeFormat))
+	d := updater.RetryAfter(h)
+	assert.Greater(t, d, 59*time.Minute, "http date")
+	assert.LessOrEqual(t, d, time.Hour, "http date")
+
+	for _, s := range []string{"0", "-1", "soon"} {
+		h.Set("Retry-After", s)
+		assert.Equal(t, time.Duration(0), updater.RetryAfter(h), s)
+	}
+}
+
+func Test_ServerDelay(t *testing.T) {
+	tests := []struct {
+		name       string
+		status     int
+		retryAfter string
+		manifest   string
+		want       time.Duration
+	}{
+		{"retry after", http.StatusServiceUnavailable, "7200", "", 2 * time.Hour},
+		{"next check after", http.StatusOK, "", `{"releases": [], "next_check_after": 3600}`, time.Hour},
+		{"max server delay", http.StatusServiceUnavailable, strconv.Itoa(int(2 * updater.MaxServerDelay / time.Second)), "", updater.MaxServerDelay},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			manifest := ""
+			if tt.manifest != "" {
+				manifest = signManifest(t, tt.manifest)
+			}
+
+			srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				if tt.retryAfter != "" {
+					w.Header().Set("Retry-After", tt.retryAfter)
+				}
+				w.WriteHeader(tt.status)
+				_, _ = w.Write([]byte(manifest))
+			}))
+			defer srv.Close()
+
+			u := newRawTestUpdater(t, "", updater.WithCheckURL(srv.URL), updater.WithScanFrequency(time.Second))
+
+			// the delay which the server asks for is kept after the check
+			success, err := u.CheckOnce()
+			assert.False(t, success)
+			assert.Equal(t, tt.status != http.StatusOK, err != nil, "CheckOnce")
+
+			assert.Equal(t, tt.want, u.NextDelay(nil), "success")
+			assert.Equal(t, tt.want, u.NextDelay(errors.Wrap(updater.NetError, "get")), "error")
+		})
+	}
+}
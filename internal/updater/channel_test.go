@@ -0,0 +1,81 @@
+package updater_test
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+
+	"nametag/internal/imagestore"
+	"nametag/internal/updater"
+)
+
+const channelManifest = `{
+	"releases": [
+		{"version": "1.3.0-nightly.1", "channel": "nightly"},
+		{"version": "1.2.0-beta.1", "channel": "beta"},
+		{"version": "1.1.0", "channel": "stable"},
+		{"version": "0.9.0", "channel": "stable"}
+	]
+}`
+
+// offered returns the version which the updater wants to install, empty if there is none.
+// The update is postponed, so the version is offered again by the next check.
+func offered(t *testing.T, u *updater.Updater) string {
+	var got updater.HookInfo
+	u.AddHook(updater.StageBeforeDownload, time.Second, func(_ context.Context, info updater.HookInfo) error {
+		got = info
+		return updater.Postpone(time.Hour)
+	})
+	success, _ := u.CheckOnce()
+	assert.False(t, success)
+
+	if got.NewVersion == nil {
+		return ""
+	}
+	return got.NewVersion.String()
+}
+
+func Test_Channel(t *testing.T) {
+	tests := []struct {
+		channel string
+		want    string
+	}{
+		{imagestore.ChannelStable, "1.1.0"},
+		{imagestore.ChannelBeta, "1.2.0-beta.1"},
+		{imagestore.ChannelNightly, "1.3.0-nightly.1"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.channel, func(t *testing.T) {
+			u := newTestUpdater(t, channelManifest, updater.WithChannel(tt.channel))
+			assert.Equal(t, tt.channel, u.Channel())
+			assert.Equal(t, tt.want, offered(t, u))
+			assert.Equal(t, tt.channel, u.Status().Channel)
+		})
+	}
+}
+
+func Test_SetChannel(t *testing.T) {
+	// v1.0.0 is installed from beta, the last stable release is older
+	u := newTestUpdater(t, `{
+		"releases": [
+			{"version": "1.1.0-beta.1", "channel": "beta"},
+			{"version": "0.9.0", "channel": "stable"}
+		]
+	}`, updater.WithChannel(imagestore.ChannelBeta))
+	assert.Equal(t, "1.1.0-beta.1", offered(t, u), "beta")
+
+	assert.Nil(t, u.SetChannel(imagestore.ChannelStable), "SetChannel")
+	assert.Equal(t, imagestore.ChannelStable, u.Channel())
+	assert.Equal(t, "", offered(t, u), "no downgrade to the stable release")
+
+	s := u.Status()
+	assert.Equal(t, "0.9.0", s.LatestVersion, "the last stable release")
+	assert.Empty(t, s.AvailableVersion, "nothing to install")
+	assert.Empty(t, s.LastError)
+
+	assert.NotNil(t, u.SetChannel("alpha"), "unknown channel")
+	assert.Equal(t, imagestore.ChannelStable, u.Channel(), "the channel isn't changed")
+}
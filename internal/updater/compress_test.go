@@ -0,0 +1,100 @@
+package updater_test
+
+import (
+	"bytes"
+	"compress/gzip"
+	"context"
+	"crypto/sha256"
+	"encoding/base64"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+
+	"nametag/internal/lg"
+	"nametag/internal/updater"
+)
+
+func Test_Compressed(t *testing.T) {
+	data := bytes.Repeat([]byte("app.v2.0.0 "), 10000)
+	sum := sha256.Sum256(data)
+
+	buf := &bytes.Buffer{}
+	w := gzip.NewWriter(buf)
+	_, err := w.Write(data)
+	assert.Nil(t, err, "Write")
+	assert.Nil(t, w.Close(), "Close")
+
+	tests := []struct {
+		name    string
+		size    int
+		limit   int64
+		applied bool
+		err     string
+	}{
+		{"ok", len(data), updater.DefaultMaxImageSize, true, ""},
+		{"bomb", len(data) - 1, updater.DefaultMaxImageSize, false, "size limit exceeded"},
+		{"too large", len(data), int64(len(data) - 1), false, "exceeds the limit"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			manifest := fmt.Sprintf(`{"releases": [{"version": "2.0.0", "channel": "stable", "uri": "/data/app.v2.0.0.gz",
+				"compression": "gzip", "size": %d, "file_sum": %q}]}`, tt.size, base64.URLEncoding.EncodeToString(sum[:]))
+
+			srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				if r.URL.Path == "/data/app.v2.0.0.gz" {
+					_, _ = w.Write(buf.Bytes())
+					return
+				}
+				_, _ = w.Write([]byte(signManifest(t, manifest)))
+			}))
+			defer srv.Close()
+
+			dir := t.TempDir()
+			execPath := filepath.Join(dir, "app")
+			assert.Nil(t, os.WriteFile(execPath, []byte("app.v1.0.0"), 0755), "WriteFile")
+
+			log, err := lg.New(filepath.Join(dir, "test.log"), "v1.0.0")
+			assert.Nil(t, err, "lg.New")
+
+			u, err := updater.New(log, okVerifier{}, "v1.0.0",
+				updater.WithCheckURL(srv.URL),
+				updater.WithStateDir(dir),
+				updater.WithTempDir(dir),
+				updater.WithExecPath(execPath),
+				updater.WithOldSavePath(execPath+".previous"),
+				updater.WithInitialSplay(0),
+				updater.WithMaxImageSize(tt.limit),
+			)
+			assert.Nil(t, err, "updater.New")
+
+			// look at the applied binary and stop before the restart
+			var applied []byte
+			u.AddHook(updater.StageAfterApply, time.Second, func(context.Context, updater.HookInfo) error {
+				applied, _ = os.ReadFile(execPath)
+				return updater.ErrVeto
+			})
+			success, err := u.CheckOnce()
+			assert.False(t, success)
+
+			if tt.applied {
+				assert.Equal(t, data, applied, "the uncompressed image is applied")
+				assert.Nil(t, err, "CheckOnce")
+			} else {
+				assert.Nil(t, applied, "not applied")
+				if assert.NotNil(t, err, "CheckOnce") {
+					assert.Contains(t, err.Error(), tt.err)
+				}
+			}
+
+			current, _ := os.ReadFile(execPath)
+			assert.Equal(t, "app.v1.0.0", string(current), "the vetoed update is restored")
+		})
+	}
+}
@@ -0,0 +1,129 @@
+package updater
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/base64"
+	"io"
+	"os"
+
+	"github.com/minio/selfupdate"
+	"github.com/pkg/errors"
+
+	"nametag/internal/bsdiff"
+	"nametag/internal/imagestore"
+)
+
+// currentSum returns the sha256 of the executable in the imagestore.Image.FileSum format.
+func (u *Updater) currentSum() (string, error) {
+	f, err := os.Open(u.opts.ExecPath)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+
+	h := sha256.New()
+	if _, err := io.Copy(h, f); err != nil {
+		return "", err
+	}
+
+	return base64.URLEncoding.EncodeToString(h.Sum(nil)), nil
+}
+
+// findPatch returns the signed patch from the current executable to the image or nil.
+func (u *Updater) findPatch(im *imagestore.Image) (*imagestore.Patch, error) {
+	if len(im.Patches) == 0 {
+		return nil, nil
+	}
+
+	sum, err := u.currentSum()
+	if err != nil {
+		return nil, err
+	}
+
+	for i := range im.Patches {
+		if im.Patches[i].BaseSum == sum && im.Patches[i].FileSum != "" {
+			return &im.Patches[i], nil
+		}
+	}
+
+	return nil, nil
+}
+
+// loadPatch updates the executable by the binary patch, beforeApply runs the hooks.
+// It returns false if there is no patch for the current executable.
+// The patch is checked against its signed size and hash before it's applied,
+// the patched binary is checked against the checksum of the full image.
+func (u *Updater) loadPatch(im *imagestore.Image, checksum []byte, beforeApply func() error) (bool, error) {
+	patch, err := u.findPatch(im)
+	if err != nil || patch == nil {
+		return false, err
+	}
+
+	limit, err := u.imageLimit(im)
+	if err != nil {
+		return true, err
+	}
+	if patch.Size > limit {
+		return true, errors.Errorf("patch from %s: size %d exceeds the limit %d", patch.From, patch.Size, limit)
+	}
+
+	s := u.staging(patch.FileSum)
+	f, err := u.download(patch.Uri, s, patch.Size)
+	if err != nil {
+		return true, err
+	}
+	defer f.Close()
+
+	if err := checkPatch(f, patch, im.Size); err != nil {
+		s.Remove()
+		return true, errors.Wrapf(err, "patch from %s", patch.From)
+	}
+
+	if err := beforeApply(); err != nil {
+		if errors.Is(err, ErrVeto) {
+			s.Remove()
+		}
+		return true, err
+	}
+
+	err = selfupdate.Apply(f, selfupdate.Options{
+		Checksum:    checksum,
+		Patcher:     selfupdate.NewBSDiffPatcher(),
+		TargetPath:  u.opts.ExecPath,
+		OldSavePath: u.opts.OldSavePath,
+	})
+
+	// the applied or broken patch isn't needed anymore, the full image is the fallback
+	s.Remove()
+	return true, errors.Wrapf(err, "patch from %s", patch.From)
+}
+
+// checkPatch compares the downloaded patch with its signed size and hash, and checks
+// that its header makes the image of newSize bytes, so bspatch can't be made to allocate
+// the buffers by the forged lengths.
+func checkPatch(f *os.File, patch *imagestore.Patch, newSize int64) error {
+	sum, err := base64.URLEncoding.DecodeString(patch.FileSum)
+	if err != nil {
+		return errors.Wrap(err, "patch sum")
+	}
+
+	h := sha256.New()
+	n, err := io.Copy(h, f)
+	if err != nil {
+		return err
+	}
+	if n != patch.Size || !bytes.Equal(h.Sum(nil), sum) {
+		return errors.Errorf("checksum mismatch")
+	}
+
+	if _, err := f.Seek(0, io.SeekStart); err != nil {
+		return err
+	}
+	if err := bsdiff.CheckHeader(f, patch.Size, newSize); err != nil {
+		return err
+	}
+
+	_, err = f.Seek(0, io.SeekStart)
+	return err
+}
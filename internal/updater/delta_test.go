@@ -0,0 +1,134 @@
+package updater_test
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/binary"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+
+	"nametag/internal/bsdiff"
+	"nametag/internal/lg"
+	"nametag/internal/updater"
+)
+
+func Test_Delta(t *testing.T) {
+	old := bytes.Repeat([]byte("app.v1.0.0 "), 10000)
+	data := bytes.Repeat([]byte("app.v2.0.0 "), 10000)
+	oldSum, sum := sha256.Sum256(old), sha256.Sum256(data)
+
+	patch := &bytes.Buffer{}
+	assert.Nil(t, bsdiff.Diff(bytes.NewReader(old), bytes.NewReader(data), patch), "Diff")
+
+	// the header of the forged patch makes bspatch allocate 1 TiB
+	forged := append([]byte{}, patch.Bytes()...)
+	binary.LittleEndian.PutUint64(forged[24:], 1<<40)
+
+	tests := []struct {
+		name     string
+		baseSum  []byte
+		patch    []byte
+		unsigned bool
+		padding  int // the bytes served after the signed size
+		requests []string
+	}{
+		{"patch", oldSum[:], patch.Bytes(), false, 0, []string{"/data/patch"}},
+		{"broken patch", oldSum[:], []byte("broken"), false, 0, []string{"/data/patch", "/data/app.v2.0.0"}},
+		{"forged header", oldSum[:], forged, false, 0, []string{"/data/patch", "/data/app.v2.0.0"}},
+		{"oversized patch", oldSum[:], patch.Bytes(), false, 1 << 20, []string{"/data/patch", "/data/app.v2.0.0"}},
+		{"unsigned patch", oldSum[:], patch.Bytes(), true, 0, []string{"/data/app.v2.0.0"}},
+		{"other base", sum[:], patch.Bytes(), false, 0, []string{"/data/app.v2.0.0"}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			patchSum := sha256.Sum256(tt.patch)
+			patches := fmt.Sprintf(`[{"from": "1.0.0", "base_sum": %q, "uri": "/data/patch", "size": %d, "file_sum": %q}]`,
+				base64.URLEncoding.EncodeToString(tt.baseSum), len(tt.patch), base64.URLEncoding.EncodeToString(patchSum[:]))
+			release := fmt.Sprintf(`{"version": "2.0.0", "channel": "stable", "uri": "/data/app.v2.0.0", "size": %d, "file_sum": %q`,
+				len(data), base64.URLEncoding.EncodeToString(sum[:]))
+
+			var manifest string
+			if tt.unsigned {
+				// the patches are added to the image next to the signed release
+				manifest = signManifest(t, `{"releases": [`+release+`}]}`)
+				manifest = strings.Replace(manifest, `"uri":"/data/app.v2.0.0"`, `"uri":"/data/app.v2.0.0","patches":`+patches, 1)
+				assert.Contains(t, manifest, `"patches"`)
+			} else {
+				manifest = signManifest(t, `{"releases": [`+release+`, "patches": `+patches+`}]}`)
+			}
+
+			mx := sync.Mutex{}
+			requests := make([]string, 0)
+			srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				switch r.URL.Path {
+				case "/data/patch":
+					_, _ = w.Write(append(tt.patch, make([]byte, tt.padding)...))
+				case "/data/app.v2.0.0":
+					_, _ = w.Write(data)
+				default:
+					_, _ = w.Write([]byte(manifest))
+					return
+				}
+
+				mx.Lock()
+				requests = append(requests, r.URL.Path)
+				mx.Unlock()
+			}))
+			defer srv.Close()
+
+			dir := t.TempDir()
+			execPath := filepath.Join(dir, "app")
+			assert.Nil(t, os.WriteFile(execPath, old, 0755), "WriteFile")
+
+			log, err := lg.New(filepath.Join(dir, "test.log"), "v1.0.0")
+			assert.Nil(t, err, "lg.New")
+
+			u, err := updater.New(log, okVerifier{}, "v1.0.0",
+				updater.WithCheckURL(srv.URL),
+				updater.WithStateDir(dir),
+				updater.WithTempDir(dir),
+				updater.WithExecPath(execPath),
+				updater.WithOldSavePath(execPath+".previous"),
+				updater.WithInitialSplay(0),
+				updater.WithDeltaUpdates(true),
+			)
+			assert.Nil(t, err, "updater.New")
+
+			// the hooks may drain the traffic, they are run once for the patch and the full image
+			beforeApply := 0
+			u.AddHook(updater.StageBeforeApply, time.Second, func(context.Context, updater.HookInfo) error {
+				beforeApply++
+				return nil
+			})
+
+			// look at the applied binary and stop before the restart
+			var applied []byte
+			u.AddHook(updater.StageAfterApply, time.Second, func(context.Context, updater.HookInfo) error {
+				applied, _ = os.ReadFile(execPath)
+				return updater.ErrVeto
+			})
+			success, err := u.CheckOnce()
+			assert.False(t, success)
+			assert.Nil(t, err, "CheckOnce")
+
+			assert.Equal(t, data, applied, "the new version is applied")
+			assert.Equal(t, 1, beforeApply, "StageBeforeApply")
+
+			mx.Lock()
+			defer mx.Unlock()
+			assert.Equal(t, tt.requests, requests)
+		})
+	}
+}
@@ -0,0 +1,193 @@
+package updater
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+
+	"github.com/pkg/errors"
+
+	"nametag/internal/compress"
+	"nametag/internal/imagestore"
+)
+
+// staging is the partially downloaded file in the temp dir.
+// The ETag of the response is kept next to it to resume the download by If-Range.
+type staging struct {
+	fileName string
+	etagName string
+}
+
+func (u *Updater) staging(key string) *staging {
+	h := sha256.Sum256([]byte(key))
+	fileName := filepath.Join(u.opts.TempDir, "nametag-"+hex.EncodeToString(h[:8])+".part")
+
+	return &staging{
+		fileName: fileName,
+		etagName: fileName + ".etag",
+	}
+}
+
+// Remove deletes the staging files after the update or if they are broken.
+func (s *staging) Remove() {
+	_ = os.Remove(s.fileName)
+	_ = os.Remove(s.etagName)
+}
+
+// download loads the uri of the update server into the staging file, it fails after limit bytes.
+// If the previous download was interrupted, it continues from the end of the file
+// by the Range request. It returns the complete file at the beginning.
+// The file is kept after a network error, so the next check resumes it.
+func (u *Updater) download(uri string, s *staging, limit int64) (*os.File, error) {
+	fullURI, err := url.JoinPath(u.opts.CheckURL, uri)
+	if err != nil {
+		return nil, err
+	}
+
+	f, err := os.OpenFile(s.fileName, os.O_RDWR|os.O_CREATE, 0600)
+	if err != nil {
+		return nil, errors.Wrap(err, "staging file")
+	}
+
+	if err := u.resume(fullURI, f, s, limit); err != nil {
+		_ = f.Close()
+		return nil, err
+	}
+
+	if _, err := f.Seek(0, io.SeekStart); err != nil {
+		_ = f.Close()
+		return nil, err
+	}
+
+	return f, nil
+}
+
+func (u *Updater) resume(fullURI string, f *os.File, s *staging, limit int64) error {
+	info, err := f.Stat()
+	if err != nil {
+		return err
+	}
+	offset := info.Size()
+
+	req, err := http.NewRequest(http.MethodGet, fullURI, nil)
+	if err != nil {
+		return err
+	}
+
+	// without the ETag we can't be sure that the file is the same
+	etag, _ := os.ReadFile(s.etagName)
+	if offset > 0 && len(etag) > 0 {
+		req.Header.Set("Range", fmt.Sprintf("bytes=%d-", offset))
+		req.Header.Set("If-Range", string(etag))
+	}
+
+	resp, err := u.opts.HTTPClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	total := resp.ContentLength
+	switch resp.StatusCode {
+	case http.StatusPartialContent:
+		var start int64
+		if _, err := fmt.Sscanf(resp.Header.Get("Content-Range"), "bytes %d-", &start); err != nil || start != offset {
+			return errors.Errorf("get %s: unexpected content range %q", fullURI, resp.Header.Get("Content-Range"))
+		}
+		if _, err := f.Seek(offset, io.SeekStart); err != nil {
+			return err
+		}
+		u.log.Infof("resume download %s from %d", fullURI, offset)
+		if total >= 0 {
+			total += offset
+		}
+
+	case http.StatusOK:
+		// the file is changed or the server doesn't support ranges, start from scratch
+		offset = 0
+		if err := f.Truncate(0); err != nil {
+			return err
+		}
+		if _, err := f.Seek(0, io.SeekStart); err != nil {
+			return err
+		}
+
+		newETag := []byte(resp.Header.Get("ETag"))
+		if !bytes.Equal(newETag, etag) {
+			if err := os.WriteFile(s.etagName, newETag, 0600); err != nil {
+				return errors.Wrap(err, "staging etag")
+			}
+		}
+
+	case http.StatusRequestedRangeNotSatisfiable:
+		// the file is already complete, it's checked by the caller
+		return nil
+
+	default:
+		return errors.Errorf("get %s: status %d", fullURI, resp.StatusCode)
+	}
+
+	if total > limit {
+		return errors.Errorf("get %s: size %d exceeds the limit %d", fullURI, total, limit)
+	}
+
+	pw := u.newProgressWriter(fullURI, offset, total)
+	_, err = io.Copy(io.MultiWriter(f, pw), compress.LimitReader(resp.Body, limit-offset))
+	pw.finish(err == nil)
+
+	return errors.Wrapf(err, "download %s", fullURI)
+}
+
+// imageLimit returns the size limit of the uncompressed image.
+func (u *Updater) imageLimit(im *imagestore.Image) (int64, error) {
+	if im.Size > u.opts.MaxImageSize {
+		return 0, errors.Errorf("image size %d exceeds the limit %d", im.Size, u.opts.MaxImageSize)
+	}
+
+	if im.Size > 0 {
+		return im.Size, nil
+	}
+
+	return u.opts.MaxImageSize, nil
+}
+
+// openImage returns the reader of the uncompressed image from the staging file,
+// it fails after limit bytes, so the decompression bomb doesn't fill the disk.
+func openImage(f *os.File, compression string, limit int64) (io.ReadCloser, error) {
+	r, err := compress.NewReader(f, compression)
+	if err != nil {
+		return nil, errors.Wrap(err, "decompress")
+	}
+
+	return struct {
+		io.Reader
+		io.Closer
+	}{compress.LimitReader(r, limit), r}, nil
+}
+
+// checkSum compares the sha256 of the uncompressed image with sum.
+func checkSum(f *os.File, compression string, limit int64, sum []byte) error {
+	r, err := openImage(f, compression, limit)
+	if err != nil {
+		return err
+	}
+	defer r.Close()
+
+	h := sha256.New()
+	if _, err := io.Copy(h, r); err != nil {
+		return errors.Wrap(err, "decompress")
+	}
+
+	if !bytes.Equal(h.Sum(nil), sum) {
+		return errors.Errorf("checksum mismatch")
+	}
+
+	_, err = f.Seek(0, io.SeekStart)
+	return err
+}
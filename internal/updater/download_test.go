@@ -0,0 +1,152 @@
+package updater_test
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/base64"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+
+	"nametag/internal/lg"
+	"nametag/internal/updater"
+)
+
+// statusWriter keeps the status of the response.
+type statusWriter struct {
+	http.ResponseWriter
+	status int
+}
+
+func (w *statusWriter) WriteHeader(status int) {
+	w.status = status
+	w.ResponseWriter.WriteHeader(status)
+}
+
+func Test_Resume(t *testing.T) {
+	// the new version is the script which exits at once
+	data := []byte("#!/bin/true\n" + strings.Repeat("app.v2.0.0 ", 10000) + "\n")
+	sum := sha256.Sum256(data)
+	broken := bytes.Repeat([]byte("x"), len(data))
+	half := len(data) / 2
+
+	manifest := signManifest(t, fmt.Sprintf(`{"releases": [{"version": "2.0.0", "channel": "stable", "uri": "/data/app.v2.0.0",
+		"size": %d, "file_sum": %q}]}`, len(data), base64.URLEncoding.EncodeToString(sum[:])))
+
+	tests := []struct {
+		name string
+
+		// etags and contents are of the image in the requests in order,
+		// the first response is cut off after cut bytes if cut > 0
+		etags    []string
+		contents [][]byte
+		cut      int
+
+		ranges   []string
+		statuses []int
+	}{
+		{"resumed", []string{`"v1"`, `"v1"`}, [][]byte{data, data}, half,
+			[]string{"", fmt.Sprintf("bytes=%d-", half)}, []int{http.StatusOK, http.StatusPartialContent}},
+		{"changed etag", []string{`"v1"`, `"v2"`}, [][]byte{broken, data}, half,
+			[]string{"", fmt.Sprintf("bytes=%d-", half)}, []int{http.StatusOK, http.StatusOK}},
+		{"broken", []string{`"v1"`, `"v1"`}, [][]byte{broken, data}, 0,
+			[]string{"", ""}, []int{http.StatusOK, http.StatusOK}},
+		{"complete", []string{`"v1"`, `"v1"`}, [][]byte{data, data}, len(data),
+			[]string{"", fmt.Sprintf("bytes=%d-", len(data))}, []int{http.StatusOK, http.StatusRequestedRangeNotSatisfiable}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			mx := sync.Mutex{}
+			ranges, statuses := make([]string, 0), make([]int, 0)
+
+			srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				if r.URL.Path != "/data/app.v2.0.0" {
+					_, _ = w.Write([]byte(manifest))
+					return
+				}
+
+				mx.Lock()
+				n := len(ranges)
+				ranges = append(ranges, r.Header.Get("Range"))
+				mx.Unlock()
+				if n >= len(tt.contents) {
+					http.Error(w, "unexpected request", http.StatusInternalServerError)
+					return
+				}
+
+				if r.Header.Get("Range") != "" {
+					assert.Equal(t, tt.etags[0], r.Header.Get("If-Range"), "the range of the same file")
+				}
+
+				sw := &statusWriter{ResponseWriter: w, status: http.StatusOK}
+				sw.Header().Set("ETag", tt.etags[n])
+				if n == 0 && tt.cut > 0 {
+					// the connection is lost before the end of the announced content
+					sw.Header().Set("Content-Length", strconv.Itoa(len(tt.contents[n])+1))
+					_, _ = sw.Write(tt.contents[n][:tt.cut])
+				} else {
+					http.ServeContent(sw, r, "app", time.Time{}, bytes.NewReader(tt.contents[n]))
+				}
+
+				mx.Lock()
+				statuses = append(statuses, sw.status)
+				mx.Unlock()
+
+				if n == 0 && tt.cut > 0 {
+					panic(http.ErrAbortHandler)
+				}
+			}))
+			defer srv.Close()
+
+			dir := t.TempDir()
+			execPath := filepath.Join(dir, "app")
+			assert.Nil(t, os.WriteFile(execPath, []byte("app.v1.0.0"), 0755), "WriteFile")
+
+			log, err := lg.New(filepath.Join(dir, "test.log"), "v1.0.0")
+			assert.Nil(t, err, "lg.New")
+
+			u, err := updater.New(log, okVerifier{}, "v1.0.0",
+				updater.WithCheckURL(srv.URL),
+				updater.WithStateDir(dir),
+				updater.WithTempDir(dir),
+				updater.WithExecPath(execPath),
+				updater.WithOldSavePath(execPath+".previous"),
+				updater.WithArgs(execPath),
+				updater.WithInitialSplay(0),
+			)
+			assert.Nil(t, err, "updater.New")
+
+			// the first download fails, the next check resumes or reloads it
+			success, err := u.CheckOnce()
+			assert.False(t, success)
+			assert.NotNil(t, err, "the first download fails")
+
+			success, err = u.CheckOnce()
+			assert.True(t, success, "the new version is started")
+			assert.Nil(t, err, "CheckOnce")
+
+			applied, err := os.ReadFile(execPath)
+			assert.Nil(t, err, "ReadFile")
+			assert.Equal(t, data, applied, "the complete image is applied")
+
+			mx.Lock()
+			defer mx.Unlock()
+			assert.Equal(t, tt.ranges, ranges, "ranges")
+			assert.Equal(t, tt.statuses, statuses, "statuses")
+
+			staged, err := filepath.Glob(filepath.Join(dir, "*.part"))
+			assert.Nil(t, err, "Glob")
+			assert.Empty(t, staged, "the staging file is removed after the update")
+		})
+	}
+}
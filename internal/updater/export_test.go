@@ -0,0 +1,20 @@
+package updater
+
+import (
+	"time"
+)
+
+// RetryAfter exports retryAfter for the tests.
+var RetryAfter = retryAfter
+
+// NextDelay exports nextDelay for the tests, the delay after the check with err.
+func (u *Updater) NextDelay(err error) time.Duration {
+	return u.nextDelay(err)
+}
+
+// CheckOnce is a single check of Check for the tests, without the splay and the retry delays.
+func (u *Updater) CheckOnce() (bool, error) {
+	success, err := u.checkAndRun()
+	u.setChecked(err)
+	return success, err
+}
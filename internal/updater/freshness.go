@@ -0,0 +1,84 @@
+package updater
+
+import (
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+
+	"nametag/internal/imagestore"
+)
+
+// manifestVersionFile is the file in the state directory with the highest seen manifest version.
+const manifestVersionFile = "manifest-version"
+
+// FreshnessError is returned for the manifest without the valid fresh timestamp,
+// e.g. a stale manifest replayed by an attacker to freeze the updates.
+var FreshnessError = errors.Errorf("stale manifest")
+
+// loadManifestVersion reads the highest seen manifest version, 0 at the first start.
+func loadManifestVersion(stateDir string) (int64, error) {
+	b, err := os.ReadFile(filepath.Join(stateDir, manifestVersionFile))
+	if os.IsNotExist(err) {
+		return 0, nil
+	}
+	if err != nil {
+		return 0, errors.Wrap(err, "read manifest version")
+	}
+
+	v, err := strconv.ParseInt(strings.TrimSpace(string(b)), 10, 64)
+	return v, errors.Wrap(err, "parse manifest version")
+}
+
+// saveManifestVersion keeps the highest seen manifest version across the restarts and updates.
+func saveManifestVersion(stateDir string, v int64) error {
+	if err := os.MkdirAll(stateDir, 0755); err != nil {
+		return errors.Wrap(err, "create state dir")
+	}
+
+	fileName := filepath.Join(stateDir, manifestVersionFile)
+	if err := os.WriteFile(fileName+".tmp", []byte(strconv.FormatInt(v, 10)+"\n"), 0644); err != nil {
+		return errors.Wrap(err, "save manifest version")
+	}
+
+	return errors.Wrap(os.Rename(fileName+".tmp", fileName), "save manifest version")
+}
+
+// checkFreshness verifies the timestamp of the manifest: it's signed, not expired,
+// not older than the manifests seen before and it pins the documents of the manifest
+// directly or by the snapshot. It returns the verified snapshot, nil if there is none.
+func (u *Updater) checkFreshness(m *imagestore.Manifest, now time.Time) (*imagestore.Snapshot, error) {
+	if m.Timestamp == nil {
+		return nil, errors.Wrap(FreshnessError, "no timestamp")
+	}
+
+	t := &imagestore.Timestamp{}
+	if err := u.openRole(m.Timestamp, imagestore.RoleTimestamp, 1, t); err != nil {
+		return nil, errors.Wrapf(FreshnessError, "timestamp: %s", err.Error())
+	}
+	if err := t.Check(now, u.opts.ClockSkew); err != nil {
+		return nil, errors.Wrap(FreshnessError, err.Error())
+	}
+	if !t.Matches(m) {
+		return nil, errors.Wrapf(FreshnessError, "timestamp %d doesn't match the rollback or revocation list", t.Version)
+	}
+	s, err := u.checkSnapshot(m, t, now)
+	if err != nil {
+		return nil, err
+	}
+
+	if t.Version < u.manifestVersion {
+		return nil, errors.Wrapf(FreshnessError, "manifest version %d is lower than the seen %d", t.Version, u.manifestVersion)
+	}
+	if t.Version > u.manifestVersion {
+		if err := saveManifestVersion(u.opts.StateDir, t.Version); err != nil {
+			return nil, err
+		}
+		u.manifestVersion = t.Version
+	}
+
+	return s, nil
+}
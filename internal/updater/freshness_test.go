@@ -0,0 +1,103 @@
+package updater_test
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+
+	"nametag/internal/imagestore"
+	"nametag/internal/updater"
+)
+
+func Test_Freshness(t *testing.T) {
+	const seen = 100
+
+	revoked := `{"versions": [{"version": "2.0.0"}]}`
+	manifest := func(t *testing.T, version int64, expiresAt time.Time) *imagestore.Manifest {
+		m := &imagestore.Manifest{}
+		assert.Nil(t, json.Unmarshal([]byte(signManifest(t, fmt.Sprintf(`{
+			"releases": [{"version": "2.0.0", "channel": "stable"}, {"version": "1.1.0", "channel": "stable"}],
+			"revoked": %s
+		}`, signedDocument(t, revoked)))), m), "Unmarshal")
+
+		stampManifest(t, testSigner{}, m, version, expiresAt)
+		return m
+	}
+
+	tests := []struct {
+		name   string
+		m      func(t *testing.T) *imagestore.Manifest
+		fresh  bool
+		stored int64
+	}{
+		{"fresh", func(t *testing.T) *imagestore.Manifest {
+			return manifest(t, seen+1, time.Now().Add(time.Hour))
+		}, true, seen + 1},
+		{"same version", func(t *testing.T) *imagestore.Manifest {
+			return manifest(t, seen, time.Now().Add(time.Hour))
+		}, true, seen},
+		{"expired within skew", func(t *testing.T) *imagestore.Manifest {
+			return manifest(t, seen, time.Now().Add(-time.Minute))
+		}, true, seen},
+		{"expired", func(t *testing.T) *imagestore.Manifest {
+			return manifest(t, seen+1, time.Now().Add(-updater.DefaultClockSkew-time.Minute))
+		}, false, seen},
+		{"lower version", func(t *testing.T) *imagestore.Manifest {
+			return manifest(t, seen-1, time.Now().Add(time.Hour))
+		}, false, seen},
+		{"no timestamp", func(t *testing.T) *imagestore.Manifest {
+			m := manifest(t, seen+1, time.Now().Add(time.Hour))
+			m.Timestamp = nil
+			return m
+		}, false, seen},
+		{"stripped revocations", func(t *testing.T) *imagestore.Manifest {
+			m := manifest(t, seen+1, time.Now().Add(time.Hour))
+			m.Revoked = nil
+			return m
+		}, false, seen},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			stateDir := t.TempDir()
+			assert.Nil(t, os.WriteFile(filepath.Join(stateDir, "manifest-version"), []byte(fmt.Sprint(seen)), 0644))
+
+			b, err := json.Marshal(tt.m(t))
+			assert.Nil(t, err, "Marshal")
+
+			u := newRawTestUpdater(t, string(b), updater.WithStateDir(stateDir))
+
+			var got updater.HookInfo
+			u.AddHook(updater.StageBeforeDownload, time.Second, func(_ context.Context, info updater.HookInfo) error {
+				got = info
+				return updater.ErrVeto
+			})
+			success, err := u.CheckOnce()
+			assert.False(t, success)
+
+			if tt.fresh {
+				// the revoked 2.0.0 is never offered
+				assert.Nil(t, err, "CheckOnce")
+				if assert.NotNil(t, got.NewVersion, "update") {
+					assert.Equal(t, "1.1.0", got.NewVersion.String())
+				}
+			} else {
+				assert.Nil(t, got.NewVersion, "update")
+				if assert.NotNil(t, err, "CheckOnce") {
+					assert.Contains(t, err.Error(), updater.FreshnessError.Error())
+				}
+			}
+
+			stored, err := os.ReadFile(filepath.Join(stateDir, "manifest-version"))
+			assert.Nil(t, err, "ReadFile")
+			assert.Equal(t, fmt.Sprint(tt.stored), strings.TrimSpace(string(stored)), "stored version")
+		})
+	}
+}
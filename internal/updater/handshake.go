@@ -0,0 +1,175 @@
+package updater
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"fmt"
+	"os"
+	"os/exec"
+	"strconv"
+	"sync"
+
+	"github.com/hashicorp/go-version"
+	"github.com/pkg/errors"
+)
+
+// EnvReadyFD is the number of the inherited file descriptor
+// where the new process writes the ReadyMessage.
+const EnvReadyFD = "NAMETAG_READY_FD"
+
+// ReadyMessage is sent by the new process when it's listening and ready.
+type ReadyMessage struct {
+	Version string `json:"version"`
+	Pid     int    `json:"pid"`
+}
+
+// CommandPreparer passes something to the new process, like the inherited listeners.
+// The health checkers may implement it too.
+type CommandPreparer interface {
+	// PrepareCommand is called before the start of the command.
+	// cleanup is called after the start.
+	PrepareCommand(c *exec.Cmd) (cleanup func(), err error)
+}
+
+// VersionExpecter is the health checker which checks the version of the new process.
+// ExpectVersion is called before the start with the version which is installed.
+type VersionExpecter interface {
+	ExpectVersion(v *version.Version)
+}
+
+// Handshake is the readiness handshake over the inherited pipe.
+// The parent waits for the ReadyMessage from the child (see NotifyReady)
+// and only then stops serving. The child which still runs the old binary is unhealthy.
+type Handshake struct {
+	mx      sync.Mutex
+	r       *os.File
+	version *version.Version
+}
+
+func NewHandshake() *Handshake {
+	return &Handshake{}
+}
+
+// ExpectVersion implements VersionExpecter.
+func (h *Handshake) ExpectVersion(v *version.Version) {
+	h.mx.Lock()
+	defer h.mx.Unlock()
+
+	h.version = v
+}
+
+// PrepareCommand implements CommandPreparer.
+// It passes the write end of the pipe to the new process.
+func (h *Handshake) PrepareCommand(c *exec.Cmd) (func(), error) {
+	r, w, err := os.Pipe()
+	if err != nil {
+		return nil, errors.Wrap(err, "handshake pipe")
+	}
+
+	h.mx.Lock()
+	if h.r != nil {
+		_ = h.r.Close()
+	}
+	h.r = r
+	h.mx.Unlock()
+
+	// the extra files start from fd 3 after stdin, stdout and stderr
+	fd := 3 + len(c.ExtraFiles)
+	c.ExtraFiles = append(c.ExtraFiles, w)
+	if c.Env == nil {
+		c.Env = os.Environ()
+	}
+	c.Env = append(c.Env, fmt.Sprintf("%s=%d", EnvReadyFD, fd))
+
+	// the parent's copy of the write end must be closed,
+	// otherwise the read doesn't get EOF when the child exits
+	return func() { _ = w.Close() }, nil
+}
+
+// WaitHealthy implements HealthChecker.
+func (h *Handshake) WaitHealthy(ctx context.Context, pid int) error {
+	h.mx.Lock()
+	r, expected := h.r, h.version
+	h.r = nil
+	h.mx.Unlock()
+
+	if r == nil {
+		return errors.Errorf("handshake is not prepared")
+	}
+	defer r.Close()
+
+	result := make(chan error, 1)
+	go func() {
+		line, err := bufio.NewReader(r).ReadBytes('\n')
+		if err != nil {
+			result <- errors.Wrap(err, "handshake read")
+			return
+		}
+
+		msg := &ReadyMessage{}
+		if err := json.Unmarshal(line, msg); err != nil {
+			result <- errors.Wrap(err, "handshake message")
+			return
+		}
+
+		if msg.Pid != pid {
+			result <- errors.Errorf("handshake from pid %d, expected %d", msg.Pid, pid)
+			return
+		}
+
+		if expected != nil {
+			v, err := version.NewVersion(msg.Version)
+			if err != nil {
+				result <- errors.Wrapf(err, "handshake version %q", msg.Version)
+				return
+			}
+			if !v.Equal(expected) {
+				result <- errors.Errorf("handshake from version %s, expected %s", v, expected)
+				return
+			}
+		}
+
+		result <- nil
+	}()
+
+	select {
+	case err := <-result:
+		return err
+	case <-ctx.Done():
+		// unblock the reader
+		_ = r.Close()
+		return errors.Wrap(ctx.Err(), "handshake")
+	}
+}
+
+// NotifyReady tells the parent process that the new version is listening and ready.
+// It must be called by the app after it starts listening.
+// It does nothing if the process is not started by the updater with the Handshake.
+func NotifyReady(version string) error {
+	s, ok := os.LookupEnv(EnvReadyFD)
+	if !ok {
+		return nil
+	}
+	// the next version gets its own descriptor
+	_ = os.Unsetenv(EnvReadyFD)
+
+	fd, err := strconv.Atoi(s)
+	if err != nil {
+		return errors.Wrap(err, EnvReadyFD)
+	}
+
+	f := os.NewFile(uintptr(fd), "ready")
+	if f == nil {
+		return errors.Errorf("%s: bad file descriptor %d", EnvReadyFD, fd)
+	}
+	defer f.Close()
+
+	b, err := json.Marshal(ReadyMessage{Version: version, Pid: os.Getpid()})
+	if err != nil {
+		return err
+	}
+
+	_, err = f.Write(append(b, '\n'))
+	return errors.Wrap(err, "notify ready")
+}
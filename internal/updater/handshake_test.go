@@ -0,0 +1,57 @@
+package updater_test
+
+import (
+	"context"
+	"os"
+	"os/exec"
+	"testing"
+	"time"
+
+	"github.com/hashicorp/go-version"
+	"github.com/stretchr/testify/assert"
+
+	"nametag/internal/updater"
+)
+
+// Test_HandshakeHelper is the child process of Test_Handshake
+func Test_HandshakeHelper(t *testing.T) {
+	switch os.Getenv("NAMETAG_TEST_HELPER") {
+	case "ready":
+		assert.Nil(t, updater.NotifyReady("v1.0.0"))
+	case "silent":
+		time.Sleep(time.Second)
+	}
+}
+
+func runHandshake(t *testing.T, mode string, timeout time.Duration, expected string) error {
+	h := updater.NewHandshake()
+	if expected != "" {
+		v, err := version.NewVersion(expected)
+		assert.Nil(t, err, "NewVersion")
+		h.ExpectVersion(v)
+	}
+
+	c := exec.Command(os.Args[0], "-test.run=Test_HandshakeHelper")
+	c.Env = append(os.Environ(), "NAMETAG_TEST_HELPER="+mode)
+
+	cleanup, err := h.PrepareCommand(c)
+	assert.Nil(t, err, "PrepareCommand")
+	assert.Nil(t, c.Start(), "Start")
+	cleanup()
+	defer func() {
+		_ = c.Process.Kill()
+		_ = c.Wait()
+	}()
+
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+
+	return h.WaitHealthy(ctx, c.Process.Pid)
+}
+
+func Test_Handshake(t *testing.T) {
+	assert.Nil(t, runHandshake(t, "ready", 10*time.Second, ""), "ready")
+	assert.NotNil(t, runHandshake(t, "silent", 200*time.Millisecond, ""), "no message")
+	assert.Nil(t, runHandshake(t, "ready", 10*time.Second, "1.0.0"), "new version")
+	assert.NotNil(t, runHandshake(t, "ready", 10*time.Second, "2.0.0"), "the old binary")
+}
@@ -0,0 +1,145 @@
+package updater
+
+import (
+	"context"
+	"net/http"
+	"os"
+	"strconv"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+const (
+	// DefaultHealthCheckTimeout is the time for the new process to become healthy.
+	DefaultHealthCheckTimeout = 30 * time.Second
+
+	// DefaultHealthCheckInterval is the pause between the http probes.
+	DefaultHealthCheckInterval = 500 * time.Millisecond
+
+	// PidHeader is set by the app to the pid of the process which handles the request.
+	// With SO_REUSEPORT the probe can reach the old process, such responses are skipped.
+	PidHeader = "X-Nametag-Pid"
+)
+
+var HealthCheckError = errors.Errorf("health check error")
+
+// HealthChecker checks that the new process is started successfully.
+type HealthChecker interface {
+	// WaitHealthy blocks until the process is healthy.
+	// It returns an error if ctx is done before that.
+	WaitHealthy(ctx context.Context, pid int) error
+}
+
+// HTTPHealthCheck polls the URL until it returns 2xx from the new process.
+type HTTPHealthCheck struct {
+	URL      string
+	Client   *http.Client
+	Interval time.Duration
+}
+
+func NewHTTPHealthCheck(url string) *HTTPHealthCheck {
+	return &HTTPHealthCheck{
+		URL:      url,
+		Client:   &http.Client{Timeout: DefaultHealthCheckInterval * 4},
+		Interval: DefaultHealthCheckInterval,
+	}
+}
+
+// WaitHealthy implements HealthChecker.
+func (h *HTTPHealthCheck) WaitHealthy(ctx context.Context, pid int) error {
+	t := time.NewTicker(h.Interval)
+	defer t.Stop()
+
+	var lastErr error
+	for {
+		if lastErr = h.probe(ctx, pid); lastErr == nil {
+			return nil
+		}
+
+		select {
+		case <-ctx.Done():
+			return errors.Wrapf(lastErr, "%s", ctx.Err())
+		case <-t.C:
+		}
+	}
+}
+
+func (h *HTTPHealthCheck) probe(ctx context.Context, pid int) error {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, h.URL, nil)
+	if err != nil {
+		return err
+	}
+	// don't reuse the connection to the old process
+	req.Close = true
+
+	resp, err := h.Client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return errors.Errorf("health check status %d", resp.StatusCode)
+	}
+
+	if s := resp.Header.Get(PidHeader); s != "" && s != strconv.Itoa(pid) {
+		return errors.Errorf("health check is handled by pid %s, not %d", s, pid)
+	}
+
+	return nil
+}
+
+// waitHealthy waits for the started process to become healthy.
+// It fails at once if the process exits.
+func (u *Updater) waitHealthy(p *os.Process, exited <-chan error) error {
+	ctx, cancel := context.WithTimeout(context.Background(), u.opts.HealthCheckTimeout)
+	defer cancel()
+
+	healthy := make(chan error, 1)
+	go func() {
+		healthy <- u.opts.HealthCheck.WaitHealthy(ctx, p.Pid)
+	}()
+
+	select {
+	case err := <-healthy:
+		return err
+	case err := <-exited:
+		if err == nil {
+			return errors.Errorf("process %d exited", p.Pid)
+		}
+		return errors.Wrapf(err, "process %d exited", p.Pid)
+	}
+}
+
+// rollback stops the unhealthy process and restores the previous binary.
+// The current process is the previous version, so it just keeps working.
+func (u *Updater) rollback(p *os.Process, exited <-chan error) error {
+	if err := p.Kill(); err != nil && !errors.Is(err, os.ErrProcessDone) {
+		u.log.Errorf("kill unhealthy process %d: %s", p.Pid, err.Error())
+	}
+	<-exited
+
+	return u.restorePrevious()
+}
+
+// notStarted restores the previous binary if the new process can't be started,
+// e.g. the new binary has the wrong format.
+func (u *Updater) notStarted(err error) error {
+	u.log.Errorf("new process is not started: %s", err.Error())
+	if rerr := u.restorePrevious(); rerr != nil {
+		return errors.Wrapf(rerr, "%s", err)
+	}
+
+	return err
+}
+
+// restorePrevious puts the previous binary back after the update is applied.
+func (u *Updater) restorePrevious() error {
+	if err := os.Rename(u.opts.OldSavePath, u.opts.ExecPath); err != nil {
+		return errors.Wrap(err, "restore previous version")
+	}
+
+	u.log.Infof("previous version %s is restored", u.currentVersion)
+	return nil
+}
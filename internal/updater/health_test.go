@@ -0,0 +1,173 @@
+package updater_test
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/base64"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+
+	"nametag/internal/lg"
+	"nametag/internal/updater"
+)
+
+func Test_HTTPHealthCheck(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set(updater.PidHeader, "42")
+		w.WriteHeader(http.StatusOK)
+	}))
+	defer srv.Close()
+
+	h := updater.NewHTTPHealthCheck(srv.URL)
+	h.Interval = 10 * time.Millisecond
+
+	assert.Nil(t, h.WaitHealthy(context.Background(), 42), "healthy")
+
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+	assert.NotNil(t, h.WaitHealthy(ctx, 43), "response from the other process")
+}
+
+func Test_HealthRollback(t *testing.T) {
+	// the health check of the new process never passes
+	unhealthy := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}))
+	defer unhealthy.Close()
+
+	tests := []struct {
+		name   string
+		script string
+	}{
+		{"exits", "#!/bin/sh\nexit 1\n"},
+		{"unhealthy", "#!/bin/sh\nexec sleep 10\n"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			sum := sha256.Sum256([]byte(tt.script))
+			manifest := signManifest(t, fmt.Sprintf(`{"releases": [{"version": "2.0.0", "channel": "stable", "uri": "/data/app.v2.0.0",
+				"size": %d, "file_sum": %q}]}`, len(tt.script), base64.URLEncoding.EncodeToString(sum[:])))
+
+			mx := sync.Mutex{}
+			downloads := 0
+			srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				if r.URL.Path == "/data/app.v2.0.0" {
+					mx.Lock()
+					downloads++
+					mx.Unlock()
+
+					_, _ = w.Write([]byte(tt.script))
+					return
+				}
+				_, _ = w.Write([]byte(manifest))
+			}))
+			defer srv.Close()
+
+			dir := t.TempDir()
+			execPath := filepath.Join(dir, "app")
+			assert.Nil(t, os.WriteFile(execPath, []byte("app.v1.0.0"), 0755), "WriteFile")
+
+			log, err := lg.New(filepath.Join(dir, "test.log"), "v1.0.0")
+			assert.Nil(t, err, "lg.New")
+
+			h := updater.NewHTTPHealthCheck(unhealthy.URL)
+			h.Interval = 10 * time.Millisecond
+
+			u, err := updater.New(log, okVerifier{}, "v1.0.0",
+				updater.WithCheckURL(srv.URL),
+				updater.WithStateDir(dir),
+				updater.WithTempDir(dir),
+				updater.WithExecPath(execPath),
+				updater.WithOldSavePath(execPath+".previous"),
+				updater.WithArgs(execPath),
+				updater.WithHealthCheck(h, 300*time.Millisecond),
+			)
+			assert.Nil(t, err, "updater.New")
+
+			success, err := u.CheckOnce()
+			assert.False(t, success)
+			assert.ErrorIs(t, err, updater.RunError)
+
+			// the next check doesn't install the version again
+			success, err = u.CheckOnce()
+			assert.False(t, success)
+			assert.Nil(t, err, "CheckOnce")
+
+			current, err := os.ReadFile(execPath)
+			assert.Nil(t, err, "ReadFile")
+			assert.Equal(t, "app.v1.0.0", string(current), "the previous binary is restored")
+			assert.NoFileExists(t, execPath+".previous")
+
+			mx.Lock()
+			defer mx.Unlock()
+			assert.Equal(t, 1, downloads, "the failed version is skipped")
+		})
+	}
+}
+
+func Test_NotStartedRollback(t *testing.T) {
+	// the new binary can't be executed
+	image := "not an executable"
+	sum := sha256.Sum256([]byte(image))
+	manifest := signManifest(t, fmt.Sprintf(`{"releases": [{"version": "2.0.0", "channel": "stable", "uri": "/data/app.v2.0.0",
+		"size": %d, "file_sum": %q}]}`, len(image), base64.URLEncoding.EncodeToString(sum[:])))
+
+	mx := sync.Mutex{}
+	downloads := 0
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/data/app.v2.0.0" {
+			mx.Lock()
+			downloads++
+			mx.Unlock()
+
+			_, _ = w.Write([]byte(image))
+			return
+		}
+		_, _ = w.Write([]byte(manifest))
+	}))
+	defer srv.Close()
+
+	dir := t.TempDir()
+	execPath := filepath.Join(dir, "app")
+	assert.Nil(t, os.WriteFile(execPath, []byte("app.v1.0.0"), 0755), "WriteFile")
+
+	log, err := lg.New(filepath.Join(dir, "test.log"), "v1.0.0")
+	assert.Nil(t, err, "lg.New")
+
+	u, err := updater.New(log, okVerifier{}, "v1.0.0",
+		updater.WithCheckURL(srv.URL),
+		updater.WithStateDir(dir),
+		updater.WithTempDir(dir),
+		updater.WithExecPath(execPath),
+		updater.WithOldSavePath(execPath+".previous"),
+		updater.WithArgs(execPath),
+	)
+	assert.Nil(t, err, "updater.New")
+
+	success, err := u.CheckOnce()
+	assert.False(t, success)
+	assert.ErrorIs(t, err, updater.RunError)
+
+	// the next check doesn't install the version again
+	success, err = u.CheckOnce()
+	assert.False(t, success)
+	assert.Nil(t, err, "CheckOnce")
+
+	current, err := os.ReadFile(execPath)
+	assert.Nil(t, err, "ReadFile")
+	assert.Equal(t, "app.v1.0.0", string(current), "the previous binary is restored")
+	assert.NoFileExists(t, execPath+".previous")
+
+	mx.Lock()
+	defer mx.Unlock()
+	assert.Equal(t, 1, downloads, "the failed version is skipped")
+}
@@ -0,0 +1,176 @@
+package updater_test
+
+import (
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+
+	"nametag/internal/imagestore"
+	"nametag/internal/lg"
+	"nametag/internal/signature/sign"
+	"nametag/internal/updater"
+)
+
+// okVerifier accepts any signature of any key.
+type okVerifier struct{}
+
+func (okVerifier) Verify(_, keyID, _, _ string) (string, error) {
+	return keyID, nil
+}
+
+// testSigner signs for okVerifier.
+type testSigner struct{}
+
+func (testSigner) Sign(b []byte) ([]byte, []byte, error) {
+	sum := sha256.Sum256(b)
+	return sum[:], []byte("sign"), nil
+}
+
+func (testSigner) KeyID() string {
+	return "test"
+}
+
+func (testSigner) Alg() string {
+	return "test"
+}
+
+// signManifest signs the releases of the json manifest like the image server.
+// The empty sizes and sums are filled, the tests don't download the images.
+// The empty platform is the platform of the test, the updater doesn't install the builds without it.
+func signManifest(t *testing.T, manifest string) string {
+	return signManifestBy(t, testSigner{}, manifest)
+}
+
+func signManifestBy(t *testing.T, s imagestore.Signer, manifest string) string {
+	m := &imagestore.Manifest{}
+	assert.Nil(t, json.Unmarshal([]byte(manifest), m), "Unmarshal manifest")
+
+	for _, im := range m.Releases {
+		r := &imagestore.Release{
+			Version:     im.Version,
+			Channel:     im.Channel,
+			Platform:    im.Platform,
+			Uri:         im.Uri,
+			Compression: im.Compression,
+			Size:        im.Size,
+			FileSum:     im.FileSum,
+			Critical:    im.Critical,
+			Patches:     im.Patches,
+			ExpiresAt:   time.Now().Add(time.Hour),
+		}
+		if r.Size == 0 {
+			r.Size = 1
+		}
+		if r.Platform == "" {
+			r.Platform = updater.DefaultPlatform().String()
+		}
+		if r.FileSum == "" {
+			r.FileSum = base64.URLEncoding.EncodeToString([]byte("sum"))
+		}
+
+		signed, err := imagestore.NewSigned(s, r)
+		assert.Nil(t, err, "NewSigned")
+		im.Release = signed
+	}
+
+	stampManifest(t, s, m, time.Now().Unix(), time.Now().Add(time.Hour))
+
+	b, err := json.Marshal(m)
+	assert.Nil(t, err, "Marshal manifest")
+
+	return string(b)
+}
+
+// stampManifest adds the signed timestamp which pins the documents of the manifest.
+func stampManifest(t *testing.T, s imagestore.Signer, m *imagestore.Manifest, version int64, expiresAt time.Time) {
+	ts := &imagestore.Timestamp{
+		Version:   version,
+		IssuedAt:  expiresAt.Add(-time.Hour),
+		ExpiresAt: expiresAt,
+	}
+	if m.Rollback != nil {
+		ts.Rollback = m.Rollback.FileSum
+	}
+	if m.Revoked != nil {
+		ts.Revoked = m.Revoked.FileSum
+	}
+	if m.Snapshot != nil {
+		ts.Snapshot = m.Snapshot.FileSum
+	}
+
+	signed, err := imagestore.NewSigned(s, ts)
+	assert.Nil(t, err, "NewSigned timestamp")
+	m.Timestamp = signed
+}
+
+// newTestUpdater returns the updater of v1.0.0 for the server with the manifest, the releases are signed.
+func newTestUpdater(t *testing.T, manifest string, options ...updater.Option) *updater.Updater {
+	return newRawTestUpdater(t, signManifest(t, manifest), options...)
+}
+
+// newRawTestUpdater returns the updater for the server with the manifest as is.
+func newRawTestUpdater(t *testing.T, manifest string, options ...updater.Option) *updater.Updater {
+	return newVerifiedTestUpdater(t, okVerifier{}, manifest, options...)
+}
+
+// newVerifiedTestUpdater returns the updater which checks the signatures with ver.
+func newVerifiedTestUpdater(t *testing.T, ver updater.Verifier, manifest string, options ...updater.Option) *updater.Updater {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_, _ = w.Write([]byte(manifest))
+	}))
+	t.Cleanup(srv.Close)
+
+	log, err := lg.New(filepath.Join(t.TempDir(), "test.log"), "v1.0.0")
+	assert.Nil(t, err, "lg.New")
+
+	options = append([]updater.Option{
+		updater.WithCheckURL(srv.URL),
+		updater.WithStateDir(t.TempDir()),
+		updater.WithInitialSplay(0),
+	}, options...)
+
+	u, err := updater.New(log, ver, "v1.0.0", options...)
+	assert.Nil(t, err, "updater.New")
+
+	return u
+}
+
+// signedDocument returns the json of imagestore.Signed with the payload, okVerifier accepts any signature.
+func signedDocument(t *testing.T, payload string) string {
+	sum := sha256.Sum256([]byte(payload))
+
+	b, err := json.Marshal(map[string]string{
+		"payload":  base64.URLEncoding.EncodeToString([]byte(payload)),
+		"file_sum": base64.URLEncoding.EncodeToString(sum[:]),
+		"sign":     "sign",
+	})
+	assert.Nil(t, err, "Marshal")
+
+	return string(b)
+}
+
+// newEd25519Signer returns the signer of the new generated Ed25519 key.
+func newEd25519Signer(t *testing.T) sign.Signer {
+	_, key, err := ed25519.GenerateKey(rand.Reader)
+	assert.Nil(t, err, "GenerateKey")
+	der, err := x509.MarshalPKCS8PrivateKey(key)
+	assert.Nil(t, err, "MarshalPKCS8PrivateKey")
+
+	keyFile := filepath.Join(t.TempDir(), "key")
+	assert.Nil(t, os.WriteFile(keyFile, der, 0600), "WriteFile")
+
+	s, err := sign.Load(keyFile, "")
+	assert.Nil(t, err, "sign.Load")
+	return s
+}
@@ -0,0 +1,173 @@
+package updater
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/hashicorp/go-version"
+	"github.com/pkg/errors"
+
+	"nametag/internal/imagestore"
+)
+
+// Stage is the moment of the update when the hooks are called.
+type Stage string
+
+const (
+	StageBeforeDownload     Stage = "before_download"
+	StageBeforeApply        Stage = "before_apply"
+	StageAfterApply         Stage = "after_apply"
+	StageBeforeRestart      Stage = "before_restart"
+	StageAfterRestartFailed Stage = "after_restart_failed"
+)
+
+// DefaultHookTimeout is used for the hooks without the timeout.
+const DefaultHookTimeout = 30 * time.Second
+
+var (
+	HookError = errors.Errorf("hook error")
+
+	// ErrVeto is returned by a hook to refuse the new version,
+	// it's not installed again by this process.
+	ErrVeto = errors.Errorf("update is vetoed")
+)
+
+// PostponeError is returned by a hook to retry the update later.
+type PostponeError struct {
+	Delay time.Duration
+}
+
+func (e *PostponeError) Error() string {
+	return fmt.Sprintf("update is postponed for %s", e.Delay)
+}
+
+// Postpone returns the error for a hook to retry the update after the delay.
+func Postpone(delay time.Duration) error {
+	return &PostponeError{Delay: delay}
+}
+
+// HookInfo describes the update for the hook.
+type HookInfo struct {
+	Stage          Stage
+	CurrentVersion *version.Version
+	NewVersion     *version.Version
+
+	// Critical is set by the server for the security releases,
+	// they are applied outside the maintenance windows too
+	Critical bool
+
+	// Rollback is set for the downgrade by the signed rollback directive
+	// or from the revoked version, it's applied outside the maintenance windows too
+	Rollback bool
+
+	// Revoked is set if the current version is revoked, the update is mandatory
+	// and it's applied outside the maintenance windows too
+	Revoked bool
+
+	// Err is the error of the restart for StageAfterRestartFailed
+	Err error
+}
+
+// HookFunc is called at the stage of the update.
+// It returns nil to continue, ErrVeto to refuse the new version,
+// Postpone(d) to retry later. Any other error or the timeout stops the update,
+// it's retried with the backoff.
+// The errors of StageAfterApply and StageBeforeRestart restore the previous binary,
+// the errors of StageAfterRestartFailed are only logged.
+// ctx is done after the timeout of the hook.
+type HookFunc func(ctx context.Context, info HookInfo) error
+
+type hook struct {
+	stage   Stage
+	timeout time.Duration
+	f       HookFunc
+}
+
+// hookError is returned by runHooks to stop the update.
+type hookError struct {
+	stage Stage
+	err   error
+}
+
+func (e *hookError) Error() string {
+	return fmt.Sprintf("%s: %s hook: %s", HookError, e.stage, e.err)
+}
+
+func (e *hookError) Unwrap() []error {
+	return []error{HookError, e.err}
+}
+
+// AddHook adds the hook for the stage of the update.
+// It must be called before Check.
+func (u *Updater) AddHook(stage Stage, timeout time.Duration, f HookFunc) {
+	if timeout <= 0 {
+		timeout = DefaultHookTimeout
+	}
+
+	u.hooks = append(u.hooks, hook{stage: stage, timeout: timeout, f: f})
+}
+
+func (u *Updater) hookInfo(im *imagestore.Image) HookInfo {
+	return HookInfo{
+		CurrentVersion: u.currentVersion,
+		NewVersion:     im.Version,
+		Critical:       im.Critical,
+		Rollback:       im.Version.LessThan(u.currentVersion),
+		Revoked:        u.Status().Revoked,
+	}
+}
+
+// runHooks calls the hooks of the stage in order of adding.
+// The first error stops the update.
+func (u *Updater) runHooks(stage Stage, info HookInfo) error {
+	info.Stage = stage
+
+	for _, h := range u.hooks {
+		if h.stage != stage {
+			continue
+		}
+
+		if err := h.run(info); err != nil {
+			return &hookError{stage: stage, err: err}
+		}
+	}
+
+	return nil
+}
+
+// run calls the hook with the timeout, even if the hook ignores ctx.
+func (h hook) run(info HookInfo) error {
+	ctx, cancel := context.WithTimeout(context.Background(), h.timeout)
+	defer cancel()
+
+	result := make(chan error, 1)
+	go func() {
+		result <- h.f(ctx, info)
+	}()
+
+	select {
+	case err := <-result:
+		return err
+	case <-ctx.Done():
+		return errors.Wrapf(ctx.Err(), "timeout %s", h.timeout)
+	}
+}
+
+// hookStopped handles the error of the hook which stops the update of the version.
+// It returns nil for the veto, the check is not failed.
+func (u *Updater) hookStopped(v *version.Version, err error) error {
+	u.log.Infof("update to %s is stopped: %s", v, err.Error())
+
+	if errors.Is(err, ErrVeto) {
+		u.skipVersion(v)
+		return nil
+	}
+
+	postpone := &PostponeError{}
+	if errors.As(err, &postpone) {
+		u.setMinDelay(postpone.Delay)
+	}
+
+	return err
+}
@@ -0,0 +1,113 @@
+package updater_test
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/base64"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+
+	"nametag/internal/updater"
+)
+
+func Test_Hooks_Veto(t *testing.T) {
+	u := newTestUpdater(t, `{"releases": [{"version": "2.0.0", "channel": "stable", "uri": "/data/app.v2.0.0"}]}`)
+
+	mx := sync.Mutex{}
+	calls := make([]updater.HookInfo, 0)
+	u.AddHook(updater.StageBeforeDownload, time.Second, func(ctx context.Context, info updater.HookInfo) error {
+		mx.Lock()
+		defer mx.Unlock()
+
+		calls = append(calls, info)
+		return updater.ErrVeto
+	})
+	u.AddHook(updater.StageBeforeApply, time.Second, func(ctx context.Context, info updater.HookInfo) error {
+		t.Error("the update is vetoed before the download")
+		return nil
+	})
+
+	for i := 0; i < 2; i++ {
+		success, err := u.CheckOnce()
+		assert.False(t, success)
+		assert.Nil(t, err, "the veto doesn't fail the check")
+	}
+
+	mx.Lock()
+	defer mx.Unlock()
+
+	// the vetoed version is not offered again
+	if assert.Len(t, calls, 1) {
+		assert.Equal(t, updater.StageBeforeDownload, calls[0].Stage)
+		assert.Equal(t, "2.0.0", calls[0].NewVersion.String())
+		assert.Equal(t, "1.0.0", calls[0].CurrentVersion.String())
+	}
+}
+
+func Test_Hooks_Postpone(t *testing.T) {
+	err := updater.Postpone(time.Hour)
+
+	postpone := &updater.PostponeError{}
+	assert.ErrorAs(t, err, &postpone)
+	assert.Equal(t, time.Hour, postpone.Delay)
+}
+
+func Test_Hooks_Staging(t *testing.T) {
+	data := []byte("app.v2.0.0")
+	sum := sha256.Sum256(data)
+	manifest := signManifest(t, fmt.Sprintf(`{"releases": [{"version": "2.0.0", "channel": "stable", "uri": "/data/app.v2.0.0",
+		"size": %d, "file_sum": %q}]}`, len(data), base64.URLEncoding.EncodeToString(sum[:])))
+
+	tests := []struct {
+		name   string
+		err    error
+		staged int
+	}{
+		{"veto", updater.ErrVeto, 0},
+		{"postpone", updater.Postpone(time.Hour), 1},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				if r.URL.Path == "/data/app.v2.0.0" {
+					_, _ = w.Write(data)
+					return
+				}
+				_, _ = w.Write([]byte(manifest))
+			}))
+			defer srv.Close()
+
+			dir := t.TempDir()
+			execPath := filepath.Join(dir, "app")
+			assert.Nil(t, os.WriteFile(execPath, []byte("app.v1.0.0"), 0755), "WriteFile")
+
+			u := newVerifiedTestUpdater(t, okVerifier{}, manifest,
+				updater.WithCheckURL(srv.URL),
+				updater.WithTempDir(dir),
+				updater.WithExecPath(execPath),
+				updater.WithOldSavePath(execPath+".previous"),
+			)
+
+			u.AddHook(updater.StageBeforeApply, time.Second, func(context.Context, updater.HookInfo) error {
+				return tt.err
+			})
+			success, err := u.CheckOnce()
+			assert.False(t, success)
+			assert.Equal(t, tt.err == updater.ErrVeto, err == nil, "the postponed update fails the check")
+
+			// the postponed download is applied later without loading it again
+			staged, err := filepath.Glob(filepath.Join(dir, "*.part"))
+			assert.Nil(t, err, "Glob")
+			assert.Len(t, staged, tt.staged)
+		})
+	}
+}
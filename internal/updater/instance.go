@@ -0,0 +1,44 @@
+package updater
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/pkg/errors"
+)
+
+// instanceIDFile is the file in the state directory with the client instance ID.
+const instanceIDFile = "instance-id"
+
+// loadInstanceID reads the instance ID from the state directory.
+// It generates and saves a new random ID at the first start,
+// so the ID is stable across the restarts and updates.
+func loadInstanceID(stateDir string) (string, error) {
+	fileName := filepath.Join(stateDir, instanceIDFile)
+
+	b, err := os.ReadFile(fileName)
+	if err == nil && len(strings.TrimSpace(string(b))) > 0 {
+		return strings.TrimSpace(string(b)), nil
+	}
+	if err != nil && !os.IsNotExist(err) {
+		return "", errors.Wrap(err, "read instance id")
+	}
+
+	rnd := make([]byte, 16)
+	if _, err := rand.Read(rnd); err != nil {
+		return "", errors.Wrap(err, "generate instance id")
+	}
+	id := hex.EncodeToString(rnd)
+
+	if err := os.MkdirAll(stateDir, 0755); err != nil {
+		return "", errors.Wrap(err, "create state dir")
+	}
+	if err := os.WriteFile(fileName, []byte(id+"\n"), 0644); err != nil {
+		return "", errors.Wrap(err, "save instance id")
+	}
+
+	return id, nil
+}
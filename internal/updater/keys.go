@@ -0,0 +1,133 @@
+package updater
+
+import (
+	"encoding/json"
+	"os"
+	"path/filepath"
+
+	"github.com/pkg/errors"
+
+	"nametag/internal/imagestore"
+)
+
+// keysFile is the file in the state directory with the applied key rotation documents.
+// They are applied again at the start, so the new keys survive the restarts.
+const keysFile = "keys.json"
+
+// Keyring is the Verifier with several trusted keys which are rotated
+// by the signed key rotation documents from the manifest, e.g. *verify.Verifier.
+type Keyring interface {
+	Verifier
+
+	// AddKey trusts the public key of the algorithm, keyID must be its id.
+	AddKey(alg, keyID, publicKey string) error
+
+	// VerifyKey checks the signature by the public key which isn't trusted yet.
+	VerifyKey(alg, keyID, publicKey, message, signature string) error
+
+	// RetireKey stops trusting the key.
+	RetireKey(keyID string) error
+}
+
+// rotateKeys applies the new key rotation documents in order, each one must be signed
+// by Options.SignatureThreshold trusted keys and by the new key, so its holder has the private key.
+// It reports whether the keyring is changed.
+// The invalid documents are ignored, the manifest is checked by the current keys.
+// They are tried again later, the document may be signed by the keys of the next root.
+func (u *Updater) rotateKeys(rotations []*imagestore.Signed) bool {
+	keyring, ok := u.verifier.(Keyring)
+	if !ok {
+		return false
+	}
+
+	changed := false
+	for _, s := range rotations {
+		if s == nil {
+			continue
+		}
+		if u.rotated[s.FileSum] {
+			continue
+		}
+
+		if err := u.rotateKey(keyring, s); err != nil {
+			// the document isn't changed, it's reported once
+			if _, reported := u.rotated[s.FileSum]; !reported {
+				u.log.Errorf("ignore key rotation: %s", err.Error())
+			}
+			u.rotated[s.FileSum] = false
+			continue
+		}
+
+		u.rotated[s.FileSum] = true
+		u.rotations = append(u.rotations, s)
+		changed = true
+	}
+
+	return changed
+}
+
+func (u *Updater) rotateKey(keyring Keyring, s *imagestore.Signed) error {
+	r := &imagestore.KeyRotation{}
+	if err := u.openRole(s, imagestore.RoleRoot, u.opts.SignatureThreshold, r); err != nil {
+		return err
+	}
+	if err := r.Check(); err != nil {
+		return err
+	}
+
+	newKey := map[string]imagestore.PublicKey{r.KeyID: {Alg: r.Alg, Key: r.Key}}
+	if err := u.signedByNewKeys(keyring, s, newKey, []string{r.KeyID}, 1); err != nil {
+		return errors.Wrapf(err, "key %s doesn't sign its rotation", r.KeyID)
+	}
+
+	if err := keyring.AddKey(r.Alg, r.KeyID, r.Key); err != nil {
+		return err
+	}
+
+	for _, id := range r.Retire {
+		if err := keyring.RetireKey(id); err != nil {
+			return err
+		}
+	}
+
+	u.log.Infof("key %s is trusted by the key %s, retired keys: %v", r.KeyID, s.KeyID, r.Retire)
+	return nil
+}
+
+// loadKeys applies the key rotation documents saved in the state directory and returns them.
+func (u *Updater) loadKeys() ([]*imagestore.Signed, error) {
+	b, err := os.ReadFile(filepath.Join(u.opts.StateDir, keysFile))
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, errors.Wrap(err, "read keys")
+	}
+
+	rotations := make([]*imagestore.Signed, 0)
+	if err := json.Unmarshal(b, &rotations); err != nil {
+		return nil, errors.Wrap(err, "parse keys")
+	}
+
+	u.rotateKeys(rotations)
+	return rotations, nil
+}
+
+// saveKeys saves the applied key rotation documents to the state directory.
+func (u *Updater) saveKeys() error {
+	b, err := json.Marshal(u.rotations)
+	if err != nil {
+		return errors.Wrap(err, "save keys")
+	}
+
+	if err := os.MkdirAll(u.opts.StateDir, 0755); err != nil {
+		return errors.Wrap(err, "create state dir")
+	}
+
+	fileName := filepath.Join(u.opts.StateDir, keysFile)
+	if err := os.WriteFile(fileName+".tmp", b, 0644); err != nil {
+		return errors.Wrap(err, "save keys")
+	}
+
+	return errors.Wrap(os.Rename(fileName+".tmp", fileName), "save keys")
+}
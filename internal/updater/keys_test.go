@@ -0,0 +1,75 @@
+package updater_test
+
+import (
+	"context"
+	"encoding/json"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+
+	"nametag/internal/imagestore"
+	"nametag/internal/signature/sign"
+	"nametag/internal/signature/verify"
+	"nametag/internal/updater"
+)
+
+func Test_KeyRotation(t *testing.T) {
+	old, err := sign.New()
+	assert.Nil(t, err, "sign.New")
+
+	// the new Ed25519 key replaces the embedded RSA key
+	s := newEd25519Signer(t)
+
+	// the new key is cross-signed by the embedded one which is retired
+	rotation, err := imagestore.NewSigned(old, &imagestore.KeyRotation{KeyID: s.KeyID(), Alg: s.Alg(), Key: s.PublicKey(), Retire: []string{old.KeyID()}})
+	assert.Nil(t, err, "NewSigned")
+	unproven := *rotation
+	assert.Nil(t, rotation.AddSignature(s), "AddSignature")
+
+	manifest := func(rotations ...*imagestore.Signed) string {
+		m := &imagestore.Manifest{}
+		assert.Nil(t, json.Unmarshal([]byte(signManifestBy(t, s, `{"releases": [{"version": "2.0.0", "channel": "stable"}]}`)), m), "Unmarshal")
+		m.Rotations = rotations
+
+		b, err := json.Marshal(m)
+		assert.Nil(t, err, "Marshal")
+		return string(b)
+	}
+
+	check := func(t *testing.T, stateDir, manifest string) string {
+		ver, err := verify.New()
+		assert.Nil(t, err, "verify.New")
+
+		u := newVerifiedTestUpdater(t, ver, manifest, updater.WithStateDir(stateDir))
+
+		var got updater.HookInfo
+		u.AddHook(updater.StageBeforeDownload, time.Second, func(_ context.Context, info updater.HookInfo) error {
+			got = info
+			return updater.ErrVeto
+		})
+		success, err := u.CheckOnce()
+		assert.False(t, success)
+
+		if err != nil {
+			return err.Error()
+		}
+		if got.NewVersion == nil {
+			return ""
+		}
+		return got.NewVersion.String()
+	}
+
+	stateDir := t.TempDir()
+	assert.Contains(t, check(t, stateDir, manifest()), verify.UnknownKeyError.Error(), "the new key isn't trusted yet")
+	assert.Contains(t, check(t, stateDir, manifest(&unproven)), verify.UnknownKeyError.Error(), "not signed by the new key")
+	assert.Equal(t, "2.0.0", check(t, stateDir, manifest(rotation)), "rotated")
+	assert.FileExists(t, filepath.Join(stateDir, "keys.json"))
+	assert.Equal(t, "2.0.0", check(t, stateDir, manifest()), "the new key is trusted after the restart")
+
+	// the key can't trust itself
+	forged, err := imagestore.NewSigned(s, &imagestore.KeyRotation{KeyID: s.KeyID(), Alg: s.Alg(), Key: s.PublicKey()})
+	assert.Nil(t, err, "NewSigned")
+	assert.Contains(t, check(t, t.TempDir(), manifest(forged)), verify.UnknownKeyError.Error(), "not rotated")
+}
@@ -0,0 +1,828 @@
+package updater
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strconv"
+	"time"
+
+	"github.com/pkg/errors"
+
+	"nametag/internal/imagestore"
+)
+
+const (
+	// DefaultCheckURL is the URL to check for updates
+	DefaultCheckURL = "http://127.0.0.1:8080"
+
+	// DefaultScanFrequency specifies how often request new image. For test it's set up to 10 second.
+	DefaultScanFrequency = 10 * time.Second
+
+	// DefaultHTTPTimeout limits a single request to the update server.
+	DefaultHTTPTimeout = 5 * time.Minute
+
+	// DefaultMaxImageSize limits the downloaded and the uncompressed image.
+	DefaultMaxImageSize = 1 << 30
+
+	// DefaultSignatureThreshold is the number of the keys which sign the releases.
+	DefaultSignatureThreshold = 1
+
+	// DefaultClockSkew is the tolerated difference of the clocks of the client and the server.
+	DefaultClockSkew = 5 * time.Minute
+
+	// MinScanFrequency protects the update server from too frequent requests.
+	MinScanFrequency = time.Second
+)
+
+// Environment variables which are read by WithEnv.
+const (
+	EnvCheckURL      = "NAMETAG_CHECK_URL"
+	EnvScanFrequency = "NAMETAG_SCAN_FREQUENCY"
+	EnvHTTPTimeout   = "NAMETAG_HTTP_TIMEOUT"
+	EnvTempDir       = "NAMETAG_TEMP_DIR"
+	EnvExecPath      = "NAMETAG_EXEC_PATH"
+	EnvWorkDir       = "NAMETAG_WORK_DIR"
+	EnvChannel       = "NAMETAG_CHANNEL"
+	EnvStateDir      = "NAMETAG_STATE_DIR"
+	EnvInstanceID    = "NAMETAG_INSTANCE_ID"
+
+	EnvOldSavePath        = "NAMETAG_OLD_SAVE_PATH"
+	EnvHealthCheckURL     = "NAMETAG_HEALTH_CHECK_URL"
+	EnvHealthCheckTimeout = "NAMETAG_HEALTH_CHECK_TIMEOUT"
+	EnvDeltaUpdates       = "NAMETAG_DELTA_UPDATES"
+	EnvInitialSplay       = "NAMETAG_INITIAL_SPLAY"
+
+	// EnvMaintenanceWindows are separated by ";", e.g. "Mon-Fri 22:00-06:00 Europe/Berlin; Sat,Sun 00:00-24:00"
+	EnvMaintenanceWindows = "NAMETAG_MAINTENANCE_WINDOWS"
+
+	// EnvVersionConstraints are in go-version syntax, e.g. "~> 1.4" or ">= 1.2, < 2.0"
+	EnvVersionConstraints = "NAMETAG_VERSION_CONSTRAINTS"
+	EnvPinVersion         = "NAMETAG_PIN_VERSION"
+	EnvSameMajorVersion   = "NAMETAG_SAME_MAJOR_VERSION"
+
+	EnvSignatureThreshold = "NAMETAG_SIGNATURE_THRESHOLD"
+
+	// EnvClockSkew is a duration, e.g. "5m"
+	EnvClockSkew = "NAMETAG_CLOCK_SKEW"
+
+	// EnvMaxImageSize is in bytes
+	EnvMaxImageSize = "NAMETAG_MAX_IMAGE_SIZE"
+
+	// EnvPlatform is "os/arch" or "os/arch/variant", e.g. "linux/amd64/v3"
+	EnvPlatform = "NAMETAG_PLATFORM"
+
+	// EnvConfigFile is not read by WithEnv, it's a conventional name
+	// for the path of the file for WithConfigFile.
+	EnvConfigFile = "NAMETAG_CONFIG"
+)
+
+// Options holds all the knobs of the Updater.
+// Use DefaultOptions to get the sane defaults and Option functions to change them.
+type Options struct {
+	// CheckURL is the URL of the update server
+	CheckURL string
+
+	// ScanFrequency specifies how often request new image.
+	ScanFrequency time.Duration
+
+	// InitialSplay is the upper limit of the random delay before the first check.
+	InitialSplay time.Duration
+
+	// Backoffs after the failed checks for each class of errors. The zero NetBackoff
+	// and CheckVersionBackoff are set by Validate to the defaults for ScanFrequency.
+	NetBackoff          Backoff
+	CheckVersionBackoff Backoff
+	RunBackoff          Backoff
+
+	// HTTPClient is used for all requests to the update server.
+	HTTPClient *http.Client
+
+	// TempDir is the directory for the temporary files (downloads etc).
+	TempDir string
+
+	// ExecPath is the executable file which is replaced and started by the updater.
+	ExecPath string
+
+	// WorkDir is the working directory of the new process.
+	WorkDir string
+
+	// Args are the command line arguments for the new process, including the program name.
+	Args []string
+
+	// Channel is the release channel which the updater follows.
+	Channel string
+
+	// Platform selects the build from the manifest, see DefaultPlatform.
+	Platform imagestore.Platform
+
+	// StateDir is the directory for the files which must survive the updates, like the instance ID.
+	StateDir string
+
+	// InstanceID identifies the client for the staged rollouts.
+	// If it's empty, the random ID is generated once and stored in StateDir.
+	InstanceID string
+
+	// OldSavePath is where the previous binary is kept for the rollback.
+	// It must be on the same file system as ExecPath.
+	OldSavePath string
+
+	// HealthCheck checks the new process after the start, nil means no check.
+	// If the new process doesn't become healthy in HealthCheckTimeout,
+	// it's killed and the previous binary is restored.
+	HealthCheck        HealthChecker
+	HealthCheckTimeout time.Duration
+
+	// SignatureThreshold is the number of the different trusted keys which must sign the releases,
+	// the rollback directive, the revocation list and the key rotations, e.g. 2 for 2 of 3 release keys,
+	// so one stolen key can't push a release or a downgrade. The timestamp and the snapshot are signed by the server.
+	SignatureThreshold int
+
+	// ClockSkew is the tolerated difference of the clocks for the expiry of the signed manifest.
+	ClockSkew time.Duration
+
+	// MaxImageSize limits the downloaded files and the uncompressed image in bytes,
+	// so the broken server or the decompression bomb can't fill the disk.
+	MaxImageSize int64
+
+	// DeltaUpdates enables the binary patches from the current version,
+	// the full image is loaded if there is no suitable patch.
+	DeltaUpdates bool
+
+	// MaintenanceWindows limit when the updates are applied and the process is restarted,
+	// the updates are downloaded at once. Empty means any time.
+	// The critical releases are applied at once.
+	MaintenanceWindows []Window
+
+	// VersionConstraints limit the versions which are installed, in go-version syntax,
+	// e.g. "~> 1.4" or ">= 1.2, < 2.0". Empty means any newer version.
+	// The pre-releases are checked by their release part, 1.5.0-beta.1 as 1.5.0.
+	VersionConstraints string
+
+	// PinVersion is the only version which is installed, empty means no pin.
+	// The pin doesn't downgrade the newer current version.
+	PinVersion string
+
+	// SameMajorVersion forbids crossing the major version of the current process automatically.
+	SameMajorVersion bool
+
+	// OnProgress is called during the download, nil means no callback.
+	// It must not block. The last state is also available by Updater.Progress.
+	OnProgress func(Progress)
+
+	// Listeners passes the open listeners to the new process (see listener.Registry),
+	// nil means the new process binds the address itself, e.g. with SO_REUSEPORT.
+	Listeners CommandPreparer
+}
+
+// Option changes one or more fields of Options.
+type Option func(*Options) error
+
+// DefaultOptions returns the options of the current process.
+func DefaultOptions() (Options, error) {
+	// Get the current process exe file and directory.
+	workDir, err := os.Getwd()
+	if err != nil {
+		return Options{}, err
+	}
+	execPath, err := os.Executable()
+	if err != nil {
+		return Options{}, err
+	}
+
+	args := make([]string, len(os.Args))
+	copy(args, os.Args)
+
+	return Options{
+		CheckURL:      DefaultCheckURL,
+		ScanFrequency: DefaultScanFrequency,
+		InitialSplay:  DefaultScanFrequency,
+		HTTPClient:    &http.Client{Timeout: DefaultHTTPTimeout},
+		TempDir:       os.TempDir(),
+		ExecPath:      execPath,
+		WorkDir:       workDir,
+		Args:          args,
+		Channel:       imagestore.DefaultChannel,
+		Platform:      DefaultPlatform(),
+		StateDir:      filepath.Join(filepath.Dir(execPath), ".nametag"),
+		OldSavePath:   filepath.Join(filepath.Dir(execPath), "."+filepath.Base(execPath)+".previous"),
+
+		HealthCheckTimeout: DefaultHealthCheckTimeout,
+		DeltaUpdates:       true,
+		MaxImageSize:       DefaultMaxImageSize,
+		ClockSkew:          DefaultClockSkew,
+		SignatureThreshold: DefaultSignatureThreshold,
+
+		RunBackoff: DefaultRunBackoff,
+	}, nil
+}
+
+// Validate checks that the options are usable and sets the default backoffs for the scan frequency.
+func (o *Options) Validate() error {
+	u, err := url.Parse(o.CheckURL)
+	if err != nil {
+		return errors.Wrap(err, "check url")
+	}
+	if u.Scheme != "http" && u.Scheme != "https" {
+		return errors.Errorf("check url %q: unsupported scheme %q", o.CheckURL, u.Scheme)
+	}
+	if u.Host == "" {
+		return errors.Errorf("check url %q: empty host", o.CheckURL)
+	}
+
+	if o.ScanFrequency < MinScanFrequency {
+		return errors.Errorf("scan frequency %s is less than %s", o.ScanFrequency, MinScanFrequency)
+	}
+
+	if o.InitialSplay < 0 {
+		return errors.Errorf("initial splay is negative")
+	}
+
+	if o.NetBackoff == (Backoff{}) {
+		o.NetBackoff = DefaultNetBackoff(o.ScanFrequency)
+	}
+	if o.CheckVersionBackoff == (Backoff{}) {
+		o.CheckVersionBackoff = DefaultCheckVersionBackoff(o.ScanFrequency)
+	}
+
+	for name, b := range map[string]Backoff{
+		"net":           o.NetBackoff,
+		"check version": o.CheckVersionBackoff,
+		"run":           o.RunBackoff,
+	} {
+		if err := b.check(); err != nil {
+			return errors.Wrap(err, name)
+		}
+	}
+
+	if o.HTTPClient == nil {
+		return errors.Errorf("http client is nil")
+	}
+
+	if err := checkDir(o.TempDir); err != nil {
+		return errors.Wrap(err, "temp dir")
+	}
+	if err := checkDir(o.WorkDir); err != nil {
+		return errors.Wrap(err, "work dir")
+	}
+
+	if o.ExecPath == "" {
+		return errors.Errorf("exec path is empty")
+	}
+	if len(o.Args) == 0 {
+		return errors.Errorf("args are empty, at least the program name is required")
+	}
+
+	if err := imagestore.CheckChannel(o.Channel); err != nil {
+		return err
+	}
+
+	if o.Platform.IsZero() {
+		return errors.Errorf("platform is empty")
+	}
+
+	if o.StateDir == "" {
+		return errors.Errorf("state dir is empty")
+	}
+
+	if o.OldSavePath == "" || o.OldSavePath == o.ExecPath {
+		return errors.Errorf("old save path %q must differ from exec path", o.OldSavePath)
+	}
+
+	if _, err := o.policy(); err != nil {
+		return err
+	}
+
+	if o.SignatureThreshold < 1 {
+		return errors.Errorf("signature threshold must be positive")
+	}
+
+	if o.ClockSkew < 0 {
+		return errors.Errorf("clock skew is negative")
+	}
+
+	if o.MaxImageSize <= 0 {
+		return errors.Errorf("max image size must be positive")
+	}
+
+	if o.HealthCheck != nil && o.HealthCheckTimeout <= 0 {
+		return errors.Errorf("health check timeout must be positive")
+	}
+
+	return nil
+}
+
+func checkDir(dir string) error {
+	info, err := os.Stat(dir)
+	if err != nil {
+		return err
+	}
+	if !info.IsDir() {
+		return errors.Errorf("%s is not a directory", dir)
+	}
+
+	return nil
+}
+
+// WithCheckURL sets the URL of the update server.
+func WithCheckURL(checkURL string) Option {
+	return func(o *Options) error {
+		o.CheckURL = checkURL
+		return nil
+	}
+}
+
+// WithScanFrequency sets how often the update server is requested.
+func WithScanFrequency(d time.Duration) Option {
+	return func(o *Options) error {
+		o.ScanFrequency = d
+		return nil
+	}
+}
+
+// WithInitialSplay sets the upper limit of the random delay before the first check.
+func WithInitialSplay(d time.Duration) Option {
+	return func(o *Options) error {
+		o.InitialSplay = d
+		return nil
+	}
+}
+
+// WithBackoff sets the backoff for the class of errors: NetError, CheckVersionError or RunError.
+func WithBackoff(class error, b Backoff) Option {
+	return func(o *Options) error {
+		switch class {
+		case NetError:
+			o.NetBackoff = b
+		case CheckVersionError:
+			o.CheckVersionBackoff = b
+		case RunError:
+			o.RunBackoff = b
+		default:
+			return errors.Errorf("unknown error class %v", class)
+		}
+		return nil
+	}
+}
+
+// WithHTTPClient sets the http client for all requests to the update server.
+func WithHTTPClient(c *http.Client) Option {
+	return func(o *Options) error {
+		o.HTTPClient = c
+		return nil
+	}
+}
+
+// WithTempDir sets the directory for the temporary files.
+func WithTempDir(dir string) Option {
+	return func(o *Options) error {
+		o.TempDir = dir
+		return nil
+	}
+}
+
+// WithExecPath sets the executable file which is replaced by the new version.
+func WithExecPath(execPath string) Option {
+	return func(o *Options) error {
+		o.ExecPath = execPath
+		return nil
+	}
+}
+
+// WithWorkDir sets the working directory of the new process.
+func WithWorkDir(dir string) Option {
+	return func(o *Options) error {
+		o.WorkDir = dir
+		return nil
+	}
+}
+
+// WithArgs sets the command line arguments of the new process, including the program name.
+func WithArgs(args ...string) Option {
+	return func(o *Options) error {
+		o.Args = append([]string(nil), args...)
+		return nil
+	}
+}
+
+// WithChannel sets the release channel which the updater follows.
+func WithChannel(channel string) Option {
+	return func(o *Options) error {
+		o.Channel = channel
+		return nil
+	}
+}
+
+// WithPlatform sets the platform of the builds, e.g. "linux/amd64" or "linux/amd64/v3".
+func WithPlatform(platform string) Option {
+	return func(o *Options) error {
+		p, err := imagestore.ParsePlatform(platform)
+		if err != nil {
+			return err
+		}
+		o.Platform = p
+		return nil
+	}
+}
+
+// WithStateDir sets the directory for the files which must survive the updates.
+func WithStateDir(dir string) Option {
+	return func(o *Options) error {
+		o.StateDir = dir
+		return nil
+	}
+}
+
+// WithInstanceID sets the client instance ID instead of the generated one.
+func WithInstanceID(id string) Option {
+	return func(o *Options) error {
+		o.InstanceID = id
+		return nil
+	}
+}
+
+// WithOldSavePath sets where the previous binary is kept for the rollback.
+func WithOldSavePath(oldSavePath string) Option {
+	return func(o *Options) error {
+		o.OldSavePath = oldSavePath
+		return nil
+	}
+}
+
+// WithHealthCheck sets the health check of the new process.
+func WithHealthCheck(h HealthChecker, timeout time.Duration) Option {
+	return func(o *Options) error {
+		o.HealthCheck = h
+		o.HealthCheckTimeout = timeout
+		return nil
+	}
+}
+
+// WithDeltaUpdates enables or disables the binary patches.
+func WithDeltaUpdates(enabled bool) Option {
+	return func(o *Options) error {
+		o.DeltaUpdates = enabled
+		return nil
+	}
+}
+
+// WithSignatureThreshold requires the signatures of n different trusted keys for the releases.
+func WithSignatureThreshold(n int) Option {
+	return func(o *Options) error {
+		o.SignatureThreshold = n
+		return nil
+	}
+}
+
+// WithClockSkew sets the tolerated difference of the clocks.
+func WithClockSkew(d time.Duration) Option {
+	return func(o *Options) error {
+		o.ClockSkew = d
+		return nil
+	}
+}
+
+// WithMaxImageSize limits the downloaded files and the uncompressed image.
+func WithMaxImageSize(size int64) Option {
+	return func(o *Options) error {
+		o.MaxImageSize = size
+		return nil
+	}
+}
+
+// WithMaintenanceWindows sets the windows when the updates are applied, see ParseWindow.
+func WithMaintenanceWindows(windows ...string) Option {
+	return func(o *Options) error {
+		o.MaintenanceWindows = make([]Window, 0, len(windows))
+		for _, s := range windows {
+			w, err := ParseWindow(s)
+			if err != nil {
+				return err
+			}
+			o.MaintenanceWindows = append(o.MaintenanceWindows, w)
+		}
+		return nil
+	}
+}
+
+// WithVersionConstraints limits the versions which are installed, e.g. "~> 1.4" or "< 2.0".
+func WithVersionConstraints(constraints string) Option {
+	return func(o *Options) error {
+		o.VersionConstraints = constraints
+		return nil
+	}
+}
+
+// WithPinVersion pins the updater to the exact version, an empty version removes the pin.
+func WithPinVersion(v string) Option {
+	return func(o *Options) error {
+		o.PinVersion = v
+		return nil
+	}
+}
+
+// WithSameMajorVersion forbids or allows crossing the major version.
+func WithSameMajorVersion(enabled bool) Option {
+	return func(o *Options) error {
+		o.SameMajorVersion = enabled
+		return nil
+	}
+}
+
+// WithProgress sets the callback for the download progress.
+func WithProgress(f func(Progress)) Option {
+	return func(o *Options) error {
+		o.OnProgress = f
+		return nil
+	}
+}
+
+// WithListeners sets the listeners which are passed to the new process.
+func WithListeners(l CommandPreparer) Option {
+	return func(o *Options) error {
+		o.Listeners = l
+		return nil
+	}
+}
+
+// WithEnv reads the options from the environment variables (see Env* constants).
+// Unset variables don't change the options.
+func WithEnv() Option {
+	return func(o *Options) error {
+		if s, ok := os.LookupEnv(EnvCheckURL); ok {
+			o.CheckURL = s
+		}
+		if s, ok := os.LookupEnv(EnvTempDir); ok {
+			o.TempDir = s
+		}
+		if s, ok := os.LookupEnv(EnvExecPath); ok {
+			o.ExecPath = s
+		}
+		if s, ok := os.LookupEnv(EnvWorkDir); ok {
+			o.WorkDir = s
+		}
+		if s, ok := os.LookupEnv(EnvChannel); ok {
+			o.Channel = s
+		}
+		if s, ok := os.LookupEnv(EnvPlatform); ok {
+			if err := WithPlatform(s)(o); err != nil {
+				return errors.Wrap(err, EnvPlatform)
+			}
+		}
+		if s, ok := os.LookupEnv(EnvStateDir); ok {
+			o.StateDir = s
+		}
+		if s, ok := os.LookupEnv(EnvInstanceID); ok {
+			o.InstanceID = s
+		}
+		if s, ok := os.LookupEnv(EnvOldSavePath); ok {
+			o.OldSavePath = s
+		}
+		if s, ok := os.LookupEnv(EnvHealthCheckURL); ok {
+			o.HealthCheck = NewHTTPHealthCheck(s)
+		}
+		if s, ok := os.LookupEnv(EnvHealthCheckTimeout); ok {
+			d, err := time.ParseDuration(s)
+			if err != nil {
+				return errors.Wrap(err, EnvHealthCheckTimeout)
+			}
+			o.HealthCheckTimeout = d
+		}
+		if s, ok := os.LookupEnv(EnvInitialSplay); ok {
+			d, err := time.ParseDuration(s)
+			if err != nil {
+				return errors.Wrap(err, EnvInitialSplay)
+			}
+			o.InitialSplay = d
+		}
+		if s, ok := os.LookupEnv(EnvMaintenanceWindows); ok {
+			windows, err := ParseWindows(s)
+			if err != nil {
+				return errors.Wrap(err, EnvMaintenanceWindows)
+			}
+			o.MaintenanceWindows = windows
+		}
+		if s, ok := os.LookupEnv(EnvVersionConstraints); ok {
+			o.VersionConstraints = s
+		}
+		if s, ok := os.LookupEnv(EnvPinVersion); ok {
+			o.PinVersion = s
+		}
+		if s, ok := os.LookupEnv(EnvSameMajorVersion); ok {
+			b, err := strconv.ParseBool(s)
+			if err != nil {
+				return errors.Wrap(err, EnvSameMajorVersion)
+			}
+			o.SameMajorVersion = b
+		}
+		if s, ok := os.LookupEnv(EnvSignatureThreshold); ok {
+			n, err := strconv.Atoi(s)
+			if err != nil {
+				return errors.Wrap(err, EnvSignatureThreshold)
+			}
+			o.SignatureThreshold = n
+		}
+		if s, ok := os.LookupEnv(EnvClockSkew); ok {
+			d, err := time.ParseDuration(s)
+			if err != nil {
+				return errors.Wrap(err, EnvClockSkew)
+			}
+			o.ClockSkew = d
+		}
+		if s, ok := os.LookupEnv(EnvMaxImageSize); ok {
+			n, err := strconv.ParseInt(s, 10, 64)
+			if err != nil {
+				return errors.Wrap(err, EnvMaxImageSize)
+			}
+			o.MaxImageSize = n
+		}
+		if s, ok := os.LookupEnv(EnvDeltaUpdates); ok {
+			b, err := strconv.ParseBool(s)
+			if err != nil {
+				return errors.Wrap(err, EnvDeltaUpdates)
+			}
+			o.DeltaUpdates = b
+		}
+
+		if s, ok := os.LookupEnv(EnvScanFrequency); ok {
+			d, err := time.ParseDuration(s)
+			if err != nil {
+				return errors.Wrap(err, EnvScanFrequency)
+			}
+			o.ScanFrequency = d
+		}
+
+		if s, ok := os.LookupEnv(EnvHTTPTimeout); ok {
+			d, err := time.ParseDuration(s)
+			if err != nil {
+				return errors.Wrap(err, EnvHTTPTimeout)
+			}
+			o.setHTTPTimeout(d)
+		}
+
+		return nil
+	}
+}
+
+// setHTTPTimeout changes the timeout of a copy of the http client,
+// the client passed by WithHTTPClient may be shared.
+func (o *Options) setHTTPTimeout(d time.Duration) {
+	c := http.Client{}
+	if o.HTTPClient != nil {
+		c = *o.HTTPClient
+	}
+	c.Timeout = d
+	o.HTTPClient = &c
+}
+
+// fileOptions is the format of the configuration file.
+// Durations are strings in time.ParseDuration format, like "10s".
+type fileOptions struct {
+	CheckURL      string   `json:"check_url"`
+	ScanFrequency string   `json:"scan_frequency"`
+	InitialSplay  string   `json:"initial_splay"`
+	HTTPTimeout   string   `json:"http_timeout"`
+	TempDir       string   `json:"temp_dir"`
+	ExecPath      string   `json:"exec_path"`
+	WorkDir       string   `json:"work_dir"`
+	Args          []string `json:"args"`
+	Channel       string   `json:"channel"`
+	Platform      string   `json:"platform"`
+	StateDir      string   `json:"state_dir"`
+	InstanceID    string   `json:"instance_id"`
+	OldSavePath   string   `json:"old_save_path"`
+
+	HealthCheckURL     string `json:"health_check_url"`
+	HealthCheckTimeout string `json:"health_check_timeout"`
+	DeltaUpdates       *bool  `json:"delta_updates"`
+	MaxImageSize       int64  `json:"max_image_size"`
+	ClockSkew          string `json:"clock_skew"`
+	SignatureThreshold int    `json:"signature_threshold"`
+
+	MaintenanceWindows []string `json:"maintenance_windows"`
+
+	VersionConstraints string `json:"version_constraints"`
+	PinVersion         string `json:"pin_version"`
+	SameMajorVersion   *bool  `json:"same_major_version"`
+}
+
+// WithConfigFile reads the options from the json file.
+// Empty fields don't change the options. An empty fileName does nothing.
+func WithConfigFile(fileName string) Option {
+	return func(o *Options) error {
+		if fileName == "" {
+			return nil
+		}
+
+		b, err := os.ReadFile(fileName)
+		if err != nil {
+			return errors.Wrap(err, "config file")
+		}
+
+		f := fileOptions{}
+		if err := json.Unmarshal(b, &f); err != nil {
+			return errors.Wrapf(err, "config file %s", fileName)
+		}
+
+		if f.CheckURL != "" {
+			o.CheckURL = f.CheckURL
+		}
+		if f.TempDir != "" {
+			o.TempDir = f.TempDir
+		}
+		if f.ExecPath != "" {
+			o.ExecPath = f.ExecPath
+		}
+		if f.WorkDir != "" {
+			o.WorkDir = f.WorkDir
+		}
+		if len(f.Args) > 0 {
+			o.Args = f.Args
+		}
+		if f.Channel != "" {
+			o.Channel = f.Channel
+		}
+		if f.Platform != "" {
+			if err := WithPlatform(f.Platform)(o); err != nil {
+				return errors.Wrap(err, "config file platform")
+			}
+		}
+		if f.StateDir != "" {
+			o.StateDir = f.StateDir
+		}
+		if f.InstanceID != "" {
+			o.InstanceID = f.InstanceID
+		}
+		if f.OldSavePath != "" {
+			o.OldSavePath = f.OldSavePath
+		}
+		if f.HealthCheckURL != "" {
+			o.HealthCheck = NewHTTPHealthCheck(f.HealthCheckURL)
+		}
+		if f.HealthCheckTimeout != "" {
+			d, err := time.ParseDuration(f.HealthCheckTimeout)
+			if err != nil {
+				return errors.Wrap(err, "config file health_check_timeout")
+			}
+			o.HealthCheckTimeout = d
+		}
+		if f.SignatureThreshold != 0 {
+			o.SignatureThreshold = f.SignatureThreshold
+		}
+		if f.ClockSkew != "" {
+			d, err := time.ParseDuration(f.ClockSkew)
+			if err != nil {
+				return errors.Wrap(err, "config file clock_skew")
+			}
+			o.ClockSkew = d
+		}
+		if f.MaxImageSize != 0 {
+			o.MaxImageSize = f.MaxImageSize
+		}
+		if f.DeltaUpdates != nil {
+			o.DeltaUpdates = *f.DeltaUpdates
+		}
+		if f.VersionConstraints != "" {
+			o.VersionConstraints = f.VersionConstraints
+		}
+		if f.PinVersion != "" {
+			o.PinVersion = f.PinVersion
+		}
+		if f.SameMajorVersion != nil {
+			o.SameMajorVersion = *f.SameMajorVersion
+		}
+		if len(f.MaintenanceWindows) > 0 {
+			if err := WithMaintenanceWindows(f.MaintenanceWindows...)(o); err != nil {
+				return errors.Wrap(err, "config file maintenance_windows")
+			}
+		}
+
+		if f.ScanFrequency != "" {
+			d, err := time.ParseDuration(f.ScanFrequency)
+			if err != nil {
+				return errors.Wrap(err, "config file scan_frequency")
+			}
+			o.ScanFrequency = d
+		}
+
+		if f.InitialSplay != "" {
+			d, err := time.ParseDuration(f.InitialSplay)
+			if err != nil {
+				return errors.Wrap(err, "config file initial_splay")
+			}
+			o.InitialSplay = d
+		}
+
+		if f.HTTPTimeout != "" {
+			d, err := time.ParseDuration(f.HTTPTimeout)
+			if err != nil {
+				return errors.Wrap(err, "config file http_timeout")
+			}
+			o.setHTTPTimeout(d)
+		}
+
+		return nil
+	}
+}
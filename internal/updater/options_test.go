@@ -0,0 +1,63 @@
+package updater_test
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+
+	"nametag/internal/updater"
+)
+
+func Test_Options_Default(t *testing.T) {
+	o, err := updater.DefaultOptions()
+	assert.Nil(t, err, "DefaultOptions")
+	assert.Nil(t, o.Validate(), "Validate")
+	assert.Equal(t, updater.DefaultCheckURL, o.CheckURL)
+	assert.Equal(t, updater.DefaultScanFrequency, o.ScanFrequency)
+}
+
+func Test_Options_Validate(t *testing.T) {
+	o, err := updater.DefaultOptions()
+	assert.Nil(t, err, "DefaultOptions")
+
+	bad := o
+	bad.CheckURL = "ftp://127.0.0.1"
+	assert.NotNil(t, bad.Validate(), "scheme")
+
+	bad = o
+	bad.ScanFrequency = time.Millisecond
+	assert.NotNil(t, bad.Validate(), "scan frequency")
+
+	bad = o
+	bad.TempDir = filepath.Join(t.TempDir(), "not-exists")
+	assert.NotNil(t, bad.Validate(), "temp dir")
+
+	bad = o
+	bad.Args = nil
+	assert.NotNil(t, bad.Validate(), "args")
+}
+
+func Test_Options_FileAndEnv(t *testing.T) {
+	fileName := filepath.Join(t.TempDir(), "config.json")
+	err := os.WriteFile(fileName, []byte(`{"check_url": "http://file:8080", "scan_frequency": "1m", "http_timeout": "3s"}`), 0600)
+	assert.Nil(t, err, "WriteFile")
+
+	t.Setenv(updater.EnvCheckURL, "http://env:8080")
+
+	o, err := updater.DefaultOptions()
+	assert.Nil(t, err, "DefaultOptions")
+
+	for _, option := range []updater.Option{updater.WithConfigFile(fileName), updater.WithEnv()} {
+		assert.Nil(t, option(&o))
+	}
+
+	assert.Equal(t, "http://env:8080", o.CheckURL)
+	assert.Equal(t, time.Minute, o.ScanFrequency)
+	assert.Equal(t, 3*time.Second, o.HTTPClient.Timeout)
+
+	t.Setenv(updater.EnvScanFrequency, "often")
+	assert.NotNil(t, updater.WithEnv()(&o), "bad duration")
+}
@@ -0,0 +1,64 @@
+package updater
+
+import (
+	"runtime"
+
+	"github.com/pkg/errors"
+	"golang.org/x/sys/cpu"
+
+	"nametag/internal/imagestore"
+)
+
+// PlatformError is returned if the new release has no build for the platform of the updater.
+var PlatformError = errors.Errorf("no build for the platform")
+
+// DefaultPlatform returns the platform of the current process: runtime.GOOS and runtime.GOARCH,
+// for amd64 the variant is the highest GOAMD64 level which is supported by the CPU.
+func DefaultPlatform() imagestore.Platform {
+	p := imagestore.Platform{OS: runtime.GOOS, Arch: runtime.GOARCH}
+	if runtime.GOARCH == "amd64" {
+		p.Variant = amd64Level()
+	}
+
+	return p
+}
+
+// amd64Level detects the GOAMD64 level of the CPU.
+// LZCNT, MOVBE and F16C of v3 are not detected by x/sys/cpu, they come with AVX2 on the real CPUs.
+func amd64Level() string {
+	x := cpu.X86
+	if !x.HasCX16 || !x.HasPOPCNT || !x.HasSSE3 || !x.HasSSSE3 || !x.HasSSE41 || !x.HasSSE42 {
+		return "v1"
+	}
+	if !x.HasAVX || !x.HasAVX2 || !x.HasBMI1 || !x.HasBMI2 || !x.HasFMA || !x.HasOSXSAVE {
+		return "v2"
+	}
+	if !x.HasAVX512F || !x.HasAVX512BW || !x.HasAVX512CD || !x.HasAVX512DQ || !x.HasAVX512VL {
+		return "v3"
+	}
+
+	return "v4"
+}
+
+// platformOf returns the platform of the image, the zero platform for the invalid one.
+func platformOf(im *imagestore.Image) imagestore.Platform {
+	p, err := imagestore.ParsePlatform(im.Platform)
+	if err != nil {
+		return imagestore.Platform{}
+	}
+
+	return p
+}
+
+// better reports whether the release a is preferred to b: the newer version
+// or the more specific build of the same version, e.g. linux/amd64/v3 over linux/amd64.
+func better(a, b *imagestore.Image) bool {
+	if b == nil {
+		return true
+	}
+	if c := a.Version.Compare(b.Version); c != 0 {
+		return c > 0
+	}
+
+	return platformOf(a).Variant > platformOf(b).Variant
+}
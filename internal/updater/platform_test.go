@@ -0,0 +1,89 @@
+package updater_test
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/hashicorp/go-version"
+	"github.com/stretchr/testify/assert"
+
+	"nametag/internal/imagestore"
+	"nametag/internal/updater"
+)
+
+const platformManifest = `{
+	"releases": [
+		{"version": "1.1.0", "channel": "stable", "platform": "linux/arm64", "uri": "/data/app.v1.1.0.linux-arm64"},
+		{"version": "1.0.5", "channel": "stable", "platform": "linux/amd64", "uri": "/data/app.v1.0.5.linux-amd64"},
+		{"version": "1.0.5", "channel": "stable", "platform": "linux/amd64/v2", "uri": "/data/app.v1.0.5.linux-amd64-v2"},
+		{"version": "1.0.5", "channel": "stable", "platform": "linux/amd64/v4", "uri": "/data/app.v1.0.5.linux-amd64-v4"}
+	]
+}`
+
+func Test_Platform(t *testing.T) {
+	u := newTestUpdater(t, platformManifest, updater.WithPlatform("linux/amd64/v3"), updater.WithDeltaUpdates(false))
+
+	success, err := u.CheckOnce()
+	assert.False(t, success)
+	assert.ErrorIs(t, err, updater.NetError, "the download fails")
+
+	// the test server returns the manifest instead of the image, the download fails after the selection
+	assert.True(t, strings.HasSuffix(u.Progress().Uri, "/data/app.v1.0.5.linux-amd64-v2"), "the best build for the CPU: %s", u.Progress().Uri)
+	assert.Equal(t, "1.0.5", u.Status().LatestVersion)
+}
+
+func Test_Platform_Missing(t *testing.T) {
+	u := newTestUpdater(t, platformManifest, updater.WithPlatform("linux/riscv64"))
+
+	success, err := u.CheckOnce()
+	assert.False(t, success)
+	assert.NotNil(t, err, "CheckOnce")
+
+	s := u.Status()
+	assert.Contains(t, s.LastError, "no build for the platform")
+	assert.Contains(t, s.LastError, "1.1.0 for linux/riscv64")
+	assert.Empty(t, s.LatestVersion)
+}
+
+func Test_Platform_Unknown(t *testing.T) {
+	// the old build without the platform suffix may be of the other os or arch
+	r := &imagestore.Release{
+		Version:   version.Must(version.NewVersion("1.1.0")),
+		Channel:   imagestore.ChannelStable,
+		Uri:       "/data/app.v1.1.0",
+		Size:      1,
+		FileSum:   base64.URLEncoding.EncodeToString([]byte("sum")),
+		ExpiresAt: time.Now().Add(time.Hour),
+	}
+	signed, err := imagestore.NewSigned(testSigner{}, r)
+	assert.Nil(t, err, "NewSigned")
+	im := &imagestore.Image{Release: signed}
+	r.Apply(im)
+
+	m := &imagestore.Manifest{Releases: []*imagestore.Image{im}}
+	stampManifest(t, testSigner{}, m, 1, time.Now().Add(time.Hour))
+	b, err := json.Marshal(m)
+	assert.Nil(t, err, "Marshal")
+
+	u := newRawTestUpdater(t, string(b), updater.WithPlatform("darwin/arm64"))
+
+	success, err := u.CheckOnce()
+	assert.False(t, success)
+	assert.NotNil(t, err, "CheckOnce")
+
+	s := u.Status()
+	assert.Contains(t, s.LastError, "no build for the platform")
+	assert.Contains(t, s.LastError, "1.1.0 for darwin/arm64")
+}
+
+func Test_DefaultPlatform(t *testing.T) {
+	p := updater.DefaultPlatform()
+	assert.False(t, p.IsZero())
+
+	opts, err := updater.DefaultOptions()
+	assert.Nil(t, err, "DefaultOptions")
+	assert.NotNil(t, updater.WithPlatform("linux")(&opts))
+}
@@ -0,0 +1,151 @@
+package updater
+
+import (
+	"github.com/hashicorp/go-version"
+	"github.com/pkg/errors"
+
+	"nametag/internal/imagestore"
+)
+
+// policy limits the versions which are installed automatically.
+type policy struct {
+	// constraints in go-version syntax, e.g. "~> 1.4" or ">= 1.2, < 2.0", nil means any version
+	constraints version.Constraints
+
+	// pin is the only version which can be installed, nil means no pin
+	pin *version.Version
+
+	// sameMajor forbids crossing the major version of the current process
+	sameMajor bool
+}
+
+// policy parses the version policy from the options.
+func (o *Options) policy() (*policy, error) {
+	p := &policy{sameMajor: o.SameMajorVersion}
+
+	if o.VersionConstraints != "" {
+		c, err := version.NewConstraint(o.VersionConstraints)
+		if err != nil {
+			return nil, errors.Wrap(err, "version constraints")
+		}
+		p.constraints = c
+	}
+
+	if o.PinVersion != "" {
+		v, err := version.NewVersion(o.PinVersion)
+		if err != nil {
+			return nil, errors.Wrap(err, "pin version")
+		}
+		p.pin = v
+	}
+
+	return p, nil
+}
+
+// check returns the reason why the update from current to v isn't allowed, nil if it's allowed.
+func (p *policy) check(current, v *version.Version) error {
+	if p.pin != nil && !v.Equal(p.pin) {
+		return errors.Errorf("pinned to %s", p.pin)
+	}
+
+	if p.sameMajor && v.Segments()[0] != current.Segments()[0] {
+		return errors.Errorf("crosses the major version %d", current.Segments()[0])
+	}
+
+	// go-version constraints never match the pre-releases, e.g. "< 2.0" doesn't allow 1.5.0-beta.1,
+	// so the pre-releases are checked by their release part: 1.5.0-beta.1 as 1.5.0
+	if p.constraints != nil && !p.constraints.Check(v.Core()) {
+		return errors.Errorf("doesn't satisfy %q", p.constraints)
+	}
+
+	return nil
+}
+
+// selection is the result of selectRelease.
+type selection struct {
+	// latest is the newest release of the channel for the platform
+	latest *imagestore.Image
+
+	// im is the newest release which can be installed
+	im *imagestore.Image
+
+	// blocked is the newer release which is blocked by the policy with the reason
+	blocked *imagestore.Image
+	reason  error
+
+	// missing is the newer release without the build for the platform
+	missing *imagestore.Image
+}
+
+// selectRelease selects the newest release from the manifest which can be installed.
+// The broken versions of the rollback directive and the revoked versions are never installed.
+// If the current version is revoked, the newest good release allowed by the version policy
+// is installed even if it's older. Only if the policy allows none, the newest good release
+// is installed anyway and reported as blocked, the client must not stay on the yanked build.
+func (u *Updater) selectRelease(m *imagestore.Manifest, channel string, rollback *imagestore.Rollback, revoked *imagestore.Revocations) selection {
+	leave := revoked.Revoked(u.currentVersion) != nil
+
+	sel := selection{}
+
+	// fallback is the newest good release blocked by the policy, it's installed to leave the revoked version
+	var fallback *imagestore.Image
+	var fallbackReason error
+	for _, r := range m.Releases {
+		if !imagestore.Follows(channel, r.Channel) {
+			continue
+		}
+
+		supported := u.opts.Platform.Supports(platformOf(r))
+		if supported && (sel.latest == nil || r.Version.GreaterThan(sel.latest.Version)) {
+			sel.latest = r
+		}
+
+		// the version from the other channel is newer, e.g. after switching from beta to stable.
+		// Just wait for the next release in the channel, no forced downgrade.
+		if r.Version.Equal(u.currentVersion) || (!leave && r.Version.LessThan(u.currentVersion)) {
+			continue
+		}
+		if u.skipped(r.Version) || revoked.Revoked(r.Version) != nil {
+			continue
+		}
+		if rollback != nil && rollback.Applies(r.Version) {
+			continue
+		}
+
+		if !supported {
+			if sel.missing == nil || r.Version.GreaterThan(sel.missing.Version) {
+				sel.missing = r
+			}
+			continue
+		}
+
+		if err := u.policy.check(u.currentVersion, r.Version); err != nil {
+			if sel.blocked == nil || r.Version.GreaterThan(sel.blocked.Version) {
+				sel.blocked, sel.reason = r, err
+			}
+			if leave && better(r, fallback) {
+				fallback, fallbackReason = r, err
+			}
+			continue
+		}
+
+		if better(r, sel.im) {
+			sel.im = r
+		}
+	}
+
+	// the blocked and missing releases don't matter if a newer one is installed
+	if sel.blocked != nil && sel.im != nil && !sel.blocked.Version.GreaterThan(sel.im.Version) {
+		sel.blocked, sel.reason = nil, nil
+	}
+	if sel.missing != nil && sel.im != nil && !sel.missing.Version.GreaterThan(sel.im.Version) {
+		sel.missing = nil
+	}
+
+	if sel.im == nil && fallback != nil {
+		sel.im = fallback
+		sel.blocked, sel.reason = fallback, errors.Wrap(fallbackReason, "installed anyway, the current version is revoked")
+	}
+
+	return sel
+}
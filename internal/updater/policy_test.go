@@ -0,0 +1,69 @@
+package updater_test
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+
+	"nametag/internal/updater"
+)
+
+const policyManifest = `{
+	"releases": [
+		{"version": "2.1.0", "channel": "stable"},
+		{"version": "1.7.0-beta.1", "channel": "beta"},
+		{"version": "1.6.0", "channel": "stable"},
+		{"version": "1.5.0", "channel": "stable"},
+		{"version": "1.3.0", "channel": "stable"}
+	]
+}`
+
+func Test_Policy(t *testing.T) {
+	tests := []struct {
+		name      string
+		option    updater.Option
+		available string
+		blocked   string
+	}{
+		{"no policy", updater.WithVersionConstraints(""), "2.1.0", ""},
+		{"same major", updater.WithSameMajorVersion(true), "1.6.0", "2.1.0"},
+		{"constraints", updater.WithVersionConstraints("~> 1.4, != 1.6.0"), "1.5.0", "2.1.0"},
+		{"pin", updater.WithPinVersion("v1.3.0"), "1.3.0", "2.1.0"},
+		{"pin unknown", updater.WithPinVersion("v1.4.0"), "", "2.1.0"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			u := newTestUpdater(t, policyManifest, tt.option)
+
+			// stop before the download
+			u.AddHook(updater.StageBeforeDownload, time.Second, func(context.Context, updater.HookInfo) error {
+				return updater.ErrVeto
+			})
+			success, err := u.CheckOnce()
+			assert.False(t, success)
+			assert.Nil(t, err, "CheckOnce")
+
+			s := u.Status()
+			assert.Equal(t, "1.0.0", s.CurrentVersion)
+			assert.Equal(t, "2.1.0", s.LatestVersion)
+			assert.Equal(t, tt.available, s.AvailableVersion, "available")
+			assert.Equal(t, tt.blocked, s.BlockedVersion, "blocked")
+			assert.Equal(t, tt.blocked != "", s.BlockedReason != "", s.BlockedReason)
+		})
+	}
+}
+
+func Test_Policy_Options(t *testing.T) {
+	for _, option := range []updater.Option{
+		updater.WithVersionConstraints("~> one"),
+		updater.WithPinVersion("latest"),
+	} {
+		opts, err := updater.DefaultOptions()
+		assert.Nil(t, err, "DefaultOptions")
+		assert.Nil(t, option(&opts))
+		assert.NotNil(t, opts.Validate())
+	}
+}
@@ -0,0 +1,97 @@
+package updater
+
+import (
+	"time"
+)
+
+// progressInterval limits how often the progress is reported.
+const progressInterval = 250 * time.Millisecond
+
+// Progress is the state of the current download.
+type Progress struct {
+	Uri      string
+	Received int64         // bytes, including the resumed part
+	Total    int64         // bytes, -1 if the server doesn't send the size
+	Rate     float64       // bytes per second
+	ETA      time.Duration // 0 if it's unknown
+	Done     bool
+}
+
+// Percent returns the downloaded part in [0, 100] or -1 if the size is unknown.
+func (p Progress) Percent() float64 {
+	if p.Total <= 0 {
+		return -1
+	}
+
+	return float64(p.Received) * 100 / float64(p.Total)
+}
+
+// Progress returns the state of the current or the last download.
+func (u *Updater) Progress() Progress {
+	u.mx.RLock()
+	defer u.mx.RUnlock()
+
+	return u.progress
+}
+
+// progressWriter counts the downloaded bytes and reports the progress.
+type progressWriter struct {
+	u *Updater
+	p Progress
+
+	start      time.Time
+	startBytes int64 // the resumed part is not counted in the rate
+	lastReport time.Time
+}
+
+func (u *Updater) newProgressWriter(uri string, offset, total int64) *progressWriter {
+	now := time.Now()
+	w := &progressWriter{
+		u:          u,
+		p:          Progress{Uri: uri, Received: offset, Total: total},
+		start:      now,
+		startBytes: offset,
+		lastReport: now,
+	}
+	w.report()
+
+	return w
+}
+
+func (w *progressWriter) Write(b []byte) (int, error) {
+	w.p.Received += int64(len(b))
+
+	if time.Since(w.lastReport) >= progressInterval {
+		w.report()
+	}
+
+	return len(b), nil
+}
+
+// finish reports the last state of the download.
+func (w *progressWriter) finish(done bool) {
+	w.p.Done = done
+	w.report()
+}
+
+func (w *progressWriter) report() {
+	now := time.Now()
+	w.lastReport = now
+
+	if elapsed := now.Sub(w.start).Seconds(); elapsed > 0 {
+		w.p.Rate = float64(w.p.Received-w.startBytes) / elapsed
+	}
+
+	w.p.ETA = 0
+	if w.p.Rate > 0 && w.p.Total > w.p.Received {
+		w.p.ETA = time.Duration(float64(w.p.Total-w.p.Received) / w.p.Rate * float64(time.Second))
+	}
+
+	w.u.mx.Lock()
+	w.u.progress = w.p
+	w.u.mx.Unlock()
+
+	if w.u.opts.OnProgress != nil {
+		w.u.opts.OnProgress(w.p)
+	}
+}
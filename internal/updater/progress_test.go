@@ -0,0 +1,141 @@
+package updater_test
+
+import (
+	"crypto/sha256"
+	"encoding/base64"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+
+	"nametag/internal/lg"
+	"nametag/internal/updater"
+)
+
+func Test_Progress_Percent(t *testing.T) {
+	assert.Equal(t, 42.0, updater.Progress{Received: 42, Total: 100}.Percent())
+	assert.Equal(t, -1.0, updater.Progress{Received: 42, Total: -1}.Percent())
+}
+
+func Test_Progress(t *testing.T) {
+	// the new version is the script which exits at once
+	data := []byte("#!/bin/true\n" + strings.Repeat("app.v2.0.0 ", 10000) + "\n")
+	sum := sha256.Sum256(data)
+	half := len(data) / 2
+	manifest := signManifest(t, fmt.Sprintf(`{"releases": [{"version": "2.0.0", "channel": "stable", "uri": "/data/app.v2.0.0",
+		"size": %d, "file_sum": %q}]}`, len(data), base64.URLEncoding.EncodeToString(sum[:])))
+
+	mx := sync.Mutex{}
+	requests := 0
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/data/app.v2.0.0" {
+			_, _ = w.Write([]byte(manifest))
+			return
+		}
+
+		mx.Lock()
+		requests++
+		n := requests
+		mx.Unlock()
+
+		w.Header().Set("ETag", `"v1"`)
+		if n == 1 {
+			// the first download is cut off in the middle
+			w.Header().Set("Content-Length", strconv.Itoa(len(data)))
+			_, _ = w.Write(data[:half])
+			panic(http.ErrAbortHandler)
+		}
+
+		// the rest is sent slowly, so the progress is reported several times
+		w.Header().Set("Content-Range", fmt.Sprintf("bytes %d-%d/%d", half, len(data)-1, len(data)))
+		w.Header().Set("Content-Length", strconv.Itoa(len(data)-half))
+		w.WriteHeader(http.StatusPartialContent)
+
+		rest := data[half:]
+		chunk := len(rest)/4 + 1
+		for len(rest) > 0 {
+			k := min(chunk, len(rest))
+			_, _ = w.Write(rest[:k])
+			w.(http.Flusher).Flush()
+			rest = rest[k:]
+			time.Sleep(200 * time.Millisecond)
+		}
+	}))
+	defer srv.Close()
+
+	dir := t.TempDir()
+	execPath := filepath.Join(dir, "app")
+	assert.Nil(t, os.WriteFile(execPath, []byte("app.v1.0.0"), 0755), "WriteFile")
+
+	log, err := lg.New(filepath.Join(dir, "test.log"), "v1.0.0")
+	assert.Nil(t, err, "lg.New")
+
+	reports := make([]updater.Progress, 0)
+	u, err := updater.New(log, okVerifier{}, "v1.0.0",
+		updater.WithCheckURL(srv.URL),
+		updater.WithStateDir(dir),
+		updater.WithTempDir(dir),
+		updater.WithExecPath(execPath),
+		updater.WithOldSavePath(execPath+".previous"),
+		updater.WithArgs(execPath),
+		updater.WithInitialSplay(0),
+		updater.WithProgress(func(p updater.Progress) {
+			mx.Lock()
+			defer mx.Unlock()
+
+			reports = append(reports, p)
+		}),
+	)
+	assert.Nil(t, err, "updater.New")
+
+	// the first download fails, the next check resumes or reloads it
+	success, err := u.CheckOnce()
+	assert.False(t, success)
+	assert.NotNil(t, err, "the first download fails")
+
+	success, err = u.CheckOnce()
+	assert.True(t, success, "the new version is started")
+	assert.Nil(t, err, "CheckOnce")
+
+	mx.Lock()
+	defer mx.Unlock()
+
+	// the reports of the resumed download start after the first one is finished
+	resumed := -1
+	for i, p := range reports {
+		assert.Equal(t, srv.URL+"/data/app.v2.0.0", p.Uri)
+		if i > 0 && reports[i-1].Received == int64(half) && !reports[i-1].Done && p.Received == int64(half) {
+			resumed = i
+		}
+	}
+	if !assert.Greater(t, resumed, 0, "resumed: %v", reports) {
+		return
+	}
+	assert.Equal(t, int64(len(data)), reports[resumed].Total, "the total size of the resumed download")
+
+	// the rate counts the bytes of this download only, they're reported every 250ms at most
+	moving := false
+	for _, p := range reports[resumed+1 : len(reports)-1] {
+		assert.False(t, p.Done)
+		if p.Rate > 0 && p.ETA > 0 && p.Received < p.Total {
+			moving = true
+			assert.LessOrEqual(t, p.Rate, float64(p.Received-int64(half))/0.25, "rate without the resumed part")
+		}
+	}
+	assert.True(t, moving, "rate and ETA: %v", reports)
+
+	last := reports[len(reports)-1]
+	assert.True(t, last.Done, "done")
+	assert.Equal(t, int64(len(data)), last.Received)
+	assert.Equal(t, time.Duration(0), last.ETA)
+	assert.Equal(t, float64(100), last.Percent())
+	assert.Equal(t, last, u.Progress(), "the last state")
+}
@@ -0,0 +1,58 @@
+package updater
+
+import (
+	"time"
+
+	"nametag/internal/imagestore"
+)
+
+// verifyReleases replaces the fields of the releases in the manifest with the signed ones,
+// the releases without the valid unexpired signatures of Options.SignatureThreshold keys are dropped.
+// The Channels of the manifest are for the old clients, they are not used.
+func (u *Updater) verifyReleases(m *imagestore.Manifest, now time.Time) {
+	releases := make([]*imagestore.Image, 0, len(m.Releases))
+	for _, im := range m.Releases {
+		if im == nil {
+			continue
+		}
+		if im.Release == nil {
+			u.log.Errorf("ignore unsigned release %s", im.Uri)
+			continue
+		}
+
+		r := &imagestore.Release{}
+		if err := u.openRole(im.Release, imagestore.RoleTargets, u.opts.SignatureThreshold, r); err != nil {
+			u.log.Errorf("ignore release %s: %s", im.Uri, err.Error())
+			continue
+		}
+		if err := r.Check(now, u.opts.ClockSkew); err != nil {
+			u.log.Errorf("ignore release %s: %s", im.Uri, err.Error())
+			continue
+		}
+
+		r.Apply(im)
+		releases = append(releases, im)
+	}
+
+	m.Releases = releases
+	m.Channels = nil
+}
+
+// rolledOut drops the releases of the staged rollouts which the client doesn't get yet.
+// The manifest lists all the releases, the client selects its cohort by the rollout
+// signed in the snapshot s, without the snapshot by the unsigned rollout of the release.
+func (u *Updater) rolledOut(m *imagestore.Manifest, s *imagestore.Snapshot, now time.Time) {
+	releases := make([]*imagestore.Image, 0, len(m.Releases))
+	for _, im := range m.Releases {
+		rollout := im.Rollout
+		if s != nil {
+			rollout = s.Rollout(im.Release)
+		}
+
+		if imagestore.InCohort(u.opts.InstanceID, im.Version, rollout.Percent(now)) {
+			releases = append(releases, im)
+		}
+	}
+
+	m.Releases = releases
+}
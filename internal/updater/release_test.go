@@ -0,0 +1,81 @@
+package updater_test
+
+import (
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"testing"
+	"time"
+
+	"github.com/hashicorp/go-version"
+	"github.com/stretchr/testify/assert"
+
+	"nametag/internal/imagestore"
+	"nametag/internal/updater"
+)
+
+func Test_Release(t *testing.T) {
+	release := func(v string, expiresAt time.Time) *imagestore.Image {
+		r := &imagestore.Release{
+			Version:   version.Must(version.NewVersion(v)),
+			Channel:   imagestore.ChannelStable,
+			Platform:  updater.DefaultPlatform().String(),
+			Uri:       "/data/app.v" + v,
+			Size:      1,
+			FileSum:   base64.URLEncoding.EncodeToString([]byte(v)),
+			ExpiresAt: expiresAt,
+		}
+		signed, err := imagestore.NewSigned(testSigner{}, r)
+		assert.Nil(t, err, "NewSigned")
+
+		im := &imagestore.Image{Release: signed}
+		r.Apply(im)
+		return im
+	}
+
+	future := time.Now().Add(time.Hour)
+	tests := []struct {
+		name   string
+		tamper func(im *imagestore.Image)
+		want   string
+	}{
+		{"signed", func(im *imagestore.Image) {}, "2.0.0"},
+		{"unsigned", func(im *imagestore.Image) { im.Release = nil }, "1.1.0"},
+		{"relabeled", func(im *imagestore.Image) { im.Version = version.Must(version.NewVersion("99.0.0")) }, "2.0.0"},
+		{"other image", func(im *imagestore.Image) { im.Uri = "/data/evil" }, "2.0.0"},
+		{"tampered", func(im *imagestore.Image) {
+			im.Release.Payload = base64.URLEncoding.EncodeToString([]byte(`{"version": "99.0.0"}`))
+		}, "1.1.0"},
+		{"expired", func(im *imagestore.Image) {
+			*im = *release("2.0.0", time.Now().Add(-updater.DefaultClockSkew-time.Minute))
+		}, "1.1.0"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			newest := release("2.0.0", future)
+			tt.tamper(newest)
+
+			m := &imagestore.Manifest{Releases: []*imagestore.Image{newest, release("1.1.0", future)}}
+			stampManifest(t, testSigner{}, m, 1, future)
+
+			b, err := json.Marshal(m)
+			assert.Nil(t, err, "Marshal")
+
+			u := newRawTestUpdater(t, string(b))
+
+			var got updater.HookInfo
+			u.AddHook(updater.StageBeforeDownload, time.Second, func(_ context.Context, info updater.HookInfo) error {
+				got = info
+				return updater.ErrVeto
+			})
+			success, err := u.CheckOnce()
+			assert.False(t, success)
+			assert.Nil(t, err, "CheckOnce")
+
+			if assert.NotNil(t, got.NewVersion, "update") {
+				assert.Equal(t, tt.want, got.NewVersion.String())
+			}
+		})
+	}
+}
@@ -0,0 +1,25 @@
+package updater
+
+import (
+	"nametag/internal/imagestore"
+)
+
+// revocations returns the verified revocation list from the manifest, nil if there is none.
+// The invalid list is ignored as the invalid rollback directive.
+func (u *Updater) revocations(m *imagestore.Manifest) *imagestore.Revocations {
+	if m.Revoked == nil {
+		return nil
+	}
+
+	r := &imagestore.Revocations{}
+	if err := u.openRole(m.Revoked, imagestore.RoleTargets, u.opts.SignatureThreshold, r); err != nil {
+		u.log.Errorf("ignore revocation list: %s", err.Error())
+		return nil
+	}
+	if err := r.Check(); err != nil {
+		u.log.Errorf("ignore revocation list: %s", err.Error())
+		return nil
+	}
+
+	return r
+}
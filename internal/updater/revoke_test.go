@@ -0,0 +1,109 @@
+package updater_test
+
+import (
+	"context"
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+
+	"nametag/internal/updater"
+)
+
+func Test_Revoked(t *testing.T) {
+	tests := []struct {
+		name    string
+		revoked string
+		options []updater.Option
+		want    string
+		leave   bool
+	}{
+		{"newer is revoked", `{"versions": [{"version": "1.1.0"}]}`, nil, "1.0.5", false},
+		{"current is revoked", `{"versions": [{"version": "1.0.0", "reason": "cve"}, {"version": "1.1.0"}, {"version": "1.0.5"}]}`, nil, "0.9.0", true},
+		{"current and newer", `{"versions": [{"version": "1.0.0"}]}`, nil, "1.1.0", true},
+
+		// the policy doesn't keep the client on the revoked version
+		{"pinned", `{"versions": [{"version": "1.0.0"}]}`, []updater.Option{updater.WithPinVersion("1.0.0")}, "1.1.0", true},
+		{"other major", `{"versions": [{"version": "1.0.0"}, {"version": "1.1.0"}, {"version": "1.0.5"}]}`,
+			[]updater.Option{updater.WithSameMajorVersion(true)}, "0.9.0", true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			u := newTestUpdater(t, fmt.Sprintf(`{
+				"releases": [
+					{"version": "1.1.0", "channel": "stable"},
+					{"version": "1.0.5", "channel": "stable"},
+					{"version": "1.0.0", "channel": "stable"},
+					{"version": "0.9.0", "channel": "stable"}
+				],
+				"revoked": %s
+			}`, signedDocument(t, tt.revoked)), tt.options...)
+
+			var got updater.HookInfo
+			u.AddHook(updater.StageBeforeDownload, time.Second, func(_ context.Context, info updater.HookInfo) error {
+				got = info
+				return updater.ErrVeto
+			})
+			success, err := u.CheckOnce()
+			assert.False(t, success)
+			assert.Nil(t, err, "CheckOnce")
+
+			if assert.NotNil(t, got.NewVersion, "update") {
+				assert.Equal(t, tt.want, got.NewVersion.String())
+				assert.Equal(t, tt.leave, got.Revoked, "mandatory")
+			}
+			assert.Equal(t, tt.leave, u.Status().Revoked, "status")
+		})
+	}
+}
+
+func Test_Revoked_Policy(t *testing.T) {
+	tests := []struct {
+		name    string
+		option  updater.Option
+		want    string
+		blocked string
+	}{
+		{"same major", updater.WithSameMajorVersion(true), "1.1.0", "2.0.0"},
+		{"constraints", updater.WithVersionConstraints("~> 1.0"), "1.1.0", "2.0.0"},
+		{"pinned", updater.WithPinVersion("0.9.0"), "0.9.0", "2.0.0"},
+
+		// the policy allows no good release, the newest one is installed anyway
+		{"pinned to revoked", updater.WithPinVersion("1.0.0"), "2.0.0", "2.0.0"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			u := newTestUpdater(t, fmt.Sprintf(`{
+				"releases": [
+					{"version": "2.0.0", "channel": "stable"},
+					{"version": "1.1.0", "channel": "stable"},
+					{"version": "1.0.0", "channel": "stable"},
+					{"version": "0.9.0", "channel": "stable"}
+				],
+				"revoked": %s
+			}`, signedDocument(t, `{"versions": [{"version": "1.0.0"}]}`)), tt.option)
+
+			var got updater.HookInfo
+			u.AddHook(updater.StageBeforeDownload, time.Second, func(_ context.Context, info updater.HookInfo) error {
+				got = info
+				return updater.ErrVeto
+			})
+			success, err := u.CheckOnce()
+			assert.False(t, success)
+			assert.Nil(t, err, "CheckOnce")
+
+			if assert.NotNil(t, got.NewVersion, "update") {
+				assert.Equal(t, tt.want, got.NewVersion.String())
+				assert.True(t, got.Revoked, "mandatory")
+			}
+
+			s := u.Status()
+			assert.Equal(t, tt.want, s.AvailableVersion, "available")
+			assert.Equal(t, tt.blocked, s.BlockedVersion, "blocked")
+			assert.NotEmpty(t, s.BlockedReason, "blocked reason")
+		})
+	}
+}
@@ -0,0 +1,273 @@
+package updater
+
+import (
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"slices"
+	"time"
+
+	"github.com/pkg/errors"
+
+	"nametag/internal/imagestore"
+)
+
+// rootsFile is the file in the state directory with the accepted root documents.
+// They are verified again at the start, each one by the previous one.
+const rootsFile = "roots.json"
+
+// RootError is returned for the root document which isn't signed by the root keys,
+// and for the expired root.
+var RootError = errors.Errorf("untrusted root")
+
+// openRole checks that the document is signed by the threshold of the keys of the role
+// and unmarshals it into v. Without the root any trusted key signs any document,
+// fallback is the threshold then, with the root it's the minimal threshold.
+func (u *Updater) openRole(s *imagestore.Signed, role string, fallback int, v any) error {
+	if u.root == nil {
+		return u.openSignedBy(s, fallback, nil, v)
+	}
+
+	r := u.root.Roles[role]
+	return u.openSignedBy(s, max(r.Threshold, fallback), r.KeyIDs, v)
+}
+
+// openSignedBy checks that the signed document has the valid signatures of at least
+// threshold different trusted keys from keyIDs, nil means any key, and unmarshals it into v.
+func (u *Updater) openSignedBy(s *imagestore.Signed, threshold int, keyIDs []string, v any) error {
+	b, err := base64.URLEncoding.DecodeString(s.Payload)
+	if err != nil {
+		return errors.Wrap(err, "payload DecodeString")
+	}
+
+	sum := sha256.Sum256(b)
+	if base64.URLEncoding.EncodeToString(sum[:]) != s.FileSum {
+		return errors.Errorf("payload doesn't match the signed hash")
+	}
+
+	signatures := s.AllSignatures()
+	if threshold > 1 {
+		// each signature names its key, so one signature can't be counted twice
+		claimed := map[string]struct{}{}
+		for _, sig := range signatures {
+			if sig.KeyID == "" {
+				return errors.Errorf("signature without the key id")
+			}
+			if _, ok := claimed[sig.KeyID]; ok {
+				return errors.Errorf("duplicate signature of the key %s", sig.KeyID)
+			}
+			claimed[sig.KeyID] = struct{}{}
+		}
+	}
+
+	// the signatures are counted by the keys which verified them, not by the claimed ids
+	valid := map[string]struct{}{}
+	var lastErr error
+	for _, sig := range signatures {
+		id, err := u.verifier.Verify(sig.Alg, sig.KeyID, s.Message(sig.Alg), sig.Sign)
+		if err != nil {
+			lastErr = err
+			continue
+		}
+		if keyIDs != nil && !slices.Contains(keyIDs, id) {
+			continue
+		}
+		valid[id] = struct{}{}
+	}
+
+	if len(valid) < threshold {
+		if lastErr == nil {
+			lastErr = errors.Errorf("not enough signatures")
+		}
+		return errors.Wrapf(lastErr, "%d of %d required signatures", len(valid), threshold)
+	}
+
+	return json.Unmarshal(b, v)
+}
+
+// updateRoots accepts the new root documents in order, it reports whether the root is changed.
+// The first root is signed by the keys which are trusted already, e.g. the embedded ones,
+// the next one is signed by the root keys of the previous root and by its own root keys.
+func (u *Updater) updateRoots(roots []*imagestore.Signed) (bool, error) {
+	keyring, ok := u.verifier.(Keyring)
+	if !ok {
+		return false, nil
+	}
+
+	changed := false
+	for _, s := range roots {
+		if s == nil || u.rootAccepted(s) {
+			continue
+		}
+
+		if err := u.acceptRoot(keyring, s); err != nil {
+			return changed, errors.Wrap(RootError, err.Error())
+		}
+		changed = true
+	}
+
+	return changed, nil
+}
+
+// rootAccepted reports whether the root document or the later one is accepted.
+func (u *Updater) rootAccepted(s *imagestore.Signed) bool {
+	if u.root == nil {
+		return false
+	}
+
+	b, err := base64.URLEncoding.DecodeString(s.Payload)
+	if err != nil {
+		return false
+	}
+
+	r := &imagestore.Root{}
+	return json.Unmarshal(b, r) == nil && r.Version <= u.root.Version
+}
+
+func (u *Updater) acceptRoot(keyring Keyring, s *imagestore.Signed) error {
+	// the payload is checked by the signatures below
+	r := &imagestore.Root{}
+	if err := u.openSignedBy(s, 0, nil, r); err != nil {
+		return err
+	}
+	if err := r.Check(); err != nil {
+		return err
+	}
+	role := r.Roles[imagestore.RoleRoot]
+
+	if u.root == nil {
+		// the keys of the root must be trusted before it
+		if err := u.openSignedBy(s, max(role.Threshold, u.opts.SignatureThreshold), role.KeyIDs, r); err != nil {
+			return errors.Wrapf(err, "root %d", r.Version)
+		}
+	} else {
+		if r.Version != u.root.Version+1 {
+			return errors.Errorf("root %d doesn't follow the root %d", r.Version, u.root.Version)
+		}
+
+		if err := u.openRole(s, imagestore.RoleRoot, 0, r); err != nil {
+			return errors.Wrapf(err, "root %d by the previous root", r.Version)
+		}
+
+		// the new keys are trusted after both checks only
+		if err := u.signedByNewKeys(keyring, s, r.Keys, role.KeyIDs, role.Threshold); err != nil {
+			return errors.Wrapf(err, "root %d by its own keys", r.Version)
+		}
+	}
+
+	// the new keys are used by the roles of the accepted root only
+	for id, key := range r.Keys {
+		if err := keyring.AddKey(key.Alg, id, key.Key); err != nil {
+			return errors.Wrapf(err, "root %d", r.Version)
+		}
+	}
+
+	u.log.Infof("root %d is accepted, expires at %s", r.Version, r.ExpiresAt.Format(time.RFC3339))
+	u.root = r
+	u.roots = append(u.roots, s)
+	return nil
+}
+
+// signedByNewKeys checks that the document is signed by threshold different keys from keyIDs
+// which may be not trusted yet, keys are their public keys.
+func (u *Updater) signedByNewKeys(keyring Keyring, s *imagestore.Signed, keys map[string]imagestore.PublicKey, keyIDs []string, threshold int) error {
+	valid := map[string]struct{}{}
+	var lastErr error
+	for _, sig := range s.AllSignatures() {
+		key, ok := keys[sig.KeyID]
+		if !ok || !slices.Contains(keyIDs, sig.KeyID) {
+			continue
+		}
+
+		// VerifyKey checks that the id is of the key, so the signatures are counted by the keys
+		if err := keyring.VerifyKey(key.Alg, sig.KeyID, key.Key, s.Message(key.Alg), sig.Sign); err != nil {
+			lastErr = err
+			continue
+		}
+		valid[sig.KeyID] = struct{}{}
+	}
+
+	if len(valid) < threshold {
+		if lastErr == nil {
+			lastErr = errors.Errorf("not enough signatures")
+		}
+		return errors.Wrapf(lastErr, "%d of %d required signatures", len(valid), threshold)
+	}
+
+	return nil
+}
+
+// checkRoot rejects the expired root, so a frozen repository is found out.
+func (u *Updater) checkRoot(now time.Time) error {
+	if u.root != nil && !now.Add(-u.opts.ClockSkew).Before(u.root.ExpiresAt) {
+		return errors.Wrapf(RootError, "root %d is expired at %s", u.root.Version, u.root.ExpiresAt.Format(time.RFC3339))
+	}
+
+	return nil
+}
+
+// checkSnapshot verifies the snapshot pinned by the timestamp, it's required with the root.
+// The snapshot pins all the documents of the targets role in the manifest,
+// it's nil if the snapshot isn't required and the timestamp doesn't pin it.
+func (u *Updater) checkSnapshot(m *imagestore.Manifest, t *imagestore.Timestamp, now time.Time) (*imagestore.Snapshot, error) {
+	if t.Snapshot == "" && u.root == nil {
+		return nil, nil
+	}
+	// the timestamp matches the snapshot of the manifest already
+	if m.Snapshot == nil {
+		return nil, errors.Wrapf(FreshnessError, "timestamp %d doesn't pin the snapshot", t.Version)
+	}
+
+	s := &imagestore.Snapshot{}
+	if err := u.openRole(m.Snapshot, imagestore.RoleSnapshot, 1, s); err != nil {
+		return nil, errors.Wrapf(FreshnessError, "snapshot: %s", err.Error())
+	}
+	if err := s.Check(now, u.opts.ClockSkew); err != nil {
+		return nil, errors.Wrap(FreshnessError, err.Error())
+	}
+	if !s.Matches(m) {
+		return nil, errors.Wrapf(FreshnessError, "snapshot %d doesn't match the documents of the manifest", s.Version)
+	}
+
+	return s, nil
+}
+
+// loadRoots accepts the root documents saved in the state directory.
+func (u *Updater) loadRoots() error {
+	b, err := os.ReadFile(filepath.Join(u.opts.StateDir, rootsFile))
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return errors.Wrap(err, "read roots")
+	}
+
+	roots := make([]*imagestore.Signed, 0)
+	if err := json.Unmarshal(b, &roots); err != nil {
+		return errors.Wrap(err, "parse roots")
+	}
+
+	_, err = u.updateRoots(roots)
+	return err
+}
+
+// saveRoots saves the accepted root documents to the state directory.
+func (u *Updater) saveRoots() error {
+	b, err := json.Marshal(u.roots)
+	if err != nil {
+		return errors.Wrap(err, "save roots")
+	}
+
+	if err := os.MkdirAll(u.opts.StateDir, 0755); err != nil {
+		return errors.Wrap(err, "create state dir")
+	}
+
+	fileName := filepath.Join(u.opts.StateDir, rootsFile)
+	if err := os.WriteFile(fileName+".tmp", b, 0644); err != nil {
+		return errors.Wrap(err, "save roots")
+	}
+
+	return errors.Wrap(os.Rename(fileName+".tmp", fileName), "save roots")
+}
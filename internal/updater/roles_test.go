@@ -0,0 +1,237 @@
+package updater_test
+
+import (
+	"context"
+	"encoding/json"
+	"sort"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+
+	"nametag/internal/imagestore"
+	"nametag/internal/signature/sign"
+	"nametag/internal/signature/verify"
+	"nametag/internal/updater"
+)
+
+// testRoles are the keys of the roles, the root key is the embedded one.
+type testRoles map[string]sign.Signer
+
+func newTestRoles(t *testing.T) testRoles {
+	root, err := sign.New()
+	assert.Nil(t, err, "sign.New")
+
+	return testRoles{
+		imagestore.RoleRoot:      root,
+		imagestore.RoleTargets:   newEd25519Signer(t),
+		imagestore.RoleSnapshot:  newEd25519Signer(t),
+		imagestore.RoleTimestamp: newEd25519Signer(t),
+	}
+}
+
+// root returns the root document of the keys signed by signers.
+func (r testRoles) root(t *testing.T, version int64, expiresAt time.Time, signers ...sign.Signer) *imagestore.Signed {
+	root := &imagestore.Root{Version: version, ExpiresAt: expiresAt, Keys: map[string]imagestore.PublicKey{}, Roles: map[string]imagestore.Role{}}
+	for role, s := range r {
+		root.Keys[s.KeyID()] = imagestore.PublicKey{Alg: s.Alg(), Key: s.PublicKey()}
+		root.Roles[role] = imagestore.Role{KeyIDs: []string{s.KeyID()}, Threshold: 1}
+	}
+
+	signed, err := imagestore.NewSigned(signers[0], root)
+	assert.Nil(t, err, "NewSigned root")
+	for _, s := range signers[1:] {
+		assert.Nil(t, signed.AddSignature(s), "AddSignature root")
+	}
+
+	return signed
+}
+
+// roleManifest returns the manifest of the release signed by targets,
+// snapshot and timestamp are the signers of the snapshot and the timestamp.
+func roleManifest(t *testing.T, targets, snapshot, timestamp sign.Signer, roots ...*imagestore.Signed) *imagestore.Manifest {
+	m := &imagestore.Manifest{}
+	assert.Nil(t, json.Unmarshal([]byte(signManifestBy(t, targets, `{"releases": [{"version": "2.0.0", "channel": "stable"}]}`)), m), "Unmarshal")
+	m.Roots = roots
+
+	signSnapshot(t, m, snapshot, timestamp, nil)
+	return m
+}
+
+// signSnapshot pins the releases of the manifest by the new snapshot with the rollouts
+// by the version and the snapshot by the new timestamp.
+func signSnapshot(t *testing.T, m *imagestore.Manifest, snapshot, timestamp sign.Signer, rollouts map[string]imagestore.Rollout) {
+	s := &imagestore.Snapshot{Version: 1, IssuedAt: time.Now(), ExpiresAt: time.Now().Add(time.Hour), Rollouts: map[string]imagestore.Rollout{}}
+	for _, im := range m.Releases {
+		s.Releases = append(s.Releases, im.Release.FileSum)
+		if r, ok := rollouts[im.Version.String()]; ok {
+			s.Rollouts[im.Release.FileSum] = r
+		}
+	}
+	sort.Strings(s.Releases)
+
+	signed, err := imagestore.NewSigned(snapshot, s)
+	assert.Nil(t, err, "NewSigned snapshot")
+	m.Snapshot = signed
+
+	stampManifest(t, timestamp, m, time.Now().Unix(), time.Now().Add(time.Hour))
+}
+
+// checkRoles returns the offered version or the error of a single check.
+func checkRoles(t *testing.T, stateDir string, m *imagestore.Manifest) string {
+	ver, err := verify.New()
+	assert.Nil(t, err, "verify.New")
+
+	return checkRolesBy(t, ver, stateDir, m)
+}
+
+func checkRolesBy(t *testing.T, ver *verify.Verifier, stateDir string, m *imagestore.Manifest) string {
+	b, err := json.Marshal(m)
+	assert.Nil(t, err, "Marshal")
+
+	u := newVerifiedTestUpdater(t, ver, string(b), updater.WithStateDir(stateDir))
+
+	var got updater.HookInfo
+	u.AddHook(updater.StageBeforeDownload, time.Second, func(_ context.Context, info updater.HookInfo) error {
+		got = info
+		return updater.ErrVeto
+	})
+	success, err := u.CheckOnce()
+	assert.False(t, success)
+
+	if err != nil {
+		return err.Error()
+	}
+	if got.NewVersion == nil {
+		return ""
+	}
+	return got.NewVersion.String()
+}
+
+func Test_Roles(t *testing.T) {
+	r := newTestRoles(t)
+	root, targets, snapshot, timestamp := r[imagestore.RoleRoot], r[imagestore.RoleTargets], r[imagestore.RoleSnapshot], r[imagestore.RoleTimestamp]
+	expiresAt := time.Now().Add(time.Hour)
+	root1 := r.root(t, 1, expiresAt, root)
+
+	t.Run("roles", func(t *testing.T) {
+		stateDir := t.TempDir()
+		assert.Contains(t, checkRoles(t, stateDir, roleManifest(t, targets, snapshot, timestamp)), verify.UnknownKeyError.Error(), "no root")
+		assert.Equal(t, "2.0.0", checkRoles(t, stateDir, roleManifest(t, targets, snapshot, timestamp, root1)))
+		assert.FileExists(t, stateDir+"/roots.json")
+		assert.Equal(t, "2.0.0", checkRoles(t, stateDir, roleManifest(t, targets, snapshot, timestamp)), "the root is loaded after the restart")
+	})
+
+	t.Run("wrong role", func(t *testing.T) {
+		// the keys are trusted, but they sign the documents of the other roles
+		assert.Equal(t, "2.0.0", checkRoles(t, t.TempDir(), roleManifest(t, targets, snapshot, timestamp, root1)))
+		assert.Contains(t, checkRoles(t, t.TempDir(), roleManifest(t, targets, timestamp, timestamp, root1)), updater.FreshnessError.Error(), "snapshot")
+		assert.Contains(t, checkRoles(t, t.TempDir(), roleManifest(t, targets, snapshot, snapshot, root1)), updater.FreshnessError.Error(), "timestamp")
+
+		assert.NotEqual(t, "2.0.0", checkRoles(t, t.TempDir(), roleManifest(t, root, snapshot, timestamp, root1)), "release")
+	})
+
+	t.Run("mix and match", func(t *testing.T) {
+		// the release isn't pinned by the snapshot
+		m := roleManifest(t, targets, snapshot, timestamp, root1)
+		other := roleManifest(t, targets, snapshot, timestamp)
+		m.Releases = other.Releases
+		assert.Contains(t, checkRoles(t, t.TempDir(), m), updater.FreshnessError.Error())
+
+		// the snapshot isn't pinned by the timestamp
+		m = roleManifest(t, targets, snapshot, timestamp, root1)
+		m.Snapshot = nil
+		assert.Contains(t, checkRoles(t, t.TempDir(), m), updater.FreshnessError.Error())
+
+		// the newest release is deleted to freeze the client on the old one
+		m = &imagestore.Manifest{Roots: []*imagestore.Signed{root1}}
+		releases := `{"releases": [{"version": "2.1.0", "channel": "stable"}, {"version": "2.0.0", "channel": "stable"}]}`
+		assert.Nil(t, json.Unmarshal([]byte(signManifestBy(t, targets, releases)), m), "Unmarshal")
+		signSnapshot(t, m, snapshot, timestamp, nil)
+		assert.Equal(t, "2.1.0", checkRoles(t, t.TempDir(), m))
+		m.Releases = m.Releases[1:]
+		assert.Contains(t, checkRoles(t, t.TempDir(), m), updater.FreshnessError.Error(), "deleted")
+	})
+
+	t.Run("rollout", func(t *testing.T) {
+		// the client selects its cohort by the signed rollout, the unsigned one is ignored
+		hidden := imagestore.Rollout{{At: time.Now().Add(-time.Hour), Percent: 0}}
+		m := roleManifest(t, targets, snapshot, timestamp, root1)
+		signSnapshot(t, m, snapshot, timestamp, map[string]imagestore.Rollout{"2.0.0": hidden})
+		assert.Empty(t, checkRoles(t, t.TempDir(), m), "not rolled out")
+
+		m = roleManifest(t, targets, snapshot, timestamp, root1)
+		m.Releases[0].Rollout = hidden
+		signSnapshot(t, m, snapshot, timestamp, map[string]imagestore.Rollout{"2.0.0": {{At: time.Now().Add(-time.Hour), Percent: 100}}})
+		assert.Equal(t, "2.0.0", checkRoles(t, t.TempDir(), m), "rolled out")
+	})
+
+	t.Run("untrusted root", func(t *testing.T) {
+		forged := r.root(t, 1, expiresAt, targets)
+		assert.Contains(t, checkRoles(t, t.TempDir(), roleManifest(t, targets, snapshot, timestamp, forged)), updater.RootError.Error())
+
+		expired := r.root(t, 1, time.Now().Add(-time.Hour), root)
+		assert.Contains(t, checkRoles(t, t.TempDir(), roleManifest(t, targets, snapshot, timestamp, expired)), updater.RootError.Error())
+	})
+
+	t.Run("root update", func(t *testing.T) {
+		stateDir := t.TempDir()
+		assert.Equal(t, "2.0.0", checkRoles(t, stateDir, roleManifest(t, targets, snapshot, timestamp, root1)))
+
+		// the new root replaces the root and the timestamp keys
+		next := testRoles{
+			imagestore.RoleRoot:      newEd25519Signer(t),
+			imagestore.RoleTargets:   targets,
+			imagestore.RoleSnapshot:  snapshot,
+			imagestore.RoleTimestamp: newEd25519Signer(t),
+		}
+		newTimestamp := next[imagestore.RoleTimestamp]
+
+		// the new root must be signed by the old root key and by its own key
+		notOld := next.root(t, 2, expiresAt, next[imagestore.RoleRoot])
+		assert.Contains(t, checkRoles(t, stateDir, roleManifest(t, targets, snapshot, newTimestamp, root1, notOld)), updater.RootError.Error())
+		notNew := next.root(t, 2, expiresAt, root)
+		ver, err := verify.New()
+		assert.Nil(t, err, "verify.New")
+		assert.Contains(t, checkRolesBy(t, ver, stateDir, roleManifest(t, targets, snapshot, newTimestamp, root1, notNew)), updater.RootError.Error())
+		assert.NotContains(t, ver.KeyIDs(), newTimestamp.KeyID(), "the keys of the rejected root aren't trusted")
+		assert.NotContains(t, ver.KeyIDs(), next[imagestore.RoleRoot].KeyID(), "the keys of the rejected root aren't trusted")
+		skipped := next.root(t, 3, expiresAt, root, next[imagestore.RoleRoot])
+		assert.Contains(t, checkRoles(t, stateDir, roleManifest(t, targets, snapshot, newTimestamp, root1, skipped)), updater.RootError.Error())
+
+		root2 := next.root(t, 2, expiresAt, root, next[imagestore.RoleRoot])
+		assert.Equal(t, "2.0.0", checkRoles(t, stateDir, roleManifest(t, targets, snapshot, newTimestamp, root1, root2)), "updated")
+		assert.Contains(t, checkRoles(t, stateDir, roleManifest(t, targets, snapshot, timestamp, root1, root2)), updater.FreshnessError.Error(), "the old timestamp key")
+		assert.Equal(t, "2.0.0", checkRoles(t, stateDir, roleManifest(t, targets, snapshot, newTimestamp)), "the roots are loaded after the restart")
+	})
+
+	t.Run("rotation by the new root", func(t *testing.T) {
+		next := testRoles{
+			imagestore.RoleRoot:      newEd25519Signer(t),
+			imagestore.RoleTargets:   targets,
+			imagestore.RoleSnapshot:  snapshot,
+			imagestore.RoleTimestamp: timestamp,
+		}
+		root2 := next.root(t, 2, expiresAt, root, next[imagestore.RoleRoot])
+
+		// the rotation is signed by the root key of the root 2 which comes in the same manifest
+		s := newEd25519Signer(t)
+		rotation, err := imagestore.NewSigned(next[imagestore.RoleRoot], &imagestore.KeyRotation{KeyID: s.KeyID(), Alg: s.Alg(), Key: s.PublicKey()})
+		assert.Nil(t, err, "NewSigned")
+		assert.Nil(t, rotation.AddSignature(s), "AddSignature")
+
+		stateDir := t.TempDir()
+		m := roleManifest(t, targets, snapshot, timestamp, root1, root2)
+		m.Rotations = []*imagestore.Signed{rotation}
+		ver, err := verify.New()
+		assert.Nil(t, err, "verify.New")
+		assert.Equal(t, "2.0.0", checkRolesBy(t, ver, stateDir, m))
+		assert.Contains(t, ver.KeyIDs(), s.KeyID(), "rotated")
+
+		// the saved rotation is applied after the saved roots
+		ver, err = verify.New()
+		assert.Nil(t, err, "verify.New")
+		assert.Equal(t, "2.0.0", checkRolesBy(t, ver, stateDir, roleManifest(t, targets, snapshot, timestamp)))
+		assert.Contains(t, ver.KeyIDs(), s.KeyID(), "rotated after the restart")
+	})
+}
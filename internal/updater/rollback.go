@@ -0,0 +1,55 @@
+package updater
+
+import (
+	"slices"
+
+	"github.com/pkg/errors"
+
+	"nametag/internal/imagestore"
+)
+
+// rollbackDirective returns the verified rollback directive from the manifest, nil if there is none.
+// The invalid directive is ignored, it must not stop the normal updates.
+func (u *Updater) rollbackDirective(m *imagestore.Manifest) *imagestore.Rollback {
+	if m.Rollback == nil {
+		return nil
+	}
+
+	r := &imagestore.Rollback{}
+	if err := u.openRole(m.Rollback, imagestore.RoleTargets, u.opts.SignatureThreshold, r); err != nil {
+		u.log.Errorf("ignore rollback directive: %s", err.Error())
+		return nil
+	}
+	if err := r.Check(); err != nil {
+		u.log.Errorf("ignore rollback directive: %s", err.Error())
+		return nil
+	}
+
+	return r
+}
+
+// rollbackTarget returns the image of the directive if the current version must go back to it.
+// The image must have one of the hashes from the signed directive and must be built for the platform.
+// The revoked target is not installed.
+func (u *Updater) rollbackTarget(m *imagestore.Manifest, r *imagestore.Rollback, revoked *imagestore.Revocations) (*imagestore.Image, error) {
+	if r == nil || !r.Applies(u.currentVersion) || u.skipped(r.Target) || revoked.Revoked(r.Target) != nil {
+		return nil, nil
+	}
+
+	var target *imagestore.Image
+	for _, im := range m.Releases {
+		if !im.Version.Equal(r.Target) || !slices.Contains(r.TargetSums, im.FileSum) {
+			continue
+		}
+		if u.opts.Platform.Supports(platformOf(im)) && better(im, target) {
+			target = im
+		}
+	}
+
+	if target == nil {
+		return nil, errors.Wrapf(PlatformError, "rollback target %s for %s is not in the manifest", r.Target, u.opts.Platform)
+	}
+
+	u.log.Infof("rollback from %s to %s: %s", u.currentVersion, r.Target, r.Reason)
+	return target, nil
+}
@@ -0,0 +1,73 @@
+package updater_test
+
+import (
+	"context"
+	"encoding/base64"
+	"fmt"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+
+	"nametag/internal/updater"
+)
+
+// rollbackManifest publishes the directive from 1.0.0 to 0.9.0 and the newer 1.0.1.
+// The tampered directive doesn't match the signed hash.
+func rollbackManifest(t *testing.T, directive string, tamper bool) string {
+	signed := signedDocument(t, directive)
+	if tamper {
+		signed = strings.Replace(signed, base64.URLEncoding.EncodeToString([]byte(directive)),
+			base64.URLEncoding.EncodeToString([]byte(`{"target": "0.8.0", "target_sums": ["old"], "from": ">= 1.0.0"}`)), 1)
+	}
+
+	return fmt.Sprintf(`{
+		"releases": [
+			{"version": "1.0.1", "channel": "stable", "file_sum": "new"},
+			{"version": "1.0.0", "channel": "stable", "file_sum": "broken"},
+			{"version": "0.9.0", "channel": "stable", "file_sum": "good"},
+			{"version": "0.8.0", "channel": "stable", "file_sum": "old"}
+		],
+		"rollback": %s
+	}`, signed)
+}
+
+func Test_Rollback(t *testing.T) {
+	tests := []struct {
+		name      string
+		directive string
+		tamper    bool
+		want      string
+	}{
+		{"rollback", `{"target": "0.9.0", "target_sums": ["good"], "from": ">= 1.0.0, < 1.0.1"}`, false, "0.9.0"},
+		{"tampered", `{"target": "0.9.0", "target_sums": ["good"], "from": ">= 1.0.0, < 1.0.1"}`, true, "1.0.1"},
+		{"other image", `{"target": "0.9.0", "target_sums": ["evil"], "from": ">= 1.0.0, < 1.0.1"}`, false, ""},
+		{"not broken", `{"target": "0.9.0", "target_sums": ["good"], "from": "= 0.9.5"}`, false, "1.0.1"},
+		{"newer is broken", `{"target": "0.9.0", "target_sums": ["good"], "from": ">= 1.0.1"}`, false, ""},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			u := newTestUpdater(t, rollbackManifest(t, tt.directive, tt.tamper))
+
+			var got updater.HookInfo
+			u.AddHook(updater.StageBeforeDownload, time.Second, func(_ context.Context, info updater.HookInfo) error {
+				got = info
+				return updater.ErrVeto
+			})
+			success, err := u.CheckOnce()
+			assert.False(t, success)
+
+			if tt.want == "" {
+				assert.Nil(t, got.NewVersion, "no update")
+				return
+			}
+			assert.Nil(t, err, "CheckOnce")
+			if assert.NotNil(t, got.NewVersion, "update") {
+				assert.Equal(t, tt.want, got.NewVersion.String())
+				assert.Equal(t, tt.want == "0.9.0", got.Rollback, "rollback")
+			}
+		})
+	}
+}
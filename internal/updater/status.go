@@ -0,0 +1,97 @@
+package updater
+
+import (
+	"time"
+
+	"nametag/internal/imagestore"
+)
+
+// Status is the state of the updater for the host application.
+type Status struct {
+	CurrentVersion string
+	Channel        string
+
+	// LastCheck is the time of the last check, LastError is its error if it failed.
+	LastCheck time.Time
+	LastError string
+
+	// LatestVersion is the newest release in the channel for the platform, empty if it's unknown.
+	LatestVersion string
+
+	// AvailableVersion is the newest release which is allowed by the version policy
+	// and is newer than the current version, empty if there is nothing to install.
+	AvailableVersion string
+
+	// BlockedVersion is the newer release which isn't installed because of the version policy
+	// (see Options.VersionConstraints, PinVersion and SameMajorVersion), BlockedReason explains why.
+	// If the current version is revoked and the policy allows no good release,
+	// it's the release which is installed anyway.
+	BlockedVersion string
+	BlockedReason  string
+
+	// Revoked is set if the current version is revoked by the server,
+	// the next good version is installed as a mandatory update.
+	Revoked       bool
+	RevokedReason string
+
+	Progress Progress
+}
+
+// Status returns the state of the updater after the last check.
+func (u *Updater) Status() Status {
+	u.mx.RLock()
+	defer u.mx.RUnlock()
+
+	s := u.status
+	s.CurrentVersion = u.currentVersion.String()
+	s.Channel = u.channel
+	s.Progress = u.progress
+
+	return s
+}
+
+// setChecked saves the result of the check.
+func (u *Updater) setChecked(err error) {
+	u.mx.Lock()
+	defer u.mx.Unlock()
+
+	u.status.LastCheck = time.Now()
+	u.status.LastError = ""
+	if err != nil {
+		u.status.LastError = err.Error()
+	}
+}
+
+// setReleases saves the releases found in the manifest.
+func (u *Updater) setReleases(sel selection) {
+	u.mx.Lock()
+	defer u.mx.Unlock()
+
+	u.status.LatestVersion = versionOf(sel.latest)
+	u.status.AvailableVersion = versionOf(sel.im)
+	u.status.BlockedVersion = versionOf(sel.blocked)
+	u.status.BlockedReason = ""
+	if sel.reason != nil {
+		u.status.BlockedReason = sel.reason.Error()
+	}
+}
+
+func versionOf(im *imagestore.Image) string {
+	if im == nil || im.Version == nil {
+		return ""
+	}
+
+	return im.Version.String()
+}
+
+// setRevoked saves the revocation of the current version, nil if it's not revoked.
+func (u *Updater) setRevoked(rv *imagestore.Revocation) {
+	u.mx.Lock()
+	defer u.mx.Unlock()
+
+	u.status.Revoked = rv != nil
+	u.status.RevokedReason = ""
+	if rv != nil {
+		u.status.RevokedReason = rv.Reason
+	}
+}
@@ -0,0 +1,171 @@
+package updater_test
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/hashicorp/go-version"
+	"github.com/stretchr/testify/assert"
+
+	"nametag/internal/imagestore"
+	"nametag/internal/signature/sign"
+	"nametag/internal/signature/verify"
+	"nametag/internal/updater"
+)
+
+func Test_Threshold(t *testing.T) {
+	keys := []sign.Signer{newEd25519Signer(t), newEd25519Signer(t), newEd25519Signer(t)}
+	untrusted := newEd25519Signer(t)
+	embedded, err := sign.New()
+	assert.Nil(t, err, "sign.New")
+
+	// the copy of the signature without the key id is checked by any RSA key, the same one
+	unnamed := func(r *imagestore.Signed) {
+		r.Signatures = append(r.Signatures, imagestore.Signature{Sign: r.Sign})
+	}
+	duplicate := func(r *imagestore.Signed) {
+		r.Signatures = append(r.Signatures, imagestore.Signature{KeyID: r.KeyID, Alg: r.Alg, Sign: r.Sign})
+	}
+
+	tests := []struct {
+		name      string
+		threshold int
+		cosigners []sign.Signer
+		want      string
+
+		// server signs the release instead of the first key, forge changes the signatures
+		server sign.Signer
+		forge  func(r *imagestore.Signed)
+	}{
+		{"one key", 1, nil, "2.0.0", nil, nil},
+		{"2 of 3", 2, keys[1:2], "2.0.0", nil, nil},
+		{"3 of 3", 3, keys[1:], "2.0.0", nil, nil},
+		{"not enough", 2, nil, "", nil, nil},
+		{"same key", 2, keys[:1], "", nil, nil},
+		{"untrusted key", 2, []sign.Signer{untrusted}, "", nil, nil},
+		{"3 of 3 with 2", 3, keys[1:2], "", nil, nil},
+		{"unnamed copy", 2, nil, "", embedded, unnamed},
+		{"unnamed copy of one", 1, nil, "2.0.0", embedded, unnamed},
+		{"duplicate", 2, nil, "", keys[0], duplicate},
+		{"unnamed cosigner", 2, keys[1:2], "", keys[0], func(r *imagestore.Signed) { r.Signatures[0].KeyID = "" }},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ver, err := verify.New()
+			assert.Nil(t, err, "verify.New")
+			for _, k := range keys {
+				assert.Nil(t, ver.AddKey(k.Alg(), k.KeyID(), k.PublicKey()), "AddKey")
+			}
+
+			// the server signs by the first key, the others sign offline
+			server := tt.server
+			if server == nil {
+				server = keys[0]
+			}
+			m := &imagestore.Manifest{}
+			assert.Nil(t, json.Unmarshal([]byte(signManifestBy(t, server, `{"releases": [{"version": "2.0.0", "channel": "stable"}]}`)), m), "Unmarshal")
+			for _, k := range tt.cosigners {
+				assert.Nil(t, m.Releases[0].Release.AddSignature(k), "AddSignature")
+			}
+			if tt.forge != nil {
+				tt.forge(m.Releases[0].Release)
+			}
+
+			b, err := json.Marshal(m)
+			assert.Nil(t, err, "Marshal")
+
+			u := newVerifiedTestUpdater(t, ver, string(b), updater.WithSignatureThreshold(tt.threshold))
+
+			var got updater.HookInfo
+			u.AddHook(updater.StageBeforeDownload, time.Second, func(_ context.Context, info updater.HookInfo) error {
+				got = info
+				return updater.ErrVeto
+			})
+			success, err := u.CheckOnce()
+			assert.False(t, success)
+			assert.Nil(t, err, "CheckOnce")
+
+			if tt.want == "" {
+				assert.Nil(t, got.NewVersion, "rejected")
+				return
+			}
+			if assert.NotNil(t, got.NewVersion, "update") {
+				assert.Equal(t, tt.want, got.NewVersion.String())
+			}
+		})
+	}
+}
+
+func Test_ThresholdDocuments(t *testing.T) {
+	keys := []sign.Signer{newEd25519Signer(t), newEd25519Signer(t)}
+
+	rollback := &imagestore.Rollback{From: ">= 1.0.0"}
+	rollback.Target, _ = version.NewVersion("0.9.0")
+	rollback.TargetSums = []string{"good"}
+	v100, _ := version.NewVersion("1.0.0")
+	revoked := &imagestore.Revocations{Versions: []imagestore.Revocation{{Version: v100}}}
+
+	tests := []struct {
+		name      string
+		field     string
+		document  any
+		cosigners []sign.Signer
+		want      string
+	}{
+		{"rollback by one key", "rollback", rollback, nil, ""},
+		{"rollback by 2 keys", "rollback", rollback, keys[1:], "0.9.0"},
+		{"revoked by one key", "revoked", revoked, nil, ""},
+		{"revoked by 2 keys", "revoked", revoked, keys[1:], "0.9.0"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ver, err := verify.New()
+			assert.Nil(t, err, "verify.New")
+			for _, k := range keys {
+				assert.Nil(t, ver.AddKey(k.Alg(), k.KeyID(), k.PublicKey()), "AddKey")
+			}
+
+			// one stolen key can't downgrade the clients, the releases are co-signed
+			signed, err := imagestore.NewSigned(keys[0], tt.document)
+			assert.Nil(t, err, "NewSigned")
+			for _, k := range tt.cosigners {
+				assert.Nil(t, signed.AddSignature(k), "AddSignature")
+			}
+			doc, err := json.Marshal(signed)
+			assert.Nil(t, err, "Marshal")
+
+			m := &imagestore.Manifest{}
+			manifest := fmt.Sprintf(`{"releases": [{"version": "0.9.0", "channel": "stable", "file_sum": "good"}], %q: %s}`, tt.field, doc)
+			assert.Nil(t, json.Unmarshal([]byte(signManifestBy(t, keys[0], manifest)), m), "Unmarshal")
+			assert.Nil(t, m.Releases[0].Release.AddSignature(keys[1]), "AddSignature")
+
+			b, err := json.Marshal(m)
+			assert.Nil(t, err, "Marshal")
+
+			u := newVerifiedTestUpdater(t, ver, string(b), updater.WithSignatureThreshold(2))
+
+			var got updater.HookInfo
+			u.AddHook(updater.StageBeforeDownload, time.Second, func(_ context.Context, info updater.HookInfo) error {
+				got = info
+				return updater.ErrVeto
+			})
+			success, err := u.CheckOnce()
+			assert.False(t, success)
+			assert.Nil(t, err, "CheckOnce")
+
+			if tt.want == "" {
+				assert.Nil(t, got.NewVersion, "ignored")
+				assert.False(t, u.Status().Revoked, "not revoked")
+				return
+			}
+			if assert.NotNil(t, got.NewVersion, "downgrade") {
+				assert.Equal(t, tt.want, got.NewVersion.String())
+			}
+		})
+	}
+}
@@ -9,6 +9,7 @@ import (
 	"net/url"
 	"os"
 	"os/exec"
+	"sync"
 	"time"
 
 	"github.com/hashicorp/go-version"
@@ -19,32 +20,60 @@ import (
 	"nametag/internal/lg"
 )
 
-const (
-	// CheckURL is the URL to check for updates
-	// todo: move to configuration
-	CheckURL = "http://127.0.0.1:8080"
-
-	// ScanFrequency specifies how often request new image. For test it's set up to 10 second.
-	// todo: move to configuration
-	ScanFrequency = 10 * time.Second
-)
-
 var (
 	NetError          = errors.Errorf("net error")
 	CheckVersionError = errors.Errorf("check versition error")
 	RunError          = errors.Errorf("run app error")
 )
 
-// Verifier checks binaryData signature by public key
+// Verifier checks the signature of the message by the public key with keyID and the algorithm alg,
+// see imagestore.Signed.Message. The empty keyID and alg are for the documents of the old servers.
+// It returns the id of the key which verified the signature.
 type Verifier interface {
-	Verify(binaryData, signature string) error
+	Verify(alg, keyID, message, signature string) (string, error)
 }
 
 type Updater struct {
 	// current process parameters for passing to the new process
-	pwdDir          string
-	execName        string
-	commandLineArgs []string
+	// and the update server settings
+	opts Options
+
+	// channel is the release channel, it can be changed by SetChannel while Check is running
+	mx      sync.RWMutex
+	channel string
+
+	// skippedVersions are the versions which didn't pass the health check
+	// or are vetoed by the hooks, they are not installed again by this process
+	skippedVersions map[string]struct{}
+
+	hooks []hook
+
+	// policy limits the versions which are installed automatically
+	policy *policy
+
+	// status is the result of the last check
+	status Status
+
+	// progress is the state of the current download
+	progress Progress
+
+	// failures in a row for each class of errors and the delay asked by the server or the hooks,
+	// they are used by the Check goroutine only
+	failures map[error]int
+	minDelay time.Duration
+
+	// manifestVersion is the highest seen version of the manifest timestamp, it's used by the Check goroutine only
+	manifestVersion int64
+
+	// rotations are the applied key rotation documents, rotated marks the applied (true)
+	// and the rejected (false) ones by FileSum, they are used by the Check goroutine only
+	rotations []*imagestore.Signed
+	rotated   map[string]bool
+
+	// root is the last accepted root document, nil without the roots,
+	// roots are the accepted root documents, the oldest first
+	root  *imagestore.Root
+	roots []*imagestore.Signed
 
 	// objects to check and identify the new version
 	verifier       Verifier
@@ -54,33 +83,102 @@ type Updater struct {
 	log *lg.Logger
 }
 
-func New(log *lg.Logger, ver Verifier, currentVersion string) (*Updater, error) {
-	// Get the current process exe file and directory.
-	pwdDir, err := os.Getwd()
+// New creates the Updater. Options are applied in order over DefaultOptions,
+// so the later ones win, e.g. New(log, ver, v, WithConfigFile(f), WithEnv()).
+func New(log *lg.Logger, ver Verifier, currentVersion string, options ...Option) (*Updater, error) {
+	opts, err := DefaultOptions()
+	if err != nil {
+		return nil, err
+	}
+
+	for _, option := range options {
+		if err := option(&opts); err != nil {
+			return nil, err
+		}
+	}
+
+	if err := opts.Validate(); err != nil {
+		return nil, errors.Wrap(err, "updater options")
+	}
+
+	c, err := version.NewVersion(currentVersion)
 	if err != nil {
 		return nil, err
 	}
-	execName, err := os.Executable()
+
+	p, err := opts.policy()
 	if err != nil {
 		return nil, err
 	}
 
-	args := make([]string, len(os.Args))
-	copy(args, os.Args)
+	if opts.InstanceID == "" {
+		if opts.InstanceID, err = loadInstanceID(opts.StateDir); err != nil {
+			return nil, err
+		}
+	}
 
-	c, err := version.NewVersion(currentVersion)
+	manifestVersion, err := loadManifestVersion(opts.StateDir)
 	if err != nil {
 		return nil, err
 	}
 
-	return &Updater{
+	u := &Updater{
 		log:             log,
 		verifier:        ver,
 		currentVersion:  c,
-		commandLineArgs: args,
-		pwdDir:          pwdDir,
-		execName:        execName,
-	}, nil
+		opts:            opts,
+		channel:         opts.Channel,
+		policy:          p,
+		manifestVersion: manifestVersion,
+		skippedVersions: map[string]struct{}{},
+		failures:        map[error]int{},
+		rotated:         map[string]bool{},
+	}
+
+	rotations, err := u.loadKeys()
+	if err != nil {
+		return nil, err
+	}
+	if err := u.loadRoots(); err != nil {
+		return nil, err
+	}
+	// the rotation may be signed by the keys of the saved root
+	u.rotateKeys(rotations)
+
+	// the update is downloaded at once, but it's applied in the maintenance window
+	if len(opts.MaintenanceWindows) > 0 {
+		u.AddHook(StageBeforeApply, DefaultHookTimeout, u.windowHook)
+	}
+
+	return u, nil
+}
+
+// Channel returns the release channel which the updater follows.
+func (u *Updater) Channel() string {
+	u.mx.RLock()
+	defer u.mx.RUnlock()
+
+	return u.channel
+}
+
+// SetChannel switches the updater to another release channel.
+// The switch is safe: if the current version is newer than the last release
+// of the new channel (e.g. beta -> stable), the updater doesn't downgrade
+// and waits until the channel catches up with the current version.
+func (u *Updater) SetChannel(channel string) error {
+	if err := imagestore.CheckChannel(channel); err != nil {
+		return err
+	}
+
+	u.mx.Lock()
+	defer u.mx.Unlock()
+
+	if u.channel != channel {
+		u.log.Infof("switch channel from %s to %s", u.channel, channel)
+		u.channel = channel
+	}
+
+	return nil
 }
 
 // errorHandler is an example of an error handler.
@@ -98,32 +196,37 @@ func (u *Updater) errorHandler(err error) {
 // Check checks for new versions of the program and updates it.
 // It returns true if new process is success run
 // It's a blocking function.
+// The first check is delayed by a random splay, the failed checks are retried
+// with the exponential backoff for the class of the error.
 func (u *Updater) Check(ctx context.Context) bool {
-	success, err := u.checkAndRun()
-	u.errorHandler(err)
+	t := time.NewTimer(splay(u.opts.InitialSplay))
+	defer t.Stop()
 
-	if success {
-		return true
-	}
-
-	t := time.NewTicker(ScanFrequency)
 	for {
 		select {
 		case <-ctx.Done():
 			return false
 		case <-t.C:
+			u.minDelay = 0
 			success, err := u.checkAndRun()
+			u.setChecked(err)
 			u.errorHandler(err)
 
 			if success {
 				return true
 			}
+
+			t.Reset(u.nextDelay(err))
 		}
 	}
 }
 
 func (u *Updater) checkAndRun() (bool, error) {
+	// the manifest which isn't received is NetError, the bad or untrusted one is CheckVersionError
 	im, err := u.checkNewVersion()
+	if errors.Is(err, NetError) {
+		return false, err
+	}
 	if err != nil {
 		return false, errors.Wrapf(CheckVersionError, err.Error())
 	}
@@ -132,43 +235,159 @@ func (u *Updater) checkAndRun() (bool, error) {
 		return false, nil
 	}
 
+	info := u.hookInfo(im)
+	if err := u.runHooks(StageBeforeDownload, info); err != nil {
+		return false, u.hookStopped(im.Version, err)
+	}
+
 	if err := u.loadNewVersion(im); err != nil {
+		if errors.Is(err, HookError) {
+			return false, u.hookStopped(im.Version, err)
+		}
 		return false, errors.Wrapf(NetError, err.Error())
 	}
 
-	success, err := u.runNext()
+	// the new binary is applied, restore the previous one if the hooks stop the update
+	for _, stage := range []Stage{StageAfterApply, StageBeforeRestart} {
+		if err := u.runHooks(stage, info); err != nil {
+			if rerr := u.restorePrevious(); rerr != nil {
+				return false, errors.Wrap(RunError, rerr.Error())
+			}
+			return false, u.hookStopped(im.Version, err)
+		}
+	}
+
+	// the previous binary is restored after any failure, the new version isn't installed again
+	success, err := u.runNext(im.Version)
 	if err != nil {
+		u.skipVersion(im.Version)
 		err = errors.Wrap(RunError, err.Error())
+
+		info.Err = err
+		if herr := u.runHooks(StageAfterRestartFailed, info); herr != nil {
+			u.log.Errorf("%s", herr.Error())
+		}
 	}
 
 	return success, err
 }
 
+// skipVersion stops installing the version by this process.
+func (u *Updater) skipVersion(v *version.Version) {
+	u.mx.Lock()
+	defer u.mx.Unlock()
+
+	u.skippedVersions[v.String()] = struct{}{}
+}
+
+func (u *Updater) skipped(v *version.Version) bool {
+	u.mx.RLock()
+	defer u.mx.RUnlock()
+
+	_, find := u.skippedVersions[v.String()]
+	return find
+}
+
 func (u *Updater) checkNewVersion() (*imagestore.Image, error) {
-	resp, err := http.Get(CheckURL)
+	uri, err := url.JoinPath(u.opts.CheckURL, imagestore.ManifestPath)
 	if err != nil {
 		return nil, err
 	}
+
+	req, err := http.NewRequest(http.MethodGet, uri, nil)
+	if err != nil {
+		return nil, err
+	}
+	// the server selects the releases of the staged rollouts by the instance ID
+	req.Header.Set(imagestore.InstanceHeader, u.opts.InstanceID)
+
+	resp, err := u.opts.HTTPClient.Do(req)
+	if err != nil {
+		return nil, errors.Wrapf(NetError, "get manifest: %s", err)
+	}
 	defer resp.Body.Close()
 
+	// the overloaded server asks to come back later
+	u.setMinDelay(retryAfter(resp.Header))
+	if resp.StatusCode != http.StatusOK {
+		return nil, errors.Wrapf(NetError, "get manifest: status %d", resp.StatusCode)
+	}
+
 	b, err := io.ReadAll(resp.Body)
 	if err != nil {
+		return nil, errors.Wrapf(NetError, "read manifest: %s", err)
+	}
+
+	manifest := &imagestore.Manifest{}
+	if err := json.Unmarshal(b, manifest); err != nil {
 		return nil, err
 	}
+	u.setMinDelay(time.Duration(manifest.NextCheckAfter) * time.Second)
 
-	im := &imagestore.Image{}
-	if err := json.Unmarshal(b, im); err != nil {
+	// the documents below may be signed by the new key
+	if u.rotateKeys(manifest.Rotations) {
+		if err := u.saveKeys(); err != nil {
+			return nil, err
+		}
+	}
+
+	// the roles of the new root are used for the documents below
+	if changed, err := u.updateRoots(manifest.Roots); err != nil {
 		return nil, err
+	} else if changed {
+		if err := u.saveRoots(); err != nil {
+			return nil, err
+		}
+
+		// the rotation may be signed by the keys of the new root
+		if u.rotateKeys(manifest.Rotations) {
+			if err := u.saveKeys(); err != nil {
+				return nil, err
+			}
+		}
 	}
 
-	if im.Version.Compare(u.currentVersion) < 1 {
-		return nil, nil
+	// the stale manifest is rejected at all, only the signed fields of the releases are used below
+	now := time.Now()
+	if err := u.checkRoot(now); err != nil {
+		return nil, err
 	}
+	snapshot, err := u.checkFreshness(manifest, now)
+	if err != nil {
+		return nil, err
+	}
+	u.verifyReleases(manifest, now)
+	u.rolledOut(manifest, snapshot, now)
+
+	// the server asks to go back from the broken version, it's the only way to downgrade
+	rollback := u.rollbackDirective(manifest)
+	revoked := u.revocations(manifest)
+	u.setRevoked(revoked.Revoked(u.currentVersion))
 
-	if err := u.verifier.Verify(im.FileSum, im.Sign); err != nil {
+	im, err := u.rollbackTarget(manifest, rollback, revoked)
+	if err != nil {
 		return nil, err
 	}
 
+	if im == nil {
+		sel := u.selectRelease(manifest, u.Channel(), rollback, revoked)
+		u.setReleases(sel)
+		if sel.blocked != nil {
+			u.log.Infof("version %s is blocked by the policy: %s", sel.blocked.Version, sel.reason)
+		}
+		if sel.missing != nil {
+			err := errors.Wrapf(PlatformError, "version %s for %s", sel.missing.Version, u.opts.Platform)
+			if sel.im == nil {
+				return nil, err
+			}
+			u.log.Errorf("%s, install %s", err.Error(), sel.im.Version)
+		}
+		if sel.im == nil {
+			return nil, nil
+		}
+		im = sel.im
+	}
+
 	return im, nil
 }
 
@@ -178,18 +397,76 @@ func (u *Updater) loadNewVersion(im *imagestore.Image) error {
 		return err
 	}
 
-	uri, _ := url.JoinPath(CheckURL, im.Uri)
-	resp2, err := http.Get(uri)
+	// the hooks are run once, before the patch or the full image is applied
+	approved := false
+	beforeApply := func() error {
+		if approved {
+			return nil
+		}
+		if err := u.runHooks(StageBeforeApply, u.hookInfo(im)); err != nil {
+			return err
+		}
+		approved = true
+		return nil
+	}
+
+	// the patch is much smaller, the full image is the fallback
+	if u.opts.DeltaUpdates {
+		found, err := u.loadPatch(im, signB, beforeApply)
+		if found && err == nil {
+			u.log.Infof("version %s is loaded by patch", im.Version)
+			return nil
+		}
+		if errors.Is(err, HookError) {
+			return err
+		}
+		if err != nil {
+			u.log.Errorf("load patch failed, load full image: %s", err.Error())
+		}
+	}
+
+	limit, err := u.imageLimit(im)
+	if err != nil {
+		return err
+	}
+
+	s := u.staging(im.FileSum)
+	f, err := u.download(im.Uri, s, u.opts.MaxImageSize)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	// the sum of the uncompressed image is signed, the file is checked before it's applied
+	if err := checkSum(f, im.Compression, limit, signB); err != nil {
+		s.Remove()
+		return errors.Wrapf(err, "downloaded %s", im.Uri)
+	}
+
+	if err := beforeApply(); err != nil {
+		// the vetoed version isn't loaded again, the postponed one is applied later
+		if errors.Is(err, ErrVeto) {
+			s.Remove()
+		}
+		return err
+	}
+
+	r, err := openImage(f, im.Compression, limit)
 	if err != nil {
+		s.Remove()
 		return err
 	}
-	defer resp2.Body.Close()
+	defer r.Close()
 
 	// pass the sign of file to check it
-	err = selfupdate.Apply(resp2.Body, selfupdate.Options{
-		Checksum: signB,
+	// and keep the previous version for the rollback
+	err = selfupdate.Apply(r, selfupdate.Options{
+		Checksum:    signB,
+		TargetPath:  u.opts.ExecPath,
+		OldSavePath: u.opts.OldSavePath,
 	})
 
+	s.Remove()
 	if err != nil {
 		return err
 	}
@@ -197,31 +474,85 @@ func (u *Updater) loadNewVersion(im *imagestore.Image) error {
 	return nil
 }
 
-// runNext starts the next version of the process.
-// It does not support any delays or timeouts.
+// runNext starts the next version v of the process.
+// If the health check is set up, it waits for the new process to become healthy,
+// otherwise the new process is killed and the previous binary is restored.
+// The previous binary is restored also if the new process can't be started.
 // We assume that all connections, sockets, files, etc. can be used together.
-// If you need to add a delay or reuse files, you need to pass and process them here.
-// In addition, it may be necessary to update the command arguments (c.Args)
-// to delay a new process while the current process closes connections, files, logs, etc.
-func (u *Updater) runNext() (bool, error) {
-	c := exec.Command(u.execName)
-	c.Args = u.commandLineArgs
+// The app can close its files, logs etc. in the StageBeforeRestart hook,
+// the listeners are passed by Options.Listeners.
+func (u *Updater) runNext(v *version.Version) (bool, error) {
+	c := exec.Command(u.opts.ExecPath)
+	c.Args = u.opts.Args
+	c.Dir = u.opts.WorkDir
 	c.Stdin = os.Stdin
 	c.Stdout = os.Stdout
 	c.Stderr = os.Stderr
 
+	// the health check fails if the new process runs the other version
+	if e, ok := u.opts.HealthCheck.(VersionExpecter); ok {
+		e.ExpectVersion(v)
+	}
+
+	preparers := make([]CommandPreparer, 0, 2)
+	if u.opts.Listeners != nil {
+		preparers = append(preparers, u.opts.Listeners)
+	}
+	if p, ok := u.opts.HealthCheck.(CommandPreparer); ok {
+		preparers = append(preparers, p)
+	}
+
+	// the parent's copies of the passed files are closed right after the start
+	cleanups := make([]func(), 0, len(preparers))
+	cleanup := func() {
+		for _, f := range cleanups {
+			f()
+		}
+	}
+
+	for _, p := range preparers {
+		f, err := p.PrepareCommand(c)
+		if err != nil {
+			cleanup()
+			return false, u.notStarted(err)
+		}
+		cleanups = append(cleanups, f)
+	}
+
 	// Start the command.
-	if err := c.Start(); err != nil {
-		return false, err
+	err := c.Start()
+	cleanup()
+	if err != nil {
+		return false, u.notStarted(err)
 	}
 
 	// Wait for the command to finish.
 	if c.Process != nil {
 		u.log.Infof("start new proccess pid: %d", c.Process.Pid)
 	} else {
-		return false, errors.New("process is nil")
+		return false, u.notStarted(errors.New("process is nil"))
+	}
+
+	if u.opts.HealthCheck == nil {
+		return true, nil
+	}
+
+	// the channel is closed after the exit, so both waitHealthy and rollback can wait for it
+	exited := make(chan error, 1)
+	go func() {
+		exited <- c.Wait()
+		close(exited)
+	}()
+
+	if err := u.waitHealthy(c.Process, exited); err != nil {
+		u.log.Errorf("new process %d is unhealthy: %s", c.Process.Pid, err.Error())
+		if rerr := u.rollback(c.Process, exited); rerr != nil {
+			return false, errors.Wrapf(rerr, "%s: %s", HealthCheckError, err)
+		}
+		return false, errors.Wrap(HealthCheckError, err.Error())
 	}
 
+	u.log.Infof("new proccess pid: %d is healthy", c.Process.Pid)
 	return true, nil
 }
 
@@ -238,8 +569,8 @@ func (u *Updater) runNext2() (bool, error) {
 	}
 
 	// Spawn child process.
-	p, err := os.StartProcess(u.execName, u.commandLineArgs, &os.ProcAttr{
-		Dir:   u.pwdDir,
+	p, err := os.StartProcess(u.opts.ExecPath, u.opts.Args, &os.ProcAttr{
+		Dir:   u.opts.WorkDir,
 		Env:   os.Environ(),
 		Files: files,
 		Sys:   &syscall.SysProcAttr{},
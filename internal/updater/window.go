@@ -0,0 +1,221 @@
+package updater
+
+import (
+	"context"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+var weekdays = map[string]time.Weekday{
+	"sun": time.Sunday,
+	"mon": time.Monday,
+	"tue": time.Tuesday,
+	"wed": time.Wednesday,
+	"thu": time.Thursday,
+	"fri": time.Friday,
+	"sat": time.Saturday,
+}
+
+// Window is the maintenance window when the updates can be applied,
+// e.g. "Mon-Fri 22:00-06:00 Europe/Berlin". The window which ends before
+// it starts goes over midnight, it belongs to the day of its start.
+type Window struct {
+	days     [7]bool
+	start    int // minutes from midnight
+	end      int // minutes from midnight, up to 24:00
+	location *time.Location
+	source   string
+}
+
+// ParseWindow parses the window "<days> <HH:MM>-<HH:MM> [<time zone>]".
+// Days are "*", "Mon-Fri", "Sat,Sun" or "Mon,Wed-Fri". The range may end at 24:00, but not start.
+// The default time zone is local.
+func ParseWindow(s string) (Window, error) {
+	w := Window{location: time.Local, source: s}
+
+	fields := strings.Fields(s)
+	if len(fields) < 2 || len(fields) > 3 {
+		return w, errors.Errorf("window %q: expected \"<days> <HH:MM>-<HH:MM> [<time zone>]\"", s)
+	}
+
+	if err := w.parseDays(fields[0]); err != nil {
+		return w, errors.Wrapf(err, "window %q", s)
+	}
+
+	from, to, find := strings.Cut(fields[1], "-")
+	if !find {
+		return w, errors.Errorf("window %q: bad time range %q", s, fields[1])
+	}
+
+	var err error
+	if w.start, err = parseClock(from, false); err != nil {
+		return w, errors.Wrapf(err, "window %q", s)
+	}
+	if w.end, err = parseClock(to, true); err != nil {
+		return w, errors.Wrapf(err, "window %q", s)
+	}
+	if w.start == w.end {
+		return w, errors.Errorf("window %q: empty time range", s)
+	}
+
+	if len(fields) == 3 {
+		if w.location, err = time.LoadLocation(fields[2]); err != nil {
+			return w, errors.Wrapf(err, "window %q", s)
+		}
+	}
+
+	return w, nil
+}
+
+func (w *Window) parseDays(s string) error {
+	if s == "*" {
+		for i := range w.days {
+			w.days[i] = true
+		}
+		return nil
+	}
+
+	for _, item := range strings.Split(s, ",") {
+		from, to, isRange := strings.Cut(item, "-")
+
+		first, find := weekdays[strings.ToLower(from)]
+		if !find {
+			return errors.Errorf("unknown day %q", from)
+		}
+
+		last := first
+		if isRange {
+			if last, find = weekdays[strings.ToLower(to)]; !find {
+				return errors.Errorf("unknown day %q", to)
+			}
+		}
+
+		// Fri-Mon goes over the end of the week
+		for d := first; ; d = (d + 1) % 7 {
+			w.days[d] = true
+			if d == last {
+				break
+			}
+		}
+	}
+
+	return nil
+}
+
+// parseClock returns the minutes of the day, 24:00 is allowed for the end of the range only.
+func parseClock(s string, end bool) (int, error) {
+	h, m, find := strings.Cut(s, ":")
+	if !find {
+		return 0, errors.Errorf("bad time %q, expected HH:MM", s)
+	}
+
+	hours, err := strconv.Atoi(h)
+	if err != nil {
+		return 0, errors.Errorf("bad time %q, expected HH:MM", s)
+	}
+	minutes, err := strconv.Atoi(m)
+	if err != nil {
+		return 0, errors.Errorf("bad time %q, expected HH:MM", s)
+	}
+
+	if hours < 0 || minutes < 0 || minutes > 59 || hours*60+minutes > 24*60 {
+		return 0, errors.Errorf("bad time %q", s)
+	}
+	if hours*60+minutes == 24*60 && !end {
+		return 0, errors.Errorf("bad time %q, 24:00 is the end of the day only", s)
+	}
+
+	return hours*60 + minutes, nil
+}
+
+func (w Window) String() string {
+	return w.source
+}
+
+// Contains reports whether t is inside the window.
+func (w Window) Contains(t time.Time) bool {
+	t = t.In(w.location)
+	minute := t.Hour()*60 + t.Minute()
+
+	if w.start < w.end {
+		return w.days[t.Weekday()] && minute >= w.start && minute < w.end
+	}
+
+	// over midnight: the end of the window started today or the tail of the yesterday's one
+	yesterday := (t.Weekday() + 6) % 7
+	return (w.days[t.Weekday()] && minute >= w.start) || (w.days[yesterday] && minute < w.end)
+}
+
+// Next returns the start of the next window after t or t if t is inside the window.
+func (w Window) Next(t time.Time) time.Time {
+	if w.Contains(t) {
+		return t
+	}
+
+	local := t.In(w.location)
+	midnight := time.Date(local.Year(), local.Month(), local.Day(), 0, 0, 0, 0, w.location)
+	for i := 0; i <= 7; i++ {
+		// the wall clock, the day of the DST change is shorter or longer than 24 hours
+		day := midnight.AddDate(0, 0, i)
+		start := time.Date(day.Year(), day.Month(), day.Day(), w.start/60, w.start%60, 0, 0, w.location)
+		if w.days[day.Weekday()] && start.After(t) {
+			return start
+		}
+	}
+
+	// unreachable for a valid window
+	return t.Add(24 * time.Hour)
+}
+
+// ParseWindows parses the windows separated by ";".
+func ParseWindows(s string) ([]Window, error) {
+	out := make([]Window, 0)
+	for _, item := range strings.Split(s, ";") {
+		if strings.TrimSpace(item) == "" {
+			continue
+		}
+
+		w, err := ParseWindow(item)
+		if err != nil {
+			return nil, err
+		}
+		out = append(out, w)
+	}
+
+	return out, nil
+}
+
+// untilWindow returns the time until the nearest window or 0 if now is inside one.
+func (u *Updater) untilWindow(now time.Time) time.Duration {
+	if len(u.opts.MaintenanceWindows) == 0 {
+		return 0
+	}
+
+	var next time.Time
+	for i, w := range u.opts.MaintenanceWindows {
+		n := w.Next(now)
+		if i == 0 || n.Before(next) {
+			next = n
+		}
+	}
+
+	return next.Sub(now)
+}
+
+// windowHook postpones the apply and the restart until the maintenance window.
+// The critical releases are applied at once.
+func (u *Updater) windowHook(_ context.Context, info HookInfo) error {
+	if info.Critical || info.Rollback || info.Revoked {
+		return nil
+	}
+
+	if d := u.untilWindow(time.Now()); d > 0 {
+		return errors.Wrap(Postpone(d), fmt.Sprintf("outside maintenance windows %v", u.opts.MaintenanceWindows))
+	}
+
+	return nil
+}
@@ -0,0 +1,59 @@
+package updater_test
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+
+	"nametag/internal/updater"
+)
+
+func Test_Window(t *testing.T) {
+	w, err := updater.ParseWindow("Mon-Fri 22:00-06:00 UTC")
+	assert.Nil(t, err, "ParseWindow")
+
+	// 2024-09-02 is Monday
+	at := func(day, hour, minute int) time.Time {
+		return time.Date(2024, 9, day, hour, minute, 0, 0, time.UTC)
+	}
+
+	assert.True(t, w.Contains(at(2, 23, 0)), "Mon night")
+	assert.True(t, w.Contains(at(3, 5, 59)), "Tue morning, Mon window")
+	assert.False(t, w.Contains(at(3, 6, 0)), "Tue day")
+	assert.True(t, w.Contains(at(7, 1, 0)), "Sat morning, Fri window")
+	assert.False(t, w.Contains(at(7, 23, 0)), "Sat night")
+	assert.False(t, w.Contains(at(2, 1, 0)), "Mon morning, no Sun window")
+
+	assert.Equal(t, at(2, 22, 0), w.Next(at(2, 12, 0)), "today")
+	assert.Equal(t, at(9, 22, 0), w.Next(at(7, 12, 0)), "after the weekend")
+	assert.Equal(t, at(2, 23, 0), w.Next(at(2, 23, 0)), "inside")
+
+	// time zones
+	w, err = updater.ParseWindow("* 02:00-04:00 Asia/Tokyo")
+	assert.Nil(t, err, "ParseWindow")
+	assert.True(t, w.Contains(at(2, 18, 0)), "03:00 in Tokyo")
+
+	// the DST changes: 2024-03-31 has 23 hours in Berlin, 2024-10-27 has 25 hours
+	w, err = updater.ParseWindow("* 03:00-05:00 Europe/Berlin")
+	if assert.Nil(t, err, "ParseWindow") {
+		berlin, _ := time.LoadLocation("Europe/Berlin")
+		for _, day := range []time.Time{
+			time.Date(2024, 3, 31, 0, 30, 0, 0, berlin),
+			time.Date(2024, 10, 27, 0, 30, 0, 0, berlin),
+		} {
+			next := w.Next(day).In(berlin)
+			assert.Equal(t, time.Date(day.Year(), day.Month(), day.Day(), 3, 0, 0, 0, berlin), next, day.String())
+			assert.True(t, w.Contains(next), day.String())
+		}
+	}
+
+	for _, s := range []string{"Mon", "Funday 01:00-02:00", "Mon 01:00-01:00", "Mon 25:00-26:00", "Mon 24:00-02:00", "Mon 01:00-02:00 Mars/Base"} {
+		_, err := updater.ParseWindow(s)
+		assert.NotNil(t, err, s)
+	}
+
+	windows, err := updater.ParseWindows("Sat,Sun 00:00-24:00; Mon-Fri 22:00-06:00")
+	assert.Nil(t, err, "ParseWindows")
+	assert.Len(t, windows, 2)
+}
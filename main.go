@@ -6,13 +6,19 @@ package main
 
 import (
 	"context"
+	"errors"
 	"fmt"
+	"net"
 	"net/http"
 	"os"
+	"strconv"
+	"time"
 
 	"github.com/libp2p/go-reuseport"
 
 	"nametag/internal/lg"
+	"nametag/internal/lifecycle"
+	"nametag/internal/listener"
 	"nametag/internal/signature/verify"
 	"nametag/internal/updater"
 )
@@ -24,31 +30,64 @@ var (
 	// We use a separate log file for each version
 	LogFile = "./data/logs/%s.log" // todo: move to configuration
 	Address = "127.0.0.1:8081"     // todo: move to configuration
+
+	// DrainTimeout is the time for the in-flight requests to finish after the update
+	DrainTimeout = lifecycle.DefaultDrainTimeout // todo: move to configuration
+
+	// ReusePort switches from the inherited listener to SO_REUSEPORT:
+	// each version binds the address itself.
+	ReusePort = false // todo: move to configuration
 )
 
 type simpleHandler struct {
 	pid int
+	u   *updater.Updater
 }
 
 func (h *simpleHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	// the updater health check skips the responses of the old process
+	w.Header().Set(updater.PidHeader, strconv.Itoa(h.pid))
 	w.WriteHeader(http.StatusOK)
 	fmt.Fprintf(w, "Hello from PID %d and Version %s\n", h.pid, Version)
+
+	s := h.u.Status()
+	if s.BlockedVersion != "" {
+		fmt.Fprintf(w, "version %s is blocked by the update policy: %s\n", s.BlockedVersion, s.BlockedReason)
+	}
+	if s.Revoked {
+		fmt.Fprintf(w, "this version is revoked: %s\n", s.RevokedReason)
+	}
+
+	if p := h.u.Progress(); p.Uri != "" && !p.Done {
+		if percent := p.Percent(); percent >= 0 {
+			fmt.Fprintf(w, "update %.0f%% downloaded, eta %s\n", percent, p.ETA.Round(time.Second))
+		} else {
+			fmt.Fprintf(w, "update %d bytes downloaded\n", p.Received)
+		}
+	}
 }
 
-func prepareServer() (*lg.Logger, *updater.Updater, error) {
+func prepareServer(listeners *listener.Registry) (*lg.Logger, *updater.Updater, error) {
 	log, err := lg.New(fmt.Sprintf(LogFile, Version), Version)
 	if err != nil {
 		return nil, nil, err
 	}
 
-	log.Infof("start version: %s, pid: %s", Version, os.Getpid())
+	log.Infof("start version: %s, pid: %d", Version, os.Getpid())
 	ver, err := verify.New()
 	if err != nil {
 		log.Errorf("error create verify: %s", err.Error())
 		return nil, nil, err
 	}
 
-	u, err := updater.New(log, ver, Version)
+	// the environment variables have priority over the config file
+	u, err := updater.New(log, ver, Version,
+		// the new version reports that it's ready by updater.NotifyReady
+		updater.WithHealthCheck(updater.NewHandshake(), updater.DefaultHealthCheckTimeout),
+		updater.WithListeners(listeners),
+		updater.WithConfigFile(os.Getenv(updater.EnvConfigFile)),
+		updater.WithEnv(),
+	)
 	if err != nil {
 		log.Errorf("error create updater: %s", err.Error())
 		return nil, nil, err
@@ -58,29 +97,59 @@ func prepareServer() (*lg.Logger, *updater.Updater, error) {
 }
 
 func main() {
-	log, u, err := prepareServer()
+	listeners, err := listener.New()
+	if err != nil {
+		panic(err)
+	}
+
+	log, u, err := prepareServer(listeners)
 	if err != nil {
 		panic(err)
 	}
 	defer log.Close()
 
-	l, err := reuseport.Listen("tcp", Address)
+	var l net.Listener
+	if ReusePort {
+		l, err = reuseport.Listen("tcp", Address)
+	} else {
+		// the listener of the previous version or a new one on a fresh start
+		l, err = listeners.Listen("http", "tcp", Address)
+	}
 	if err != nil {
 		log.Fatal(err.Error())
 	}
 
+	// the parent process waits for it to stop serving
+	if err := updater.NotifyReady(Version); err != nil {
+		log.Errorf("notify ready: %s", err.Error())
+	}
+
 	server := &http.Server{}
-	server.Handler = &simpleHandler{pid: os.Getpid()}
+	server.Handler = &simpleHandler{pid: os.Getpid(), u: u}
+	ls := lifecycle.New(server, DrainTimeout)
 
+	drained := make(chan struct{})
 	go func() {
+		defer close(drained)
+
 		// waiting for the new version
 		if u.Check(context.Background()) {
-			// shutdown the server
-			_ = l.Close()
-			_ = server.Close()
+			// stop the server, the new version is ready
+			inFlight, err := ls.Drain(context.Background())
+			if err != nil {
+				log.Errorf("drain: %s, in flight: %d", err.Error(), inFlight)
+			} else {
+				log.Infof("drain: done")
+			}
 		}
 	}()
 
 	// run our server
-	server.Serve(l)
+	if err := server.Serve(l); !errors.Is(err, http.ErrServerClosed) {
+		log.Errorf("serve: %s", err.Error())
+		return
+	}
+
+	// Serve returns at once after Shutdown, wait for the in-flight requests
+	<-drained
 }